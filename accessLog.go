@@ -0,0 +1,194 @@
+package opal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/SveinungOverland/opal/http"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+/*
+	This file contains the access logging. An entry is made for every
+	served request, and the access logger of the server decides how
+	and where it is written. Nothing is logged by default.
+*/
+
+// AccessEntry describes a served request and its response
+type AccessEntry struct {
+	Time       time.Time     `json:"time"` // When the handlers started serving the request
+	Method     string        `json:"method"`
+	Path       string        `json:"path"` // The path of the request, with its query
+	Proto      string        `json:"proto"`
+	Status     uint16        `json:"status"`
+	Bytes      int           `json:"bytes"`       // Size of the response body, including flushed data
+	Duration   time.Duration `json:"duration_ns"` // How long it took to serve the request
+	StreamID   uint32        `json:"stream_id"`   // Zero for HTTP/1.1 requests
+	RemoteAddr string        `json:"remote_addr"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+}
+
+// AccessLogger logs served requests. Log is called concurrently by the connections, after the
+// response is handed over to be written. It is called on the goroutine serving the request, and
+// on HTTP/1.1 connections before the next request is read, so Log must not block. A logger
+// writing to something slow, like a network connection, should hand the entries over to a
+// goroutine of its own.
+type AccessLogger interface {
+	Log(entry *AccessEntry)
+}
+
+// SetAccessLogger sets the logger every served request is logged to. Nil disables access logging, which is the default.
+func (s *Server) SetAccessLogger(logger AccessLogger) {
+	s.accessLogger = logger
+}
+
+// NewTextLogger creates an AccessLogger writing entries as lines of text, like
+// "2006-01-02T15:04:05Z 127.0.0.1:52100 HTTP/2 GET /index.html 200 512 1.2ms stream=1".
+// Control characters and bytes outside ASCII sent by the client are escaped as \xHH.
+func NewTextLogger(w io.Writer) AccessLogger {
+	return &writerLogger{w: w, format: formatText}
+}
+
+// NewJSONLogger creates an AccessLogger writing entries as JSON objects, one per line
+func NewJSONLogger(w io.Writer) AccessLogger {
+	return &writerLogger{w: w, format: formatJSON}
+}
+
+// NewCombinedLogger creates an AccessLogger writing entries in the Combined Log Format of Apache and nginx.
+// Like nginx, control characters and bytes outside ASCII are escaped as \xHH, and quotes as \".
+func NewCombinedLogger(w io.Writer) AccessLogger {
+	return &writerLogger{w: w, format: formatCombined}
+}
+
+// NewColorLogger creates an AccessLogger printing the protocol, method, path and a colored status of every entry to the console
+func NewColorLogger() AccessLogger {
+	return &writerLogger{w: color.Output, format: formatColor}
+}
+
+// ------- HELPERS ---------
+
+// writerLogger writes formatted entries to a writer, one entry at a time
+type writerLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format func(entry *AccessEntry) []byte
+}
+
+func (l *writerLogger) Log(entry *AccessEntry) {
+	line := l.format(entry)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// LogAccess creates an entry for a served request, and logs it if the server has an access logger.
+// Bytes is the size of the response body, including the data that was flushed.
+func (c *Conn) logAccess(req *http.Request, res *http.Response, streamID uint32, start time.Time, bytes int) {
+	logger := c.server.accessLogger
+	if logger == nil {
+		return
+	}
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/2"
+	}
+	var remoteAddr string
+	if c.conn != nil {
+		remoteAddr = c.conn.RemoteAddr().String()
+	}
+	logger.Log(&AccessEntry{
+		Time:       start,
+		Method:     req.Method,
+		Path:       req.URI + req.RawQuery,
+		Proto:      proto,
+		Status:     res.Status,
+		Bytes:      bytes,
+		Duration:   time.Since(start),
+		StreamID:   streamID,
+		RemoteAddr: remoteAddr,
+		Referer:    req.Header["referer"],
+		UserAgent:  req.Header["user-agent"],
+	})
+}
+
+// FormatText formats an entry as a line of text
+func formatText(entry *AccessEntry) []byte {
+	line := fmt.Sprintf("%s %s %s %s %s %d %d %s", entry.Time.Format(time.RFC3339), orDash(entry.RemoteAddr), entry.Proto,
+		escapeField(entry.Method), escapeField(entry.Path), entry.Status, entry.Bytes, entry.Duration)
+	if entry.StreamID != 0 {
+		line += " stream=" + strconv.FormatUint(uint64(entry.StreamID), 10)
+	}
+	return []byte(line + "\n")
+}
+
+// FormatJSON formats an entry as a JSON object on its own line
+func formatJSON(entry *AccessEntry) []byte {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil
+	}
+	return append(line, '\n')
+}
+
+// FormatCombined formats an entry in the Combined Log Format:
+// host ident authuser [date] "request-line" status bytes "referer" "user-agent"
+func formatCombined(entry *AccessEntry) []byte {
+	host := entry.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.Itoa(entry.Bytes)
+	}
+	return []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n", orDash(host),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"), escapeField(entry.Method), escapeField(entry.Path), entry.Proto,
+		entry.Status, bytes, orDash(escapeField(entry.Referer)), orDash(escapeField(entry.UserAgent))))
+}
+
+// FormatColor formats an entry like the console output of earlier versions, with the status colored by its class
+func formatColor(entry *AccessEntry) []byte {
+	var statusColor func(a ...interface{}) string
+	if entry.Status < 300 {
+		statusColor = color.New(color.FgGreen).SprintFunc()
+	} else if entry.Status < 400 {
+		statusColor = color.New(color.FgYellow).SprintFunc()
+	} else {
+		statusColor = color.New(color.FgRed).SprintFunc()
+	}
+	return []byte(fmt.Sprintf("%s %s %s %s\n", entry.Proto, escapeField(entry.Method), escapeField(entry.Path), statusColor(strconv.Itoa(int(entry.Status)))))
+}
+
+// OrDash replaces an empty field with "-", which is how missing fields are logged in the Combined Log Format
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// EscapeField escapes a field sent by the client, so it can not forge log lines or escape sequences of the terminal.
+// Control characters and bytes outside ASCII are escaped as \xHH, and quotes and backslashes with a backslash.
+func escapeField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package opal
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := newTestAccessEntry()
+	tests := []struct {
+		logger   func(buf *bytes.Buffer) AccessLogger
+		expected string
+	}{
+		{
+			func(buf *bytes.Buffer) AccessLogger { return NewTextLogger(buf) },
+			"2019-10-10T13:55:36Z 10.0.0.1:52100 HTTP/2 GET /users?id=1 200 512 1.5ms stream=3\n",
+		},
+		{
+			func(buf *bytes.Buffer) AccessLogger { return NewCombinedLogger(buf) },
+			"10.0.0.1 - - [10/Oct/2019:13:55:36 +0000] \"GET /users?id=1 HTTP/2\" 200 512 \"-\" \"curl \\\"7.0\\\"\"\n",
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		test.logger(&buf).Log(entry)
+		if buf.String() != test.expected {
+			t.Errorf("Incorrect log line! Expected %q, got %q", test.expected, buf.String())
+		}
+	}
+}
+
+func TestAccessLogEscaping(t *testing.T) {
+	entry := newTestAccessEntry()
+	entry.Path = "/a 200 0\n2019-10-10T13:55:36Z forged"
+	entry.UserAgent = "\x1b[31mred\\"
+	tests := []struct {
+		logger   func(buf *bytes.Buffer) AccessLogger
+		expected string
+	}{
+		{
+			func(buf *bytes.Buffer) AccessLogger { return NewTextLogger(buf) },
+			"2019-10-10T13:55:36Z 10.0.0.1:52100 HTTP/2 GET /a 200 0\\x0a2019-10-10T13:55:36Z forged 200 512 1.5ms stream=3\n",
+		},
+		{
+			func(buf *bytes.Buffer) AccessLogger { return NewCombinedLogger(buf) },
+			"10.0.0.1 - - [10/Oct/2019:13:55:36 +0000] \"GET /a 200 0\\x0a2019-10-10T13:55:36Z forged HTTP/2\" 200 512 \"-\" \"\\x1b[31mred\\\\\"\n",
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		test.logger(&buf).Log(entry)
+		if buf.String() != test.expected {
+			t.Errorf("Incorrect log line! Expected %q, got %q", test.expected, buf.String())
+		}
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	NewJSONLogger(&buf).Log(newTestAccessEntry())
+
+	var actual AccessEntry
+	if err := json.Unmarshal(buf.Bytes(), &actual); err != nil {
+		t.Fatalf("Log line is not JSON: %v", err)
+	}
+	if expected := newTestAccessEntry(); actual != *expected {
+		t.Errorf("Incorrect entry! Expected %+v, got %+v", *expected, actual)
+	}
+}
+
+func TestAccessLogHTTP2(t *testing.T) {
+	logger := &testAccessLogger{entries: make(chan *AccessEntry, 10)}
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	srv.SetAccessLogger(logger)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/", "GET", true)
+	client.readFrame(t, frame.HeadersType, 1)
+
+	entry := logger.next(t)
+	if entry.Method != "GET" || entry.Path != "/" || entry.Proto != "HTTP/2" || entry.StreamID != 1 {
+		t.Errorf("Incorrect request in entry! Got %s %s %s on stream %d", entry.Proto, entry.Method, entry.Path, entry.StreamID)
+	}
+	if entry.Status != 400 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 400, entry.Status)
+	}
+	if entry.RemoteAddr != "pipe" {
+		t.Errorf("Incorrect remote address! Expected %q, got %q", "pipe", entry.RemoteAddr)
+	}
+}
+
+func TestAccessLogHTTP1(t *testing.T) {
+	logger := &testAccessLogger{entries: make(chan *AccessEntry, 10)}
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	srv.SetAccessLogger(logger)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+
+	go client.conn.Write([]byte("POST /test?q=1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\nConnection: close\r\n\r\nTEST"))
+	_, _, body := readHTTP1Response(t, client.br)
+
+	entry := logger.next(t)
+	if entry.Method != "POST" || entry.Path != "/test?q=1" || entry.Proto != "HTTP/1.1" || entry.StreamID != 0 {
+		t.Errorf("Incorrect request in entry! Got %s %s %s on stream %d", entry.Proto, entry.Method, entry.Path, entry.StreamID)
+	}
+	if entry.Status != 200 || entry.Bytes != len(body) {
+		t.Errorf("Incorrect response in entry! Expected %d with %d bytes, got %d with %d bytes", 200, len(body), entry.Status, entry.Bytes)
+	}
+}
+
+func TestAccessLogHTTP1Bytes(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Get("/flushed", func(req *http.Request, res *http.Response) {
+		res.Write([]byte("first "))
+		res.Flush()
+		res.Write([]byte("second"))
+	})
+
+	// The body of the 404 response to a HEAD request is not sent
+	tests := map[string]int{"GET /flushed": len("first second"), "HEAD /missing": 0}
+	for request, expected := range tests {
+		t.Run(request, func(t *testing.T) {
+			logger := &testAccessLogger{entries: make(chan *AccessEntry, 10)}
+			srv := NewServer()
+			srv.Register(r)
+			srv.SetAccessLogger(logger)
+			client := newPipeClient(srv)
+			defer client.conn.Close()
+
+			go client.conn.Write([]byte(request + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+			go ioutil.ReadAll(client.br)
+			if entry := logger.next(t); entry.Bytes != expected {
+				t.Errorf("Incorrect number of bytes in entry! Expected %d, got %d", expected, entry.Bytes)
+			}
+		})
+	}
+}
+
+// ---------- HELPERS --------------
+
+// testAccessLogger sends the entries it gets to a channel
+type testAccessLogger struct {
+	entries chan *AccessEntry
+}
+
+func (l *testAccessLogger) Log(entry *AccessEntry) {
+	l.entries <- entry
+}
+
+// Next waits for the next logged entry
+func (l *testAccessLogger) next(t *testing.T) *AccessEntry {
+	select {
+	case entry := <-l.entries:
+		return entry
+	case <-time.After(time.Second):
+		t.Fatal("No request was logged")
+		return nil
+	}
+}
+
+func newTestAccessEntry() *AccessEntry {
+	return &AccessEntry{
+		Time:       time.Date(2019, 10, 10, 13, 55, 36, 0, time.UTC),
+		Method:     "GET",
+		Path:       "/users?id=1",
+		Proto:      "HTTP/2",
+		Status:     200,
+		Bytes:      512,
+		Duration:   1500 * time.Microsecond,
+		StreamID:   3,
+		RemoteAddr: "10.0.0.1:52100",
+		UserAgent:  "curl \"7.0\"",
+	}
+}
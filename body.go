@@ -0,0 +1,192 @@
+package opal
+
+import (
+	"errors"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"io"
+	"sync"
+)
+
+/*
+	This file contains the body of a request, which is fed by the
+	DATA frames of a stream as they arrive. Flow-control credit is
+	returned to the client as the handler reads the body, half a
+	window at a time.
+*/
+
+// ErrBodyReset is returned when reading a request body of a stream that was reset, or a connection that was closed
+var ErrBodyReset = errors.New("opal: Request body was reset")
+
+// errBodyClosed is returned when reading a request body that was closed by the handler
+var errBodyClosed = errors.New("opal: Read on closed request body")
+
+// requestBody is an io.ReadCloser of the data received on a stream
+type requestBody struct {
+	conn   *Conn
+	stream *Stream
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte // Received data that is not read yet
+	err    error    // Returned when all chunks are read. io.EOF if the client ended the stream
+	closed bool     // Set when the handler closes the body, received data is discarded
+
+	unreturned uint32 // Credit of read data that is not returned to the client yet
+
+	trailer map[string]string // The request trailers, added before the body is ended
+}
+
+func newRequestBody(conn *Conn, stream *Stream) *requestBody {
+	body := &requestBody{conn: conn, stream: stream, trailer: make(map[string]string)}
+	body.cond = sync.NewCond(&body.mu)
+	return body
+}
+
+// Read reads received data, and waits for more if all received data is read
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.chunks) == 0 && b.err == nil && !b.closed {
+		if b.unreturned > 0 {
+			// Credit is returned before waiting for more data, so the client is never left waiting for it
+			b.returnCredit()
+			continue
+		}
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, errBodyClosed
+	}
+	if len(b.chunks) == 0 {
+		b.returnCredit()
+		return 0, b.err
+	}
+
+	n := copy(p, b.chunks[0])
+	if n == len(b.chunks[0]) {
+		b.chunks = b.chunks[1:]
+	} else {
+		b.chunks[0] = b.chunks[0][n:]
+	}
+	b.unreturned += uint32(n)
+	if b.unreturned >= b.creditThreshold() || (len(b.chunks) == 0 && b.err != nil) {
+		b.returnCredit()
+	}
+	return n, nil
+}
+
+// Close discards the data that is not read yet. Data received later is discarded as well.
+func (b *requestBody) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	unread := 0
+	for _, chunk := range b.chunks {
+		unread += len(chunk)
+	}
+	b.chunks = nil
+	unread += int(b.unreturned)
+	b.unreturned = 0
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	// The connection window is shared by all streams, and is restored for the discarded data. The stream
+	// window is not, as the stream is reset when the response is sent, see abandoned.
+	b.conn.returnCredit(nil, uint32(unread))
+	return nil
+}
+
+// ------- HELPERS ---------
+
+// ReturnCredit returns the credit of the data read since it was last returned. It is called with b.mu held,
+// which is released while the WINDOW_UPDATE frames are queued.
+func (b *requestBody) returnCredit() {
+	n := b.unreturned
+	ended := b.err != nil
+	b.unreturned = 0
+	b.mu.Unlock()
+	defer b.mu.Lock()
+
+	// The stream window is not restored if the client will not send more data on the stream
+	b.conn.returnCredit(nil, n)
+	if !ended {
+		b.conn.returnCredit(b.stream, n)
+	}
+}
+
+// CreditThreshold is how much credit is collected before it is returned. Half of the smallest receive
+// window is returned at a time, so a handler reading a few bytes at a time does not flood the client.
+func (b *requestBody) creditThreshold() uint32 {
+	window := b.conn.localSettings.InitialWindowSize
+	if window > initialWindowSize {
+		window = initialWindowSize // The connection window is never larger than the initial window
+	}
+	return window / 2
+}
+
+// Abandoned says if the handler closed the body before the client ended it, or the body is larger than the server
+// accepts. The client is then asked to stop sending the body when the response is sent - RFC7540 Section 8.1.
+func (b *requestBody) abandoned() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return (b.closed && b.err == nil) || b.err == http.ErrBodyTooLarge
+}
+
+// TooLarge says if the body was ended because it is larger than the server accepts
+func (b *requestBody) tooLarge() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err == http.ErrBodyTooLarge
+}
+
+// Write adds data received on the stream. Returns false if the body is closed or ended,
+// in which case the caller is responsible for returning the credit.
+func (b *requestBody) write(data []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.err != nil {
+		return false
+	}
+	if len(data) > 0 {
+		b.chunks = append(b.chunks, data)
+		b.cond.Broadcast()
+	}
+	return true
+}
+
+// CloseWithTrailer adds the trailers received after the data, and ends the body
+func (b *requestBody) closeWithTrailer(hfs []*hpack.HeaderField) {
+	b.mu.Lock()
+	for _, hf := range hfs {
+		b.trailer[hf.Name] = hf.Value
+	}
+	b.mu.Unlock()
+	b.closeWithError(io.EOF)
+}
+
+// CloseWithError makes reads return an error when all received data is read.
+// The error is io.EOF when the client has ended the stream.
+func (b *requestBody) closeWithError(err error) {
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return
+	}
+	unread := 0
+	if err != io.EOF {
+		// Data of a reset stream is not complete, and is not read
+		for _, chunk := range b.chunks {
+			unread += len(chunk)
+		}
+		b.chunks = nil
+	}
+	b.err = err
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	b.conn.returnCredit(nil, uint32(unread))
+}
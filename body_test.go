@@ -0,0 +1,294 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamingRequestBody(t *testing.T) {
+	started := make(chan struct{})
+	r := router.NewRouter("/")
+	r.Streaming("/upload")
+	r.Post("/upload", func(req *http.Request, res *http.Response) {
+		close(started)
+		body, err := ioutil.ReadAll(req.BodyReader())
+		if err != nil {
+			t.Errorf("Reading body failed: %v", err)
+		}
+		res.Body = body
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/upload", "POST", false)
+
+	// The handler should run before the body is received
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Handler was not started before the request body was received")
+	}
+
+	client.writeFrame(newTestData(1, "UPLOAD", false))
+	for _, streamID := range []uint32{0, 1} {
+		f := client.readFrame(t, frame.WindowUpdateType, streamID)
+		if increment := f.Payload.(*types.WindowUpdatePayload).WindowSizeIncrement; increment != 6 {
+			t.Errorf("Incorrect window increment on stream %d. Expected %d, got %d", streamID, 6, increment)
+		}
+	}
+	client.writeFrame(newTestData(1, "ED", true))
+
+	f := client.readFrame(t, frame.DataType, 1)
+	if data := string(f.Payload.(*types.DataPayload).Data); data != "UPLOADED" {
+		t.Errorf("Incorrect body read by handler. Expected %s, got %s", "UPLOADED", data)
+	}
+}
+
+func TestRequestBodyReset(t *testing.T) {
+	errChan := make(chan error, 1)
+	r := router.NewRouter("/")
+	r.Streaming("/upload")
+	r.Post("/upload", func(req *http.Request, res *http.Response) {
+		_, err := ioutil.ReadAll(req.BodyReader())
+		errChan <- err
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/upload", "POST", false)
+	client.writeFrame(newTestData(1, "PART", false))
+	client.writeFrame(frame.NewErrorFrame(1, constants.Cancel))
+
+	select {
+	case err := <-errChan:
+		if err != ErrBodyReset {
+			t.Errorf("Incorrect error! Expected %v, got %v", ErrBodyReset, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reading the body of a reset stream did not return")
+	}
+}
+
+func TestRequestBodyCreditCollected(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Streaming("/upload")
+	r.Post("/upload", func(req *http.Request, res *http.Response) {
+		// The body is read a byte at a time
+		p := make([]byte, 1)
+		n := 0
+		for {
+			if _, err := req.BodyReader().Read(p); err != nil {
+				break
+			}
+			n++
+		}
+		res.String(200, strconv.Itoa(n))
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/upload", "POST", false)
+	client.writeFrame(newTestData(1, strings.Repeat("a", 1000), false))
+
+	// The credit of every byte read is returned at once, when the handler waits for more data
+	for _, streamID := range []uint32{0, 1} {
+		f := client.readFrame(t, frame.WindowUpdateType, streamID)
+		if increment := f.Payload.(*types.WindowUpdatePayload).WindowSizeIncrement; increment != 1000 {
+			t.Errorf("Incorrect window increment on stream %d. Expected %d, got %d", streamID, 1000, increment)
+		}
+	}
+	client.writeFrame(newTestData(1, "", true))
+	f := client.readFrame(t, frame.DataType, 1)
+	if data := string(f.Payload.(*types.DataPayload).Data); data != "1000" {
+		t.Errorf("Incorrect number of bytes read by handler. Expected %s, got %s", "1000", data)
+	}
+}
+
+func TestRequestBodyClosedEarly(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Streaming("/upload")
+	r.Post("/upload", func(req *http.Request, res *http.Response) {
+		req.BodyReader().Close()
+		res.String(200, "ignored")
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/upload", "POST", false)
+	client.writeFrame(newTestData(1, "PART", false))
+
+	// The response is sent in full, and the client is then asked to stop sending the body
+	f := client.readFrame(t, frame.DataType, 1)
+	if !f.Flags.(*types.DataFlags).EndStream {
+		t.Error("Response was not ended before the stream was reset")
+	}
+	rst := client.readFrame(t, frame.RstStreamType, 1)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.NoError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.NoError, code)
+	}
+}
+
+func TestRequestBodyTooLarge(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Post("/upload", func(req *http.Request, res *http.Response) {
+		t.Error("Handler was run for a body larger than the limit")
+	})
+
+	srv := NewServer()
+	srv.SetMaxBodySize(10)
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/upload", "POST", false)
+	client.writeFrame(newTestData(1, "0123456789", false))
+	client.writeFrame(newTestData(1, "X", false))
+
+	headers := client.readHeaders(t, 1)
+	if headers[0].Value != "413" {
+		t.Errorf("Incorrect status! Expected %s, got %s", "413", headers[0].Value)
+	}
+	// The client is asked to stop sending the rest of the body
+	rst := client.readFrame(t, frame.RstStreamType, 1)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.NoError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.NoError, code)
+	}
+}
+
+func TestRequestContentLengthTooLarge(t *testing.T) {
+	srv := NewServer()
+	srv.SetMaxBodySize(10)
+	srv.Register(newTestRouter())
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	fields := append(newTestHeaders("/test", "POST"), hf("content-length", "11"))
+	client.writeFrame(newTestHeadersFrame(1, client.hpack.Encode(fields), true, false))
+
+	// The response is sent before any data
+	headers := client.readHeaders(t, 1)
+	if headers[0].Value != "413" {
+		t.Errorf("Incorrect status! Expected %s, got %s", "413", headers[0].Value)
+	}
+}
+
+func TestStreamingRequestBodyTooLarge(t *testing.T) {
+	errChan := make(chan error, 1)
+	r := router.NewRouter("/")
+	r.Streaming("/upload")
+	r.Post("/upload", func(req *http.Request, res *http.Response) {
+		res.Flush()
+		_, err := ioutil.ReadAll(req.BodyReader())
+		errChan <- err
+	})
+
+	srv := NewServer()
+	srv.SetMaxBodySize(10)
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/upload", "POST", false)
+	client.readHeaders(t, 1)
+	client.writeFrame(newTestData(1, "0123456789X", false))
+
+	select {
+	case err := <-errChan:
+		if err != http.ErrBodyTooLarge {
+			t.Errorf("Incorrect error! Expected %v, got %v", http.ErrBodyTooLarge, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not read the body")
+	}
+	// The headers are already sent, so the stream is reset
+	rst := client.readFrame(t, frame.RstStreamType, 1)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.Cancel {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.Cancel, code)
+	}
+}
+
+// ---------- HELPERS --------------
+
+func TestRequestTrailers(t *testing.T) {
+	trailers := make(chan map[string]string, 1)
+	r := router.NewRouter("/")
+	r.Streaming("/upload")
+	r.Post("/upload", func(req *http.Request, res *http.Response) {
+		ioutil.ReadAll(req.BodyReader())
+		trailers <- req.Trailer
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/upload", "POST", false)
+	client.writeFrame(newTestData(1, "data", false))
+	fragment := client.hpack.Encode([]*hpack.HeaderField{hf("checksum", "abc")})
+	client.writeFrame(newTestHeadersFrame(1, fragment, true, true))
+
+	select {
+	case trailer := <-trailers:
+		if trailer["checksum"] != "abc" {
+			t.Errorf("Incorrect trailer! Expected %q, got %q", "abc", trailer["checksum"])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not read the body")
+	}
+}
+
+func TestMalformedRequestTrailers(t *testing.T) {
+	tests := map[string]*hpack.HeaderField{
+		"without end stream": hf("checksum", "abc"),
+		"pseudo-header":      hf(":path", "/"),
+	}
+
+	for name, field := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := NewServer()
+			client := newPipeClient(srv)
+			defer client.conn.Close()
+			client.handshake()
+			client.writeHeaders(1, "/", "POST", false)
+			fragment := client.hpack.Encode([]*hpack.HeaderField{field})
+			client.writeFrame(newTestHeadersFrame(1, fragment, true, field.Name[0] == ':'))
+
+			rst := client.readFrame(t, frame.RstStreamType, 1)
+			if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.ProtocolError {
+				t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+			}
+		})
+	}
+}
+
+func newTestData(streamID uint32, data string, endStream bool) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.DataType,
+		Flags:   &types.DataFlags{EndStream: endStream},
+		Payload: &types.DataPayload{Data: []byte(data)},
+		Length:  uint32(len(data)),
+	}
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/SveinungOverland/opal/http"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrNoHTTP2 is returned when a TLS server does not negotiate HTTP/2 with ALPN
+var ErrNoHTTP2 = errors.New("client: Server does not support HTTP/2")
+
+// ErrUnsupportedScheme is returned for requests with a scheme other than "https" and "http"
+var ErrUnsupportedScheme = errors.New("client: Unsupported scheme")
+
+// ErrResponseTooLarge is returned when the body of a response is larger than Client.MaxResponseSize
+var ErrResponseTooLarge = errors.New("client: Response body is too large")
+
+// DefaultMaxResponseSize is the largest response body a client reads by default
+const DefaultMaxResponseSize = 10 << 20
+
+// Client is a HTTP/2 client. It keeps a pool of connections, one for each authority, and
+// multiplexes concurrent requests over them.
+type Client struct {
+	// TLSConfig is used when dialing "https" requests. NextProtos is always set to "h2"
+	TLSConfig *tls.Config
+	// Dial opens the underlying connection to an address. Defaults to net.Dial
+	Dial func(network, addr string) (net.Conn, error)
+	// PushCache stores responses pushed by servers. Server push is disabled if nil
+	PushCache *PushCache
+	// MaxResponseSize is the largest response body read, larger responses are cancelled.
+	// Zero means DefaultMaxResponseSize
+	MaxResponseSize int64
+
+	mu      sync.Mutex
+	conns   map[string]*conn     // Connections by scheme and authority
+	dialing map[string]*dialCall // Connections being dialed, by scheme and authority
+}
+
+// dialCall is a connection being dialed. Requests to the same authority wait for it, instead of dialing their own.
+type dialCall struct {
+	done chan struct{} // Closed when the dial is done
+	cc   *conn
+	err  error
+}
+
+// NewClient creates a client with server push enabled
+func NewClient() *Client {
+	return &Client{
+		PushCache: NewPushCache(),
+		conns:     make(map[string]*conn),
+	}
+}
+
+// NewRequest creates a request for a given method and URL, like "https://localhost:8080/path?q=1"
+func NewRequest(method, rawURL string, body []byte) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req := http.NewRequest()
+	req.Method = method
+	req.Scheme = u.Scheme
+	req.Authority = u.Host
+	req.URI = u.EscapedPath()
+	if req.URI == "" {
+		req.URI = "/"
+	}
+	if u.RawQuery != "" {
+		req.RawQuery = "?" + u.RawQuery
+	}
+	req.Proto = "HTTP/2"
+	req.Body = body
+	return req, nil
+}
+
+// Do sends a request and returns its response. "https" requests are sent over TLS, and "http"
+// requests are sent as cleartext HTTP/2 with prior knowledge. GET requests are answered from
+// the push cache if the server has pushed a response for them.
+func (cl *Client) Do(req *http.Request) (*http.Response, error) {
+	scheme := requestScheme(req)
+	if req.Method == "GET" && cl.PushCache != nil {
+		if res, ok := cl.PushCache.Get(scheme, req.Authority, requestPath(req)); ok {
+			return res, nil
+		}
+	}
+
+	cc, err := cl.getConn(scheme, req.Authority)
+	if err != nil {
+		return nil, err
+	}
+	res, err := cc.RoundTrip(req)
+	if err == errStreamNotProcessed {
+		// The server did not process the request, so it is safe to retry it on a new connection - RFC7540 Section 8.1.4
+		if cc, err = cl.getConn(scheme, req.Authority); err != nil {
+			return nil, err
+		}
+		res, err = cc.RoundTrip(req)
+	}
+	return res, err
+}
+
+// Close closes all connections of the client
+func (cl *Client) Close() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for key, cc := range cl.conns {
+		cc.Close()
+		delete(cl.conns, key)
+	}
+	return nil
+}
+
+// ------- HELPERS ---------
+
+// GetConn returns a usable connection to an authority, and dials a new one if there is none.
+// The lock is not held while dialing, so a slow server does not hold up requests to other servers.
+func (cl *Client) getConn(scheme, authority string) (*conn, error) {
+	key := scheme + "://" + authority
+	cl.mu.Lock()
+	if cl.conns == nil {
+		cl.conns = make(map[string]*conn)
+	}
+	if cl.dialing == nil {
+		cl.dialing = make(map[string]*dialCall)
+	}
+	if cc, ok := cl.conns[key]; ok && cc.usable() {
+		cl.mu.Unlock()
+		return cc, nil
+	}
+	if call, ok := cl.dialing[key]; ok {
+		cl.mu.Unlock()
+		<-call.done
+		return call.cc, call.err
+	}
+	call := &dialCall{done: make(chan struct{})}
+	cl.dialing[key] = call
+	cl.mu.Unlock()
+
+	call.cc, call.err = cl.newConn(scheme, authority)
+
+	cl.mu.Lock()
+	delete(cl.dialing, key)
+	if call.err == nil {
+		cl.conns[key] = call.cc
+	}
+	cl.mu.Unlock()
+	close(call.done)
+	return call.cc, call.err
+}
+
+// NewConn dials an authority, and starts a HTTP/2 connection on it
+func (cl *Client) newConn(scheme, authority string) (*conn, error) {
+	nc, err := cl.dial(scheme, authority)
+	if err != nil {
+		return nil, err
+	}
+	maxBodySize := cl.MaxResponseSize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxResponseSize
+	}
+	cc, err := newConn(nc, scheme, authority, cl.PushCache, maxBodySize)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Dial opens a connection to an authority. TLS connections must negotiate "h2" with ALPN.
+func (cl *Client) dial(scheme, authority string) (net.Conn, error) {
+	dial := cl.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	switch scheme {
+	case "http":
+		return dial("tcp", withPort(authority, "80"))
+	case "https":
+		nc, err := dial("tcp", withPort(authority, "443"))
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{}
+		if cl.TLSConfig != nil {
+			config = cl.TLSConfig.Clone()
+		}
+		config.NextProtos = []string{"h2"}
+		if config.ServerName == "" {
+			config.ServerName = hostname(authority)
+		}
+		tlsConn := tls.Client(nc, config)
+		if err := tlsConn.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+			tlsConn.Close()
+			return nil, ErrNoHTTP2
+		}
+		return tlsConn, nil
+	}
+	return nil, ErrUnsupportedScheme
+}
+
+// WithPort adds a default port to an authority without one
+func withPort(authority, port string) string {
+	if _, _, err := net.SplitHostPort(authority); err == nil {
+		return authority
+	}
+	return net.JoinHostPort(strings.Trim(authority, "[]"), port)
+}
+
+// Hostname removes the port of an authority
+func hostname(authority string) string {
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		return host
+	}
+	return strings.Trim(authority, "[]")
+}
+
+// RequestScheme returns the scheme of a request, which is "https" if it has none
+func requestScheme(req *http.Request) string {
+	if req.Scheme == "" {
+		return "https"
+	}
+	return req.Scheme
+}
+
+// RequestPath returns the ":path" of a request, which is the URI with its query
+func requestPath(req *http.Request) string {
+	path := req.URI
+	if path == "" {
+		path = "/"
+	}
+	if req.RawQuery != "" && !strings.Contains(path, "?") {
+		path += "?" + strings.TrimPrefix(req.RawQuery, "?")
+	}
+	return path
+}
@@ -0,0 +1,295 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/SveinungOverland/opal"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	cl := NewClient()
+	defer cl.Close()
+
+	res := doRequest(t, cl, "GET", "http://"+authority+"/hello?name=opal", nil)
+	if res.Status != 200 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 200, res.Status)
+	}
+	if string(res.Body) != "Hello opal" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "Hello opal", res.Body)
+	}
+	if res.Header["x-greeting"] != "yes" {
+		t.Errorf("Incorrect header! Expected %q, got %q", "yes", res.Header["x-greeting"])
+	}
+	if res.Trailer["x-checksum"] != "42" {
+		t.Errorf("Incorrect trailer! Expected %q, got %q", "42", res.Trailer["x-checksum"])
+	}
+
+	res = doRequest(t, cl, "GET", "http://"+authority+"/missing", nil)
+	if res.Status != 404 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 404, res.Status)
+	}
+}
+
+func TestLargeRequestBody(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	cl := NewClient()
+	defer cl.Close()
+
+	// The body is larger than the default flow-control window
+	body := bytes.Repeat([]byte("opal"), 100000)
+	res := doRequest(t, cl, "POST", "http://"+authority+"/echo", body)
+	if !bytes.Equal(res.Body, body) {
+		t.Errorf("Incorrect body! Expected %d bytes, got %d", len(body), len(res.Body))
+	}
+}
+
+func TestMultiplexing(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	cl := NewClient()
+	defer cl.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("client%d", i)
+			req, _ := NewRequest("GET", "http://"+authority+"/hello?name="+name, nil)
+			res, err := cl.Do(req)
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			if string(res.Body) != "Hello "+name {
+				t.Errorf("Incorrect body! Expected %q, got %q", "Hello "+name, res.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(cl.conns); n != 1 {
+		t.Errorf("Requests were not sent over one connection! Expected %d connection, got %d", 1, n)
+	}
+}
+
+func TestServerPush(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	cl := NewClient()
+	defer cl.Close()
+
+	doRequest(t, cl, "GET", "http://"+authority+"/", nil)
+
+	// The pushed response is sent after the response of the request
+	for i := 0; i < 100 && cl.PushCache.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cl.PushCache.Len() != 1 {
+		t.Fatalf("Pushed response was not cached! Expected %d response, got %d", 1, cl.PushCache.Len())
+	}
+
+	// The pushed response is used instead of sending the request
+	served := atomic.LoadInt32(&pushedServed)
+	res := doRequest(t, cl, "GET", "http://"+authority+"/pushed", nil)
+	if string(res.Body) != "pushed" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "pushed", res.Body)
+	}
+	if atomic.LoadInt32(&pushedServed) != served {
+		t.Error("Request was sent although the response was pushed")
+	}
+	if cl.PushCache.Len() != 0 {
+		t.Error("Pushed response was used more than once")
+	}
+}
+
+func TestPushDisabled(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	cl := NewClient()
+	cl.PushCache = nil
+	defer cl.Close()
+
+	res := doRequest(t, cl, "GET", "http://"+authority+"/", nil)
+	if string(res.Body) != "index" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "index", res.Body)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	cl := NewClient()
+	defer cl.Close()
+
+	req, _ := NewRequest("GET", "http://"+authority+"/slow", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req.SetContext(ctx)
+	if _, err := cl.Do(req); err != context.DeadlineExceeded {
+		t.Errorf("Incorrect error! Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// The connection is still usable after a stream is cancelled
+	res := doRequest(t, cl, "GET", "http://"+authority+"/hello?name=again", nil)
+	if string(res.Body) != "Hello again" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "Hello again", res.Body)
+	}
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	cl := NewClient()
+	cl.MaxResponseSize = 4
+	defer cl.Close()
+
+	req, _ := NewRequest("GET", "http://"+authority+"/hello?name=opal", nil)
+	if _, err := cl.Do(req); err != ErrResponseTooLarge {
+		t.Errorf("Incorrect error! Expected %v, got %v", ErrResponseTooLarge, err)
+	}
+
+	// The connection is still usable after a response is cancelled
+	res := doRequest(t, cl, "POST", "http://"+authority+"/echo", []byte("ok"))
+	if string(res.Body) != "ok" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "ok", res.Body)
+	}
+}
+
+func TestSlowDial(t *testing.T) {
+	authority, stop := startTestServer(t)
+	defer stop()
+	_, port, _ := net.SplitHostPort(authority)
+	slowAuthority := "localhost:" + port // The same server, by another name
+
+	release := make(chan struct{})
+	var slowDials int32
+	cl := NewClient()
+	cl.Dial = func(network, addr string) (net.Conn, error) {
+		if addr == slowAuthority {
+			atomic.AddInt32(&slowDials, 1)
+			<-release
+			addr = authority
+		}
+		return net.Dial(network, addr)
+	}
+	defer cl.Close()
+
+	// Requests to the slow authority wait for the same dial
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doRequest(t, cl, "GET", "http://"+slowAuthority+"/hello?name=slow", nil)
+		}()
+	}
+
+	// Requests to other authorities are not held up by the dial
+	done := make(chan struct{})
+	go func() {
+		doRequest(t, cl, "GET", "http://"+authority+"/hello?name=fast", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Request was held up by the dial of another authority")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&slowDials); n != 1 {
+		t.Errorf("Incorrect number of dials! Expected %d, got %d", 1, n)
+	}
+}
+
+// ------- HELPERS ---------
+
+var pushedServed int32
+
+// StartTestServer starts an opal server on a free port. Returns its authority, and a function shutting it down.
+func startTestServer(t *testing.T) (string, func()) {
+	r := router.NewRouter("/")
+	r.Get("/", func(req *http.Request, res *http.Response) {
+		res.Push("/pushed")
+		res.String(200, "index")
+	})
+	r.Get("/pushed", func(req *http.Request, res *http.Response) {
+		atomic.AddInt32(&pushedServed, 1)
+		res.String(200, "pushed")
+	})
+	r.Get("/hello", func(req *http.Request, res *http.Response) {
+		res.Header["x-greeting"] = "yes"
+		res.Trailer["x-checksum"] = "42"
+		res.String(200, "Hello "+req.Query("name"))
+	})
+	r.Post("/echo", func(req *http.Request, res *http.Response) {
+		res.Body = req.Body
+	})
+	r.Get("/slow", func(req *http.Request, res *http.Response) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	srv := opal.NewServer()
+	srv.Register(r)
+	port := freePort(t)
+	go srv.Listen(port)
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}
+
+	// Wait for the listener to start
+	authority := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; i < 100; i++ {
+		if nc, err := net.Dial("tcp", authority); err == nil {
+			nc.Close()
+			return authority, stop
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	t.Fatal("Server did not start")
+	return "", nil
+}
+
+// FreePort finds a free port that fits the port argument of Server.Listen
+func freePort(t *testing.T) int16 {
+	for port := 20000 + time.Now().Nanosecond()%10000; port < 32767; port++ {
+		if l, err := net.Listen("tcp4", fmt.Sprintf(":%d", port)); err == nil {
+			l.Close()
+			return int16(port)
+		}
+	}
+	t.Fatal("No free port")
+	return 0
+}
+
+func doRequest(t *testing.T, cl *Client, method, url string, body []byte) *http.Response {
+	t.Helper()
+	req, err := NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("Invalid request: %v", err)
+	}
+	res, err := cl.Do(req)
+	if err != nil {
+		t.Fatalf("Request to %s failed: %v", url, err)
+	}
+	return res
+}
@@ -0,0 +1,817 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	This file contains a single HTTP/2 connection to a server. Requests are sent
+	on new streams, and one goroutine reads the frames of all streams. Header
+	blocks are encoded and written in the order their stream identifiers are
+	chosen, so the server decodes them in the same order.
+*/
+
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// defaultWindowSize is the flow-control window of a connection and its streams until SETTINGS say otherwise - RFC7540 Section 6.9.2
+const defaultWindowSize = 65535
+
+// initialWindowSize is the receive window of the connection and of every stream. Received data is
+// acknowledged when it arrives, as responses are buffered in memory.
+const initialWindowSize = 1 << 20
+
+// maxStreamID is the largest stream identifier, after which a new connection is needed
+const maxStreamID = 1<<31 - 1
+
+// maxHeaderTableSize is the largest dynamic table the HPACK encoder uses, however large the server allows it to be
+const maxHeaderTableSize = 4096
+
+// maxHeaderBlockSize is the largest header block accepted from the server
+const maxHeaderBlockSize = 1 << 20
+
+// ErrConnClosed is returned for requests on a closed connection
+var ErrConnClosed = errors.New("client: Connection is closed")
+
+// errStreamNotProcessed is returned for requests the server did not process, which can be retried on a new connection
+var errStreamNotProcessed = errors.New("client: Stream was not processed by the server")
+
+// errMalformedResponse is returned for responses without a valid status or with unknown pseudo-headers
+var errMalformedResponse = errors.New("client: Malformed response")
+
+type conn struct {
+	nc        net.Conn
+	fr        *frame.Reader
+	hpack     *hpack.Context
+	scheme    string // The scheme of the requests sent on the connection, "https" or "http"
+	authority string
+	push      *PushCache // Nil if server push is disabled
+
+	maxBodySize int64 // The largest response body read
+
+	writeMu sync.Mutex // Guards writing frames, and choosing stream identifiers and encoding header blocks in order
+
+	mu         sync.Mutex
+	cond       *sync.Cond         // Signaled when streams finish, windows grow, or the connection changes
+	streams    map[uint32]*stream // Open and reserved streams
+	nextID     uint32             // Identifier of the next request stream
+	active     int                // Number of open request streams, including streams being opened
+	lastPushID uint32             // Identifier of the last pushed stream
+	settings   map[uint16]uint32  // The settings of the server
+	sendWindow int32              // Connection flow-control window for sending data
+	goAway     bool               // Set when the server does not accept new streams
+	err        error              // Set when the connection is closed
+
+	headerBlock *headerBlock // Header block being received. Only used by the reading goroutine
+}
+
+type stream struct {
+	id         uint32
+	req        *http.Request
+	res        *http.Response
+	body       []byte
+	sendWindow int32 // Guarded by conn.mu
+
+	// The path of a pushed stream. Its response is stored in the push cache
+	pushPath string
+
+	done chan struct{} // Closed when the response is complete or the stream fails
+	err  error
+}
+
+type headerBlock struct {
+	streamID   uint32
+	promisedID uint32 // The stream of a PUSH_PROMISE, zero for HEADERS
+	endStream  bool
+	fragment   []byte
+}
+
+// NewConn sends the connection preface and the client's SETTINGS, and starts reading frames
+func newConn(nc net.Conn, scheme, authority string, push *PushCache, maxBodySize int64) (*conn, error) {
+	c := &conn{
+		nc:          nc,
+		fr:          frame.NewReader(nc),
+		hpack:       hpack.NewContext(maxHeaderTableSize, 4096),
+		scheme:      scheme,
+		authority:   authority,
+		push:        push,
+		maxBodySize: maxBodySize,
+		streams:     make(map[uint32]*stream),
+		nextID:      1,
+		settings:    map[uint16]uint32{1: 4096, 3: math.MaxUint32, 4: defaultWindowSize, 5: 16384},
+		sendWindow:  defaultWindowSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	enablePush := uint32(0)
+	if push != nil {
+		enablePush = 1
+	}
+	settings := &frame.Frame{
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{},
+		Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{2: enablePush, 4: initialWindowSize}},
+		Length:  12,
+	}
+
+	c.writeMu.Lock()
+	_, err := nc.Write([]byte(clientPreface))
+	if err == nil {
+		err = c.write(settings, newWindowUpdate(0, initialWindowSize-defaultWindowSize))
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.readLoop()
+	return c, nil
+}
+
+// RoundTrip sends a request on a new stream and waits for its response. The request is cancelled
+// with a RST_STREAM frame when its context is done.
+func (c *conn) RoundTrip(req *http.Request) (*http.Response, error) {
+	s, err := c.openStream(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Body) > 0 {
+		go c.writeBody(s, req.Body)
+	}
+
+	select {
+	case <-s.done:
+	case <-req.Context().Done():
+		c.resetStream(s.id, constants.Cancel)
+		return nil, req.Context().Err()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.res, nil
+}
+
+// Close sends a GOAWAY frame and closes the connection
+func (c *conn) Close() error {
+	c.writeFrames(&frame.Frame{
+		Type:    frame.GoAwayType,
+		Flags:   &types.GoAwayFlags{},
+		Payload: &types.GoAwayPayload{LastStreamID: c.lastPushStream(), ErrorCode: constants.NoError},
+		Length:  8,
+	})
+	c.close(ErrConnClosed)
+	return nil
+}
+
+// ------- HELPERS ---------
+
+// Usable says if new requests can be sent on the connection
+func (c *conn) usable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil && !c.goAway && c.nextID <= maxStreamID
+}
+
+// OpenStream waits until the server allows another stream, and sends the headers of a request on it.
+// Returns the error of the request's context if it is done while waiting.
+func (c *conn) openStream(req *http.Request) (*stream, error) {
+	stop := c.wakeOnDone(req.Context())
+	defer stop()
+	c.mu.Lock()
+	for c.err == nil && !c.goAway && uint32(c.active) >= c.settings[3] {
+		if err := req.Context().Err(); err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		c.cond.Wait()
+	}
+	if err := c.streamError(); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.active++ // The slot is reserved while the headers are written
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	if err := c.streamError(); err != nil {
+		c.active--
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		return nil, err
+	}
+	s := &stream{
+		id:         c.nextID,
+		req:        req,
+		sendWindow: int32(c.settings[4]),
+		done:       make(chan struct{}),
+	}
+	c.nextID += 2
+	c.streams[s.id] = s
+	maxFrameSize := c.settings[5]
+	c.mu.Unlock()
+
+	fragment := c.hpack.Encode(requestHeaderFields(req, c.authority))
+	if err := c.write(newHeaderFrames(s.id, fragment, maxFrameSize, len(req.Body) == 0)...); err != nil {
+		c.close(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// WakeOnDone wakes the goroutines waiting on cond when a context is done, so a request waiting for a stream
+// or for flow-control credit sees that it is cancelled. The returned function stops it.
+func (c *conn) wakeOnDone(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {} // The context is never done
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// StreamError returns the reason new streams can not be opened, if any. Must be called with mu held.
+func (c *conn) streamError() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.goAway || c.nextID > maxStreamID {
+		return errStreamNotProcessed
+	}
+	return nil
+}
+
+// WriteBody sends the body of a request in DATA frames, as the flow-control windows allow
+func (c *conn) writeBody(s *stream, body []byte) {
+	stop := c.wakeOnDone(s.req.Context())
+	defer stop()
+	for len(body) > 0 {
+		n, ok := c.takeWindow(s, len(body))
+		if !ok {
+			if c.getStream(s.id) == nil && s.err == nil {
+				// The response is complete before the whole body is sent - RFC7540 Section 8.1
+				c.writeFrames(frame.NewErrorFrame(s.id, constants.NoError))
+			}
+			return
+		}
+		chunk := body[:n]
+		body = body[n:]
+		if err := c.writeFrames(newDataFrame(s.id, chunk, len(body) == 0)); err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// TakeWindow waits until data can be sent on a stream, and takes up to n bytes of its windows.
+// Returns false if the stream is done, or the context of its request is done.
+func (c *conn) takeWindow(s *stream, n int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if _, ok := c.streams[s.id]; !ok || c.err != nil || s.req.Context().Err() != nil {
+			return 0, false
+		}
+		if c.sendWindow > 0 && s.sendWindow > 0 {
+			break
+		}
+		c.cond.Wait()
+	}
+	if n > int(c.sendWindow) {
+		n = int(c.sendWindow)
+	}
+	if n > int(s.sendWindow) {
+		n = int(s.sendWindow)
+	}
+	if n > int(c.settings[5]) {
+		n = int(c.settings[5])
+	}
+	c.sendWindow -= int32(n)
+	s.sendWindow -= int32(n)
+	return n, true
+}
+
+// ReadLoop reads and processes frames until the connection fails
+func (c *conn) readLoop() {
+	for {
+		f, err := c.fr.ReadFrame()
+		if err == nil {
+			err = c.processFrame(&f)
+		}
+		switch e := err.(type) {
+		case nil:
+			continue
+		case constants.StreamError:
+			c.resetStream(e.StreamID, e.Code)
+			continue
+		case constants.ConnectionError:
+			c.writeFrames(&frame.Frame{
+				Type:    frame.GoAwayType,
+				Flags:   &types.GoAwayFlags{},
+				Payload: &types.GoAwayPayload{LastStreamID: c.lastPushStream(), ErrorCode: e.Code},
+				Length:  8,
+			})
+		}
+		c.close(err)
+		return
+	}
+}
+
+// ProcessFrame handles a frame received from the server
+func (c *conn) processFrame(f *frame.Frame) error {
+	if c.headerBlock != nil && (f.Type != frame.ContinuationType || f.ID != c.headerBlock.streamID) {
+		return constants.ConnectionError{Code: constants.ProtocolError, Reason: "header block is interrupted"}
+	}
+
+	switch f.Type {
+	case frame.DataType:
+		return c.processData(f)
+	case frame.HeadersType:
+		flags := f.Flags.(*types.HeadersFlags)
+		c.headerBlock = &headerBlock{
+			streamID:  f.ID,
+			endStream: flags.EndStream,
+			fragment:  append([]byte{}, f.Payload.(*types.HeadersPayload).Fragment...),
+		}
+		if flags.EndHeaders {
+			return c.headerBlockComplete()
+		}
+	case frame.ContinuationType:
+		if c.headerBlock == nil {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "CONTINUATION frame without HEADERS"}
+		}
+		c.headerBlock.fragment = append(c.headerBlock.fragment, f.Payload.(*types.ContinuationPayload).HeaderFragment...)
+		if len(c.headerBlock.fragment) > maxHeaderBlockSize {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "header block is too large"}
+		}
+		if f.Flags.(*types.ContinuationFlags).EndHeaders {
+			return c.headerBlockComplete()
+		}
+	case frame.PushPromiseType:
+		if c.push == nil {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "PUSH_PROMISE frame when push is disabled"}
+		}
+		payload := f.Payload.(*types.PushPromisePayload)
+		c.headerBlock = &headerBlock{
+			streamID:   f.ID,
+			promisedID: payload.StreamID,
+			fragment:   append([]byte{}, payload.Fragment...),
+		}
+		if f.Flags.(*types.PushPromiseFlags).EndHeaders {
+			return c.headerBlockComplete()
+		}
+	case frame.RstStreamType:
+		if s := c.getStream(f.ID); s != nil {
+			c.finish(s, constants.StreamError{StreamID: f.ID, Code: f.Payload.(*types.RstStreamPayload).ErrorCode})
+		}
+	case frame.SettingsType:
+		if f.Flags.(*types.SettingsFlags).Ack {
+			return nil
+		}
+		return c.applySettings(f.Payload.(*types.SettingsPayload).IDValuePair)
+	case frame.PingType:
+		if !f.Flags.(*types.PingFlags).Ack {
+			c.writeFrames(&frame.Frame{
+				Type:    frame.PingType,
+				Flags:   &types.PingFlags{Ack: true},
+				Payload: f.Payload,
+				Length:  f.Length,
+			})
+		}
+	case frame.GoAwayType:
+		c.processGoAway(f.Payload.(*types.GoAwayPayload))
+	case frame.WindowUpdateType:
+		return c.processWindowUpdate(f.ID, f.Payload.(*types.WindowUpdatePayload).WindowSizeIncrement)
+	}
+	return nil
+}
+
+// ProcessWindowUpdate grows the send window of the connection or of a stream. The increment may not be zero,
+// and a window may not grow beyond 2^31-1 - RFC7540 Section 6.9.1.
+func (c *conn) processWindowUpdate(id, increment uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == 0 {
+		if increment == 0 {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "WINDOW_UPDATE with zero increment"}
+		}
+		if int64(c.sendWindow)+int64(increment) > math.MaxInt32 {
+			return constants.ConnectionError{Code: constants.FlowControlError, Reason: "connection window exceeds 2^31-1"}
+		}
+		c.sendWindow += int32(increment)
+	} else if s, ok := c.streams[id]; ok {
+		if increment == 0 {
+			return constants.StreamError{StreamID: id, Code: constants.ProtocolError}
+		}
+		if int64(s.sendWindow)+int64(increment) > math.MaxInt32 {
+			return constants.StreamError{StreamID: id, Code: constants.FlowControlError}
+		}
+		s.sendWindow += int32(increment)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// ProcessData appends the data of a DATA frame to the body of its response, and gives the flow-control
+// window back to the server. A response larger than maxBodySize is cancelled.
+func (c *conn) processData(f *frame.Frame) error {
+	if f.Length > 0 {
+		c.writeFrames(newWindowUpdate(0, f.Length))
+	}
+	s := c.getStream(f.ID)
+	if s == nil {
+		return nil // The stream is reset or cancelled
+	}
+	if s.res == nil {
+		return constants.StreamError{StreamID: f.ID, Code: constants.ProtocolError}
+	}
+
+	data := f.Payload.(*types.DataPayload).Data
+	if int64(len(s.body))+int64(len(data)) > c.maxBodySize {
+		c.writeFrames(frame.NewErrorFrame(s.id, constants.Cancel))
+		c.finish(s, ErrResponseTooLarge)
+		return nil
+	}
+	s.body = append(s.body, data...)
+	if f.Flags.(*types.DataFlags).EndStream {
+		c.complete(s)
+	} else if f.Length > 0 {
+		c.writeFrames(newWindowUpdate(f.ID, f.Length))
+	}
+	return nil
+}
+
+// HeaderBlockComplete decodes a complete header block. Blocks of unknown streams are also decoded,
+// so the HPACK context stays in sync with the server's.
+func (c *conn) headerBlockComplete() error {
+	block := c.headerBlock
+	c.headerBlock = nil
+	hfs, err := c.hpack.Decode(block.fragment)
+	if err != nil {
+		return constants.ConnectionError{Code: constants.CompressionError, Reason: "header block could not be decoded"}
+	}
+	if block.promisedID != 0 {
+		return c.pushPromised(block, hfs)
+	}
+
+	s := c.getStream(block.streamID)
+	if s == nil {
+		return nil
+	}
+	if s.res == nil {
+		res, err := newResponse(s.req, hfs)
+		if err != nil {
+			return constants.StreamError{StreamID: s.id, Code: constants.ProtocolError}
+		}
+		if res.Status < 200 {
+			return nil // Informational responses are ignored
+		}
+		s.res = res
+	} else {
+		// A second header block is the trailers, which must end the stream - RFC7540 Section 8.1
+		if !block.endStream {
+			return constants.StreamError{StreamID: s.id, Code: constants.ProtocolError}
+		}
+		for _, hf := range hfs {
+			if strings.HasPrefix(hf.Name, ":") {
+				return constants.StreamError{StreamID: s.id, Code: constants.ProtocolError}
+			}
+			s.res.Trailer[hf.Name] = hf.Value
+		}
+	}
+
+	if block.endStream {
+		c.complete(s)
+	}
+	return nil
+}
+
+// PushPromised reserves a stream promised by the server. Its response is stored in the push cache
+// when it is complete. Promises for other origins than the connection's are refused, so a server
+// can not push responses for origins it is not authoritative for - RFC7540 Section 8.2.
+func (c *conn) pushPromised(block *headerBlock, hfs []*hpack.HeaderField) error {
+	if block.promisedID%2 != 0 || block.promisedID <= c.lastPushStream() {
+		return constants.ConnectionError{Code: constants.ProtocolError, Reason: "invalid promised stream id"}
+	}
+
+	req := http.NewRequest()
+	req.Proto = "HTTP/2"
+	for _, hf := range hfs {
+		switch hf.Name {
+		case ":method":
+			req.Method = hf.Value
+		case ":path":
+			req.URI = hf.Value
+		case ":authority":
+			req.Authority = hf.Value
+		case ":scheme":
+			req.Scheme = hf.Value
+		default:
+			req.Header[hf.Name] = hf.Value
+		}
+	}
+	if req.Authority == "" {
+		req.Authority = c.authority
+	}
+	if req.Scheme == "" {
+		req.Scheme = c.scheme
+	}
+
+	c.mu.Lock()
+	c.lastPushID = block.promisedID
+	c.mu.Unlock()
+
+	// Only safe and cacheable requests can be pushed - RFC7540 Section 8.2
+	sameOrigin := strings.EqualFold(req.Authority, c.authority) && req.Scheme == c.scheme
+	if !sameOrigin || c.getStream(block.streamID) == nil || req.Method != "GET" || req.URI == "" {
+		c.writeFrames(frame.NewErrorFrame(block.promisedID, constants.RefusedStream))
+		return nil
+	}
+
+	s := &stream{
+		id:       block.promisedID,
+		req:      req,
+		pushPath: req.URI,
+		done:     make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.streams[s.id] = s
+	c.mu.Unlock()
+	return nil
+}
+
+// ApplySettings applies the SETTINGS of the server and acknowledges them. The dynamic table of the HPACK
+// encoder is resized to SETTINGS_HEADER_TABLE_SIZE, up to maxHeaderTableSize.
+func (c *conn) applySettings(values map[uint16]uint32) error {
+	c.mu.Lock()
+	for id, value := range values {
+		switch id {
+		case 0x4:
+			if value > math.MaxInt32 {
+				c.mu.Unlock()
+				return constants.ConnectionError{Code: constants.FlowControlError, Reason: "initial window size is too large"}
+			}
+			// The difference is applied to the windows of all streams - RFC7540 Section 6.9.2
+			delta := int32(value) - int32(c.settings[4])
+			for _, s := range c.streams {
+				s.sendWindow += delta
+			}
+		case 0x5:
+			if value < 16384 || value > frame.MaxFrameSizeLimit {
+				c.mu.Unlock()
+				return constants.ConnectionError{Code: constants.ProtocolError, Reason: "invalid max frame size"}
+			}
+		}
+		c.settings[id] = value
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	// The encoder is resized between header blocks, and the resize is signaled in the next one
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if size, ok := values[0x1]; ok {
+		if size > maxHeaderTableSize {
+			size = maxHeaderTableSize
+		}
+		c.hpack.Encoder.SetMaxDynamicTableSize(size)
+	}
+	return c.write(&frame.Frame{
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{Ack: true},
+		Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{}},
+	})
+}
+
+// ProcessGoAway stops new streams on the connection, and fails the streams the server did not process
+func (c *conn) processGoAway(payload *types.GoAwayPayload) {
+	c.mu.Lock()
+	c.goAway = true
+	unprocessed := make([]*stream, 0)
+	for id, s := range c.streams {
+		if id%2 == 1 && id > payload.LastStreamID {
+			unprocessed = append(unprocessed, s)
+		}
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	for _, s := range unprocessed {
+		c.finish(s, errStreamNotProcessed)
+	}
+}
+
+// Complete finishes a stream after its whole response is received
+func (c *conn) complete(s *stream) {
+	s.res.Body = s.body
+	c.finish(s, nil)
+}
+
+// Finish removes a stream and wakes its waiting request. Pushed responses are stored in the push cache.
+func (c *conn) finish(s *stream, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.streams[s.id]; !ok {
+		return
+	}
+	delete(c.streams, s.id)
+	if s.id%2 == 1 {
+		c.active--
+	}
+	s.err = err
+	close(s.done)
+	c.cond.Broadcast()
+
+	if s.pushPath != "" && err == nil {
+		c.push.put(c.scheme, c.authority, s.pushPath, s.res)
+	}
+}
+
+// ResetStream sends a RST_STREAM frame and fails the stream
+func (c *conn) resetStream(id uint32, code constants.ErrorCode) {
+	c.writeFrames(frame.NewErrorFrame(id, code))
+	if s := c.getStream(id); s != nil {
+		c.finish(s, constants.StreamError{StreamID: id, Code: code})
+	}
+}
+
+// Close closes the connection and fails all its streams with err
+func (c *conn) close(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	streams := make([]*stream, 0, len(c.streams))
+	for _, s := range c.streams {
+		streams = append(streams, s)
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.nc.Close()
+	for _, s := range streams {
+		c.finish(s, err)
+	}
+}
+
+func (c *conn) getStream(id uint32) *stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+func (c *conn) lastPushStream() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastPushID
+}
+
+// WriteFrames writes frames to the server, one after another
+func (c *conn) writeFrames(frames ...*frame.Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.write(frames...)
+}
+
+// Write writes frames to the server. Must be called with writeMu held.
+func (c *conn) write(frames ...*frame.Frame) error {
+	for _, f := range frames {
+		if _, err := c.nc.Write(f.ToBytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequestHeaderFields converts a request into header fields. Pseudo-header fields come first.
+func requestHeaderFields(req *http.Request, authority string) []*hpack.HeaderField {
+	if req.Authority != "" {
+		authority = req.Authority
+	}
+	hfs := []*hpack.HeaderField{{Name: ":method", Value: req.Method}}
+	if req.Method == "CONNECT" && req.Protocol == "" {
+		// A CONNECT request only has an authority - RFC7540 Section 8.3
+		hfs = append(hfs, &hpack.HeaderField{Name: ":authority", Value: authority})
+	} else {
+		hfs = append(hfs,
+			&hpack.HeaderField{Name: ":scheme", Value: requestScheme(req)},
+			&hpack.HeaderField{Name: ":authority", Value: authority},
+			&hpack.HeaderField{Name: ":path", Value: requestPath(req)},
+		)
+		if req.Protocol != "" {
+			hfs = append(hfs, &hpack.HeaderField{Name: ":protocol", Value: req.Protocol})
+		}
+	}
+
+	for name, value := range req.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "host", "content-length":
+			continue // Connection-specific headers are not allowed in HTTP/2 - RFC7540 Section 8.1.2.2
+		}
+		hfs = append(hfs, &hpack.HeaderField{Name: name, Value: value})
+	}
+	if len(req.Body) > 0 {
+		hfs = append(hfs, &hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(req.Body))})
+	}
+	return hfs
+}
+
+// NewResponse builds a response from the decoded headers of a stream
+func newResponse(req *http.Request, hfs []*hpack.HeaderField) (*http.Response, error) {
+	res := http.NewResponse(req)
+	res.Header = make(map[string]string) // Without the default content type of a new response
+	status := ""
+	for _, hf := range hfs {
+		if hf.Name == ":status" {
+			status = hf.Value
+			continue
+		}
+		if strings.HasPrefix(hf.Name, ":") {
+			return nil, errMalformedResponse
+		}
+		if value, ok := res.Header[hf.Name]; ok {
+			res.Header[hf.Name] = value + ", " + hf.Value
+		} else {
+			res.Header[hf.Name] = hf.Value
+		}
+	}
+	code, err := strconv.ParseUint(status, 10, 16)
+	if err != nil || code < 100 {
+		return nil, errMalformedResponse
+	}
+	res.Status = uint16(code)
+	return res, nil
+}
+
+// NewHeaderFrames splits a header block into a HEADERS frame and CONTINUATION frames
+func newHeaderFrames(streamID uint32, fragment []byte, maxFrameSize uint32, endStream bool) []*frame.Frame {
+	first := fragment
+	if uint32(len(first)) > maxFrameSize {
+		first = fragment[:maxFrameSize]
+	}
+	frames := []*frame.Frame{{
+		ID:      streamID,
+		Type:    frame.HeadersType,
+		Flags:   &types.HeadersFlags{EndStream: endStream, EndHeaders: len(first) == len(fragment)},
+		Payload: &types.HeadersPayload{Fragment: first},
+		Length:  uint32(len(first)),
+	}}
+	for rest := fragment[len(first):]; len(rest) > 0; {
+		n := len(rest)
+		if uint32(n) > maxFrameSize {
+			n = int(maxFrameSize)
+		}
+		frames = append(frames, &frame.Frame{
+			ID:      streamID,
+			Type:    frame.ContinuationType,
+			Flags:   &types.ContinuationFlags{EndHeaders: n == len(rest)},
+			Payload: &types.ContinuationPayload{HeaderFragment: rest[:n]},
+			Length:  uint32(n),
+		})
+		rest = rest[n:]
+	}
+	return frames
+}
+
+func newDataFrame(streamID uint32, data []byte, endStream bool) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.DataType,
+		Flags:   &types.DataFlags{EndStream: endStream},
+		Payload: &types.DataPayload{Data: data},
+		Length:  uint32(len(data)),
+	}
+}
+
+func newWindowUpdate(streamID, increment uint32) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.WindowUpdateType,
+		Flags:   &types.WindowUpdateFlags{},
+		Payload: &types.WindowUpdatePayload{WindowSizeIncrement: increment},
+		Length:  4,
+	}
+}
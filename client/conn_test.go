@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushPromiseOrigin(t *testing.T) {
+	tests := map[string]struct {
+		scheme    string
+		authority string
+		refused   bool
+	}{
+		"same origin":     {"https", "localhost:8080", false},
+		"other authority": {"https", "evil.example:8080", true},
+		"other scheme":    {"http", "localhost:8080", true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			c := &conn{
+				nc:        clientConn,
+				scheme:    "https",
+				authority: "localhost:8080",
+				push:      NewPushCache(),
+				streams:   map[uint32]*stream{1: {id: 1, done: make(chan struct{})}},
+			}
+			c.cond = sync.NewCond(&c.mu)
+
+			// Frames written by the client are read on the server side of the pipe
+			frames := make(chan frame.Frame, 1)
+			go func() {
+				if f, err := frame.ReadFrame(bufio.NewReader(serverConn)); err == nil {
+					frames <- f
+				}
+				close(frames)
+			}()
+
+			err := c.pushPromised(&headerBlock{streamID: 1, promisedID: 2}, []*hpack.HeaderField{
+				{Name: ":method", Value: "GET"},
+				{Name: ":scheme", Value: test.scheme},
+				{Name: ":authority", Value: test.authority},
+				{Name: ":path", Value: "/style.css"},
+			})
+			if err != nil {
+				t.Fatalf("Push promise failed: %v", err)
+			}
+			if _, reserved := c.streams[2]; reserved == test.refused {
+				t.Errorf("Incorrect state of promised stream! Expected reserved to be %t", !test.refused)
+			}
+			if !test.refused {
+				return
+			}
+			f, ok := <-frames
+			if !ok || f.Type != frame.RstStreamType || f.ID != 2 {
+				t.Fatalf("Promised stream was not reset, got %+v", f)
+			}
+			if code := f.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.RefusedStream {
+				t.Errorf("Incorrect error code! Expected %v, got %v", constants.RefusedStream, code)
+			}
+		})
+	}
+}
+
+func TestHeaderTableSizeSetting(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	frames := make(chan frame.Frame, 10)
+	go func() {
+		br := bufio.NewReader(serverConn)
+		br.Discard(len(clientPreface))
+		for {
+			f, err := frame.ReadFrame(br)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+	c, err := newConn(clientConn, "https", "localhost:8080", nil, DefaultMaxResponseSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The server allows no dynamic table, and the client must acknowledge it before the next request
+	settings := &frame.Frame{
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{},
+		Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{1: 0}},
+		Length:  6,
+	}
+	serverConn.Write(settings.ToBytes())
+	for f := range frames {
+		if f.Type == frame.SettingsType && f.Flags.(*types.SettingsFlags).Ack {
+			break
+		}
+	}
+
+	req := http.NewRequest()
+	req.Method = "GET"
+	req.URI = "/"
+	if _, err := c.openStream(req); err != nil {
+		t.Fatal(err)
+	}
+	f := <-frames
+	if f.Type != frame.HeadersType {
+		t.Fatalf("Expected a HEADERS frame, got %+v", f)
+	}
+	if fragment := f.Payload.(*types.HeadersPayload).Fragment; fragment[0] != 0x20 {
+		t.Errorf("Header block did not start with a size update to 0, got %x", fragment[0])
+	}
+}
+
+func TestCancelWaitingForStream(t *testing.T) {
+	// The server allows no streams, so the request waits until it is cancelled
+	c := &conn{
+		streams:  make(map[uint32]*stream),
+		nextID:   1,
+		settings: map[uint16]uint32{3: 0},
+	}
+	c.cond = sync.NewCond(&c.mu)
+	req := http.NewRequest()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req.SetContext(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.openStream(req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Incorrect error! Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Request waiting for a stream was not cancelled")
+	}
+}
+
+func TestInvalidWindowUpdate(t *testing.T) {
+	tests := map[string]struct {
+		id        uint32
+		increment uint32
+		expected  error
+	}{
+		"zero on connection":     {0, 0, constants.ConnectionError{Code: constants.ProtocolError, Reason: "WINDOW_UPDATE with zero increment"}},
+		"overflow on connection": {0, 1<<31 - 1, constants.ConnectionError{Code: constants.FlowControlError, Reason: "connection window exceeds 2^31-1"}},
+		"zero on stream":         {1, 0, constants.StreamError{StreamID: 1, Code: constants.ProtocolError}},
+		"overflow on stream":     {1, 1<<31 - 1, constants.StreamError{StreamID: 1, Code: constants.FlowControlError}},
+		"valid":                  {1, 1<<31 - 1 - defaultWindowSize, nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &conn{
+				streams:    map[uint32]*stream{1: {id: 1, sendWindow: defaultWindowSize}},
+				sendWindow: defaultWindowSize,
+			}
+			c.cond = sync.NewCond(&c.mu)
+			if err := c.processWindowUpdate(test.id, test.increment); err != test.expected {
+				t.Errorf("Incorrect error! Expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
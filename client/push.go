@@ -0,0 +1,92 @@
+package client
+
+import (
+	"container/list"
+	"github.com/SveinungOverland/opal/http"
+	"sync"
+)
+
+// DefaultPushCacheSize is the number of pushed responses a push cache stores by default
+const DefaultPushCacheSize = 100
+
+// PushCache stores responses pushed by servers - RFC7540 Section 8.2. A pushed response
+// is stored when it is fully received, and is used at most once. When the cache is full,
+// the oldest response is removed to make room for a new one.
+type PushCache struct {
+	mu        sync.Mutex
+	maxSize   int
+	order     *list.List              // The stored responses, oldest first
+	responses map[string]*pushedEntry // Responses by scheme, authority and path
+}
+
+// NewPushCache creates an empty push cache storing up to DefaultPushCacheSize responses
+func NewPushCache() *PushCache {
+	return NewPushCacheSize(DefaultPushCacheSize)
+}
+
+// NewPushCacheSize creates an empty push cache storing up to a given number of responses
+func NewPushCacheSize(maxSize int) *PushCache {
+	return &PushCache{
+		maxSize:   maxSize,
+		order:     list.New(),
+		responses: make(map[string]*pushedEntry),
+	}
+}
+
+// Get removes and returns the response pushed for a path of an authority, like "localhost:8080", with a scheme
+func (pc *PushCache) Get(scheme, authority, path string) (*http.Response, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	entry, ok := pc.responses[pushKey(scheme, authority, path)]
+	if !ok {
+		return nil, false
+	}
+	pc.remove(entry)
+	return entry.res, true
+}
+
+// Len returns the number of stored responses
+func (pc *PushCache) Len() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.responses)
+}
+
+// ------- HELPERS ---------
+
+// pushedEntry is a stored response, and its place in the order of the cache
+type pushedEntry struct {
+	key     string
+	res     *http.Response
+	element *list.Element
+}
+
+// Put stores a pushed response, replacing any earlier response for the same path
+func (pc *PushCache) put(scheme, authority, path string, res *http.Response) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.maxSize <= 0 {
+		return
+	}
+	key := pushKey(scheme, authority, path)
+	if entry, ok := pc.responses[key]; ok {
+		pc.remove(entry)
+	}
+	for len(pc.responses) >= pc.maxSize {
+		pc.remove(pc.order.Front().Value.(*pushedEntry))
+	}
+	entry := &pushedEntry{key: key, res: res}
+	entry.element = pc.order.PushBack(entry)
+	pc.responses[key] = entry
+}
+
+// Remove removes an entry from the cache. Must be called with mu held.
+func (pc *PushCache) remove(entry *pushedEntry) {
+	pc.order.Remove(entry.element)
+	delete(pc.responses, entry.key)
+}
+
+// PushKey is the key of a pushed response, which is the URL of the pushed request
+func pushKey(scheme, authority, path string) string {
+	return scheme + "://" + authority + path
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"github.com/SveinungOverland/opal/http"
+	"strconv"
+	"testing"
+)
+
+func TestPushCacheOrigin(t *testing.T) {
+	pc := NewPushCache()
+	res := &http.Response{Status: 200}
+	pc.put("https", "localhost:8080", "/style.css", res)
+
+	if _, ok := pc.Get("http", "localhost:8080", "/style.css"); ok {
+		t.Error("Response pushed for https was used for http")
+	}
+	if _, ok := pc.Get("https", "localhost:8081", "/style.css"); ok {
+		t.Error("Response pushed for one authority was used for another")
+	}
+	if cached, ok := pc.Get("https", "localhost:8080", "/style.css"); !ok || cached != res {
+		t.Error("Pushed response was not found")
+	}
+}
+
+func TestPushCacheSize(t *testing.T) {
+	pc := NewPushCacheSize(3)
+	for i := 0; i < 5; i++ {
+		pc.put("https", "localhost", "/"+strconv.Itoa(i), &http.Response{Status: 200})
+	}
+	if pc.Len() != 3 {
+		t.Fatalf("Incorrect number of cached responses! Expected %d, got %d", 3, pc.Len())
+	}
+
+	// The oldest responses are removed to make room for new ones
+	for i := 0; i < 5; i++ {
+		if _, ok := pc.Get("https", "localhost", "/"+strconv.Itoa(i)); ok != (i >= 2) {
+			t.Errorf("Incorrect cache state of response %d! Expected cached to be %t", i, i >= 2)
+		}
+	}
+}
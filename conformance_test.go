@@ -0,0 +1,452 @@
+package opal
+
+import (
+	"encoding/binary"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+	"time"
+)
+
+/*
+	This file contains a protocol conformance suite in the style of h2spec.
+	Every case sends a crafted sequence of frames to a connection over a
+	pipe, and checks the GOAWAY, RST_STREAM or response required by the
+	section of RFC7540 (or RFC7541, RFC8441) it is named after.
+*/
+
+type conformanceCase struct {
+	section string // The section of RFC7540 describing the requirement, or of RFC7541 or RFC8441 if prefixed with "HPACK" or "RFC8441"
+	name    string
+	send    func(pc *pipeClient)
+	expect  func(t *testing.T, pc *pipeClient)
+}
+
+var conformanceCases = []conformanceCase{
+	// ---- Section 4: HTTP Frames ----
+	{"4.1", "Frame of unknown type is ignored", func(pc *pipeClient) {
+		pc.writeRaw(0x20, 0x0, 1, []byte("unknown"))
+	}, expectAlive},
+	{"4.1", "Unknown flags are ignored", func(pc *pipeClient) {
+		pc.writeRaw(frame.PingType, 0xFE, 0, []byte("unflaggd"))
+	}, expectPingAck("unflaggd")},
+	{"4.2", "DATA frame larger than SETTINGS_MAX_FRAME_SIZE", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("POST")...)
+		pc.writeRaw(frame.DataType, 0x1, 1, make([]byte, 16385))
+	}, expectGoAway(constants.FrameSizeError)},
+	{"4.2", "HEADERS frame larger than SETTINGS_MAX_FRAME_SIZE", func(pc *pipeClient) {
+		pc.writeRaw(frame.HeadersType, 0x5, 1, make([]byte, 16385))
+	}, expectGoAway(constants.FrameSizeError)},
+	{"4.3", "Header block that can not be decoded", func(pc *pipeClient) {
+		pc.writeRaw(frame.HeadersType, 0x5, 1, []byte{0x80}) // Index 0 is not used
+	}, expectGoAway(constants.CompressionError)},
+
+	// ---- Section 5: Streams and Multiplexing ----
+	{"5.1", "DATA frame on idle stream", func(pc *pipeClient) {
+		pc.writeFrame(newTestData(1, "data", true))
+	}, expectGoAway(constants.ProtocolError)},
+	{"5.1", "RST_STREAM frame on idle stream", func(pc *pipeClient) {
+		pc.writeFrame(frame.NewErrorFrame(1, constants.Cancel))
+	}, expectGoAway(constants.ProtocolError)},
+	{"5.1", "WINDOW_UPDATE frame on idle stream", func(pc *pipeClient) {
+		pc.writeFrame(newTestWindowUpdate(1, 100))
+	}, expectGoAway(constants.ProtocolError)},
+	{"5.1", "DATA frame on half-closed (remote) stream", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":path", "/wait")...)
+		pc.writeFrame(newTestData(1, "data", true))
+	}, expectReset(1, constants.StreamClosed)},
+	{"5.1", "HEADERS frame on half-closed (remote) stream", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":path", "/wait")...)
+		pc.writeRequest(1, true, validRequestFields("GET")...)
+	}, expectReset(1, constants.StreamClosed)},
+	{"5.1", "DATA frame on closed stream", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("POST")...)
+		pc.writeFrame(frame.NewErrorFrame(1, constants.Cancel))
+		pc.writeFrame(newTestData(1, "data", true))
+	}, expectReset(1, constants.StreamClosed)},
+	{"5.1.1", "Stream initiated with an even identifier", func(pc *pipeClient) {
+		pc.writeRequest(2, true, validRequestFields("GET")...)
+	}, expectGoAway(constants.ProtocolError)},
+	{"5.1.1", "Stream initiated with a lower identifier than the previous stream", func(pc *pipeClient) {
+		pc.writeRequest(5, true, validRequestFields("GET")...)
+		pc.writeRequest(3, true, validRequestFields("GET")...)
+	}, expectGoAway(constants.ProtocolError)},
+	{"5.3.1", "HEADERS frame depending on its own stream", func(pc *pipeClient) {
+		fragment := pc.hpack.Encode(validRequestFields("GET"))
+		pc.writeFrame(&frame.Frame{
+			ID:      1,
+			Type:    frame.HeadersType,
+			Flags:   &types.HeadersFlags{EndHeaders: true, EndStream: true, Priority: true},
+			Payload: &types.HeadersPayload{StreamDependency: 1, PriorityWeight: 15, Fragment: fragment},
+			Length:  uint32(len(fragment)) + 5,
+		})
+	}, expectReset(1, constants.ProtocolError)},
+	{"5.3.1", "PRIORITY frame depending on its own stream", func(pc *pipeClient) {
+		pc.writeFrame(&frame.Frame{
+			ID:      1,
+			Type:    frame.PriorityType,
+			Flags:   &types.PriorityFlags{},
+			Payload: &types.PriorityPayload{StreamDependency: 1, PriorityWeight: 15},
+			Length:  5,
+		})
+	}, expectReset(1, constants.ProtocolError)},
+	{"5.5", "Unknown frame type in the middle of a header block", func(pc *pipeClient) {
+		pc.writeFrame(newTestHeadersFrame(1, pc.hpack.Encode(validRequestFields("GET")), false, true))
+		pc.writeRaw(0x20, 0x0, 1, []byte("unknown"))
+	}, expectGoAway(constants.ProtocolError)},
+
+	// ---- Section 6: Frame Definitions ----
+	{"6.1", "DATA frame on stream 0", func(pc *pipeClient) {
+		pc.writeFrame(newTestData(0, "data", true))
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.1", "DATA frame with padding longer than the payload", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("POST")...)
+		pc.writeRaw(frame.DataType, 0x9, 1, []byte{5, 'd', 'a', 't', 'a'})
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.2", "HEADERS frame on stream 0", func(pc *pipeClient) {
+		pc.writeFrame(newTestHeadersFrame(0, pc.hpack.Encode(validRequestFields("GET")), true, true))
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.2", "HEADERS frame with padding longer than the payload", func(pc *pipeClient) {
+		pc.writeRaw(frame.HeadersType, 0xD, 1, []byte{5, 0x82})
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.3", "PRIORITY frame on stream 0", func(pc *pipeClient) {
+		pc.writeRaw(frame.PriorityType, 0x0, 0, []byte{0, 0, 0, 1, 15})
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.3", "PRIORITY frame with a length other than 5", func(pc *pipeClient) {
+		pc.writeRaw(frame.PriorityType, 0x0, 1, []byte{0, 0, 0, 3})
+	}, expectReset(1, constants.FrameSizeError)},
+	{"6.4", "RST_STREAM frame on stream 0", func(pc *pipeClient) {
+		pc.writeFrame(frame.NewErrorFrame(0, constants.Cancel))
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.4", "RST_STREAM frame with a length other than 4", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("POST")...)
+		pc.writeRaw(frame.RstStreamType, 0x0, 1, []byte{0, 0, 8})
+	}, expectGoAway(constants.FrameSizeError)},
+	{"6.5", "SETTINGS frame with ACK and a payload", func(pc *pipeClient) {
+		pc.writeRaw(frame.SettingsType, 0x1, 0, []byte{0, 3, 0, 0, 0, 100})
+	}, expectGoAway(constants.FrameSizeError)},
+	{"6.5", "SETTINGS frame on a stream", func(pc *pipeClient) {
+		pc.writeRaw(frame.SettingsType, 0x0, 1, []byte{0, 3, 0, 0, 0, 100})
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.5", "SETTINGS frame with a length that is not a multiple of 6", func(pc *pipeClient) {
+		pc.writeRaw(frame.SettingsType, 0x0, 0, []byte{0, 3, 0, 0, 100})
+	}, expectGoAway(constants.FrameSizeError)},
+	{"6.5.2", "SETTINGS_ENABLE_PUSH other than 0 or 1", func(pc *pipeClient) {
+		pc.writeSettings(0x2, 2)
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.5.2", "SETTINGS_INITIAL_WINDOW_SIZE above the maximum window size", func(pc *pipeClient) {
+		pc.writeSettings(0x4, 1<<31)
+	}, expectGoAway(constants.FlowControlError)},
+	{"6.5.2", "SETTINGS_MAX_FRAME_SIZE below the initial value", func(pc *pipeClient) {
+		pc.writeSettings(0x5, 16383)
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.5.2", "SETTINGS_MAX_FRAME_SIZE above the maximum frame size", func(pc *pipeClient) {
+		pc.writeSettings(0x5, 1<<24)
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.5.2", "Unknown setting is ignored", func(pc *pipeClient) {
+		pc.writeSettings(0xFF, 1)
+	}, expectSettingsAck},
+	{"6.5.3", "SETTINGS frame is acknowledged", func(pc *pipeClient) {
+		pc.writeSettings(0x3, 100)
+	}, expectSettingsAck},
+	{"6.7", "PING frame is answered with the same data", func(pc *pipeClient) {
+		pc.writeRaw(frame.PingType, 0x0, 0, []byte("pingdata"))
+	}, expectPingAck("pingdata")},
+	{"6.7", "PING frame with ACK is not answered", func(pc *pipeClient) {
+		pc.writeRaw(frame.PingType, 0x1, 0, []byte("ackdata!"))
+		pc.writeRaw(frame.PingType, 0x0, 0, []byte("pingdata"))
+	}, expectPingAck("pingdata")},
+	{"6.7", "PING frame on a stream", func(pc *pipeClient) {
+		pc.writeRaw(frame.PingType, 0x0, 1, []byte("pingdata"))
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.7", "PING frame with a length other than 8", func(pc *pipeClient) {
+		pc.writeRaw(frame.PingType, 0x0, 0, []byte("ping"))
+	}, expectGoAway(constants.FrameSizeError)},
+	{"6.8", "GOAWAY frame on a stream", func(pc *pipeClient) {
+		pc.writeRaw(frame.GoAwayType, 0x0, 1, []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.9", "WINDOW_UPDATE frame with an increment of 0 on the connection", func(pc *pipeClient) {
+		pc.writeFrame(newTestWindowUpdate(0, 0))
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.9", "WINDOW_UPDATE frame with an increment of 0 on a stream", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":path", "/wait")...)
+		pc.writeFrame(newTestWindowUpdate(1, 0))
+	}, expectReset(1, constants.ProtocolError)},
+	{"6.9", "WINDOW_UPDATE frame with a length other than 4", func(pc *pipeClient) {
+		pc.writeRaw(frame.WindowUpdateType, 0x0, 0, []byte{0, 0, 1})
+	}, expectGoAway(constants.FrameSizeError)},
+	{"6.9.1", "Connection window above the maximum window size", func(pc *pipeClient) {
+		pc.writeFrame(newTestWindowUpdate(0, 1<<31-1))
+	}, expectGoAway(constants.FlowControlError)},
+	{"6.9.1", "Stream window above the maximum window size", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":path", "/wait")...)
+		pc.writeFrame(newTestWindowUpdate(1, 1<<31-1))
+	}, expectReset(1, constants.FlowControlError)},
+	{"6.10", "CONTINUATION frame after a complete header block", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":path", "/wait")...)
+		pc.writeFrame(newTestContinuationFrame(1, pc.hpack.Encode([]*hpack.HeaderField{hf("x-test", "1")}), true))
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.10", "Header block interrupted by a DATA frame", func(pc *pipeClient) {
+		pc.writeFrame(newTestHeadersFrame(1, pc.hpack.Encode(validRequestFields("POST")), false, false))
+		pc.writeFrame(newTestData(1, "data", true))
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.10", "Header block interrupted by HEADERS on another stream", func(pc *pipeClient) {
+		pc.writeFrame(newTestHeadersFrame(1, pc.hpack.Encode(validRequestFields("GET")), false, true))
+		pc.writeRequest(3, true, validRequestFields("GET")...)
+	}, expectGoAway(constants.ProtocolError)},
+	{"6.10", "CONTINUATION frame on stream 0", func(pc *pipeClient) {
+		pc.writeFrame(newTestHeadersFrame(1, pc.hpack.Encode(validRequestFields("GET")), false, true))
+		pc.writeFrame(newTestContinuationFrame(0, []byte{}, true))
+	}, expectGoAway(constants.ProtocolError)},
+
+	// ---- Section 8: HTTP Message Exchanges ----
+	{"8.1", "Header block split into CONTINUATION frames", func(pc *pipeClient) {
+		fragment := pc.hpack.Encode(validRequestFields("GET"))
+		pc.writeFrame(newTestHeadersFrame(1, fragment[:1], false, true))
+		pc.writeFrame(newTestContinuationFrame(1, fragment[1:2], false))
+		pc.writeFrame(newTestContinuationFrame(1, fragment[2:], true))
+	}, expectResponse(1, "200")},
+	{"8.1", "Trailers without END_STREAM", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("POST")...)
+		pc.writeRequest(1, false, hf("x-trailer", "1"))
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2", "Uppercase header name", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", "X-Test", "1")...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.1", "Unknown pseudo-header", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":unknown", "1")...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.1", "Response pseudo-header in a request", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":status", "200")...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.1", "Pseudo-header after a regular header", func(pc *pipeClient) {
+		fields := append([]*hpack.HeaderField{hf("x-test", "1")}, validRequestFields("GET")...)
+		pc.writeRequest(1, true, fields...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.2", "Connection-specific header", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", "connection", "keep-alive")...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.2", "TE header other than trailers", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", "te", "gzip")...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.3", "Empty :path pseudo-header", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET", ":path", "")...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.3", "Missing :method pseudo-header", func(pc *pipeClient) {
+		pc.writeRequest(1, true, validRequestFields("GET")[1:]...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.3", "Duplicate :path pseudo-header", func(pc *pipeClient) {
+		fields := append(validRequestFields("GET"), hf(":path", "/"))
+		pc.writeRequest(1, true, fields...)
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.1.2.6", "Content-length not matching the DATA frames", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("POST", "content-length", "10")...)
+		pc.writeFrame(newTestData(1, "data", true))
+	}, expectReset(1, constants.ProtocolError)},
+	{"8.2", "PUSH_PROMISE frame from the client", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("POST")...)
+		fragment := pc.hpack.Encode(validRequestFields("GET"))
+		pc.writeFrame(&frame.Frame{
+			ID:      1,
+			Type:    frame.PushPromiseType,
+			Flags:   &types.PushPromiseFlags{EndHeaders: true},
+			Payload: &types.PushPromisePayload{StreamID: 2, Fragment: fragment},
+			Length:  uint32(len(fragment)) + 4,
+		})
+	}, expectGoAway(constants.ProtocolError)},
+
+	// ---- RFC8441: Bootstrapping WebSockets with HTTP/2 ----
+	{"RFC8441 3", "Extended CONNECT request to a server that has not enabled it", func(pc *pipeClient) {
+		pc.writeRequest(1, false, validRequestFields("CONNECT", ":protocol", "websocket")...)
+	}, expectReset(1, constants.ProtocolError)},
+
+	// ---- RFC7541: HPACK ----
+	{"HPACK 6.3", "Dynamic table size update above SETTINGS_HEADER_TABLE_SIZE", func(pc *pipeClient) {
+		fragment := append([]byte{0x3F, 0xE1, 0x3F}, pc.hpack.Encode(validRequestFields("GET"))...) // Size update to 8192
+		pc.writeFrame(newTestHeadersFrame(1, fragment, true, true))
+	}, expectGoAway(constants.CompressionError)},
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformanceCases {
+		t.Run(c.section+"/"+c.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			r := router.NewRouter("/")
+			r.Get("/", func(req *http.Request, res *http.Response) {
+				res.String(200, "ok")
+			})
+			r.Post("/", func(req *http.Request, res *http.Response) {
+				res.String(200, string(req.Body))
+			})
+			r.Get("/wait", func(req *http.Request, res *http.Response) {
+				select {
+				case <-release:
+				case <-req.Context().Done():
+				}
+			})
+
+			// Extended CONNECT is not announced, as no case opens a WebSocket
+			settings := DefaultSettings()
+			settings.EnableConnectProtocol = false
+			srv := NewServer()
+			srv.SetSettings(settings)
+			srv.Register(r)
+			pc := newPipeClient(srv)
+			defer pc.conn.Close()
+			pc.handshake()
+			pc.readFrame(t, frame.SettingsType, 0) // The SETTINGS of the server
+
+			c.send(pc)
+			c.expect(t, pc)
+		})
+	}
+}
+
+// ---------- HELPERS --------------
+
+// ExpectGoAway expects the connection to be closed with a GOAWAY frame with a given error code
+func expectGoAway(code constants.ErrorCode) func(t *testing.T, pc *pipeClient) {
+	return func(t *testing.T, pc *pipeClient) {
+		f := pc.nextFrame(t, func(f frame.Frame) bool {
+			return f.Type == frame.GoAwayType
+		})
+		if actual := f.Payload.(*types.GoAwayPayload).ErrorCode; actual != code {
+			t.Errorf("Incorrect GOAWAY error code! Expected %v, got %v", code, actual)
+		}
+	}
+}
+
+// ExpectReset expects a stream to be reset with a given error code, while the connection stays open
+func expectReset(streamID uint32, code constants.ErrorCode) func(t *testing.T, pc *pipeClient) {
+	return func(t *testing.T, pc *pipeClient) {
+		f := pc.nextFrame(t, func(f frame.Frame) bool {
+			return f.Type == frame.RstStreamType && f.ID == streamID
+		})
+		if actual := f.Payload.(*types.RstStreamPayload).ErrorCode; actual != code {
+			t.Errorf("Incorrect RST_STREAM error code! Expected %v, got %v", code, actual)
+		}
+		expectAlive(t, pc)
+	}
+}
+
+// ExpectResponse expects a response with a given status on a stream
+func expectResponse(streamID uint32, status string) func(t *testing.T, pc *pipeClient) {
+	return func(t *testing.T, pc *pipeClient) {
+		f := pc.nextFrame(t, func(f frame.Frame) bool {
+			return f.Type == frame.HeadersType && f.ID == streamID
+		})
+		hfs, err := pc.hpack.Decode(f.Payload.(*types.HeadersPayload).Fragment)
+		if err != nil {
+			t.Fatalf("Response headers could not be decoded: %v", err)
+		}
+		for _, field := range hfs {
+			if field.Name == ":status" && field.Value != status {
+				t.Errorf("Incorrect status! Expected %s, got %s", status, field.Value)
+			}
+		}
+	}
+}
+
+// ExpectPingAck expects a PING frame acknowledging a PING with the given data
+func expectPingAck(data string) func(t *testing.T, pc *pipeClient) {
+	return func(t *testing.T, pc *pipeClient) {
+		f := pc.nextFrame(t, func(f frame.Frame) bool {
+			return f.Type == frame.PingType
+		})
+		if !f.Flags.(*types.PingFlags).Ack {
+			t.Error("PING frame is not an acknowledgement")
+		}
+		if actual := string(f.Payload.(*types.PingPayload).Data); actual != data {
+			t.Errorf("Incorrect PING data! Expected %q, got %q", data, actual)
+		}
+	}
+}
+
+// ExpectAlive checks that the connection is still open, by sending a PING frame
+func expectAlive(t *testing.T, pc *pipeClient) {
+	pc.writeRaw(frame.PingType, 0x0, 0, []byte("isalive?"))
+	expectPingAck("isalive?")(t, pc)
+}
+
+// ExpectSettingsAck expects the SETTINGS frame of the client to be acknowledged
+func expectSettingsAck(t *testing.T, pc *pipeClient) {
+	pc.nextFrame(t, func(f frame.Frame) bool {
+		return f.Type == frame.SettingsType && f.Flags.(*types.SettingsFlags).Ack
+	})
+}
+
+// NextFrame waits for a frame matching a condition. A GOAWAY frame that is not expected fails the test.
+func (pc *pipeClient) nextFrame(t *testing.T, match func(f frame.Frame) bool) frame.Frame {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case f, ok := <-pc.frames:
+			if !ok {
+				t.Fatal("Connection closed before the expected frame was received")
+			}
+			if match(f) {
+				return f
+			}
+			if f.Type == frame.GoAwayType {
+				t.Fatalf("Unexpected GOAWAY with error code %v", f.Payload.(*types.GoAwayPayload).ErrorCode)
+			}
+		case <-timeout:
+			t.Fatal("Expected frame was not received")
+		}
+	}
+}
+
+// WriteRaw writes a frame from its parts, so frames that are invalid can be written
+func (pc *pipeClient) writeRaw(frameType, flags byte, streamID uint32, payload []byte) {
+	header := make([]byte, 9)
+	header[0], header[1], header[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	header[3] = frameType
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], streamID)
+	pc.conn.Write(append(header, payload...))
+}
+
+// WriteRequest encodes header fields and sends them in a HEADERS frame
+func (pc *pipeClient) writeRequest(streamID uint32, endStream bool, fields ...*hpack.HeaderField) {
+	pc.writeFrame(newTestHeadersFrame(streamID, pc.hpack.Encode(fields), true, endStream))
+}
+
+// WriteSettings sends a SETTINGS frame with a single setting
+func (pc *pipeClient) writeSettings(id uint16, value uint32) {
+	pc.writeFrame(&frame.Frame{
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{},
+		Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{id: value}},
+		Length:  6,
+	})
+}
+
+// ValidRequestFields returns the header fields of a valid request to "/". Pairs of names and values
+// replace fields with the same name, or are added.
+func validRequestFields(method string, pairs ...string) []*hpack.HeaderField {
+	fields := []*hpack.HeaderField{
+		hf(":method", method),
+		hf(":scheme", "https"),
+		hf(":authority", "localhost"),
+		hf(":path", "/"),
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		replaced := false
+		for _, field := range fields {
+			if field.Name == pairs[i] {
+				field.Value = pairs[i+1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			fields = append(fields, hf(pairs[i], pairs[i+1]))
+		}
+	}
+	return fields
+}
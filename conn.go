@@ -1,23 +1,33 @@
 package opal
 
 import (
+	"bufio"
 	"crypto/tls"
 	"fmt"
 	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"io"
 	"net"
+	"strings"
 
 	"github.com/SveinungOverland/opal/constants"
 	"github.com/SveinungOverland/opal/frame"
 	"github.com/SveinungOverland/opal/frame/types"
 
 	"context"
-	error "errors"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const initialHeaderTableSize = uint32(4096)
 
+// goAwayTimeout is how long a connection error waits for the GOAWAY frame to be written, before the connection is closed
+const goAwayTimeout = time.Second
+
+// The connection preface every HTTP/2 client starts with - RFC7540 Section 3.5
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
 var streamMapMutex = sync.Mutex{}
 
 // Conn represents a HTTP-connection
@@ -27,17 +37,40 @@ type Conn struct {
 	server            *Server
 	conn              net.Conn
 	tlsConn           *tls.Conn
+	rw                net.Conn      // The connection frames are written to, tlsConn if TLS is used
+	br                *bufio.Reader // Buffered reader of rw
+	fr                *frame.Reader // Reads frames from br, rejecting frames larger than the max frame size
 	hpack             *hpack.Context
+	headerBlock       *headerBlock // The header block being received, only accessed by the reading goroutine
 	lastReceivedFrame *frame.Frame
-	windowSize        uint32
+	sendFlow          *sendFlow      // Send windows, restored by the client's WINDOW_UPDATE frames
+	flowSignal        chan struct{}  // Signals the writer that send windows have changed
+	recvWindow        int32          // Connection-level receive window, accessed atomically
+	scheduler         WriteScheduler // Decides the order of DATA frames, guarded by schedulerMu
+	schedulerMu       sync.Mutex
+	hpackMu           sync.Mutex // Guards encoding and queueing of header blocks, see writeHeaders
 	isTLS             bool
-	maxConcurrent     uint32
+	localSettings     Settings           // The settings announced to the client
+	recvInitial       int32              // Initial receive window of new streams, changed when the settings are acknowledged
 	streams           map[uint32]*Stream // map streamId to Stream instance
 	inChan            chan *Stream       // Channel for handling new ended stream
 	outChan           chan *Stream       // Channel for sending finished streams
 	outChanFrame      chan *frame.Frame  // Channel for sending single Frame's
-	settings          map[uint16]uint32
-	prevStreamID      uint32 // The previous created stream's identifer.
+	settings          map[uint16]uint32  // The client's settings, guarded by mu
+	prevStreamID      uint32             // The previous created stream's identifer, accessed atomically
+
+	mu             sync.Mutex          // Guards the settings and the shutdown state below
+	settingsTimer  *time.Timer         // Closes the connection if the server's settings are not acknowledged
+	lastStreamID   uint32              // The highest client-initiated stream identifier received
+	goAwayStreamID uint32              // The last stream identifier announced in a sent GOAWAY
+	draining       bool                // Set when a GOAWAY has been sent, no new streams are accepted
+	ready          bool                // Set when the connection preface is done
+	isHTTP1        bool                // Set when the client speaks HTTP/1.1
+	idle           bool                // Set when a HTTP/1.1 connection is waiting for a new request
+	active         map[uint32]struct{} // Streams that are being handled, but not fully written
+	overdue        int                 // Handlers that are still running after their timeout expired
+	overdueDone    chan struct{}       // Signalled when an overdue handler returns
+	closeOnce      sync.Once
 }
 
 // SetStream sets the stream
@@ -57,26 +90,13 @@ func (c *Conn) GetStream(id uint32) (*Stream, bool) {
 
 func (c *Conn) serve() {
 	// start := time.Now() // Request timer
-	defer c.cancel()
+	defer c.server.trackConn(c, false)
+	defer c.close()
 	defer close(c.inChan)
-	defer close(c.outChan)
-	defer close(c.outChanFrame)
-
-	// Helper funcs
-	NewConnErr := func(connErr uint32) *frame.Frame {
-		return &frame.Frame{
-			ID:    0,
-			Type:  frame.GoAwayType,
-			Flags: &types.GoAwayFlags{},
-			Payload: &types.GoAwayPayload{
-				LastStreamID: c.lastReceivedFrame.ID,
-				ErrorCode:    connErr,
-			},
-			Length: 8,
-		}
-	}
+	defer c.closeStreams() // Handlers reading or writing streams are not left waiting
 
 	// Initialize TLS handshake
+	c.rw = c.conn
 	if c.isTLS {
 		err := c.tlsConn.Handshake()
 		if err != nil {
@@ -85,248 +105,699 @@ func (c *Conn) serve() {
 			c.tlsConn.Close()
 			return
 		}
+		c.rw = c.tlsConn
 	}
+	c.br = bufio.NewReader(c.rw)
+	c.fr = frame.NewReader(c.br)
 
-	prefaceBuffer := make([]byte, 24)
-	c.tlsConn.Read(prefaceBuffer)
-	// TODO: Check prefaceBuffer ^^
-	if !strings.HasPrefix(string(prefaceBuffer), "PRI") {
-		fmt.Println("Invalid HTTP/2 preface-buffer: " + string(prefaceBuffer))
-		return
-	}
-
-	settingsFrame, err := frame.ReadFrame(c.tlsConn)
-	if err != nil {
-		c.server.nonBlockingErrorChanSend(err)
-	}
-
-	if settingsFrame.Type != frame.SettingsType {
-		// This should not happen but error should be handled
-		panic("Settings frame from handshake is of wrong type!")
+	// Clients that did not negotiate HTTP/2 with ALPN, nor starts with the connection preface,
+	// speaks HTTP/1.1. Cleartext connections may be upgraded to HTTP/2 - RFC7540 Section 3.2
+	var upgradeStream *Stream
+	negotiatedH2 := c.isTLS && c.tlsConn.ConnectionState().NegotiatedProtocol == "h2"
+	if !negotiatedH2 && !c.hasPreface() {
+		req, err := http.ReadRequest(c.br, c.server.bodyLimit())
+		if c.rejectRequest(req, err) {
+			return
+		}
+		if err != nil {
+			c.server.nonBlockingErrorChanSend(err)
+			return
+		}
+		if c.isTLS || !isH2CUpgrade(req) {
+			c.serveHTTP1(req)
+			return
+		}
+		upgradeStream, err = c.upgradeH2C(req)
+		if err != nil {
+			c.server.nonBlockingErrorChanSend(err)
+			return
+		}
 	}
 
-	if settingsFrame.Length > 0 {
-		for key, value := range settingsFrame.Payload.(*types.SettingsPayload).IDValuePair {
-			if key >= 0x1 && key <= 0x6 {
-				// Any other key is out of range and is ignored
-				c.settings[key] = value
-			}
-		}
+	prefaceBuffer := make([]byte, len(clientPreface))
+	io.ReadFull(c.br, prefaceBuffer)
+	if string(prefaceBuffer) != clientPreface {
+		fmt.Println("Invalid HTTP/2 preface-buffer: " + string(prefaceBuffer))
+		return
 	}
 
 	// Creating new HPACK context (with encoder and decoder)
 	// Setting 1 is ContextSize
-	c.hpack = hpack.NewContext(initialHeaderTableSize, c.settings[1])
-
-	settingsResponse := &frame.Frame{
-		ID:     0,
-		Type:   frame.SettingsType,
-		Length: 0,
-		Flags: &types.SettingsFlags{
-			Ack: true,
-		},
-	}
+	c.hpack = hpack.NewContext(initialHeaderTableSize, c.localSettings.HeaderTableSize)
+	c.hpack.Decoder.SetMaxHeaderListSize(c.localSettings.headerListLimit())
+	c.resizeEncoder(c.setting(0x1)) // The client may have sent its settings in an upgrade request
 
 	go serveStreamHandler(c) // Starting go-routine that is responsible for handling requests when streams are done
 	go WriteStream(c)        // Starting go-routine that is responsible for handling handled requests that should be written back to client
 
-	c.outChanFrame <- settingsResponse
+	// The server's SETTINGS frame is the first frame it sends - RFC7540 Section 3.5
+	c.sendSettings()
+
+	// The client's connection preface ends with a SETTINGS frame, which is acknowledged like any other
+	settingsFrame, err := c.fr.ReadFrame()
+	if err == nil && (settingsFrame.Type != frame.SettingsType || settingsFrame.Flags.(*types.SettingsFlags).Ack) {
+		err = constants.ConnectionError{Code: constants.ProtocolError, Reason: "connection preface is not followed by SETTINGS"}
+	}
+	if err == nil {
+		err = c.processFrame(&settingsFrame)
+	}
+	if err != nil {
+		c.handleError(err)
+		return
+	}
+
+	c.mu.Lock()
+	c.ready = true
+	c.mu.Unlock()
+
+	// The request sent with the upgrade is assigned stream 1 and is half-closed (remote)
+	if upgradeStream != nil {
+		c.acceptStream(upgradeStream.id)
+		c.initStream(upgradeStream)
+		c.SetStream(upgradeStream)
+		c.dispatch(upgradeStream)
+	}
 
 	// Connection initiated and ready to receive header frames
-	// constants.EnhanceYourCalm
-loop:
 	for {
 		select {
 		case <-c.ctx.Done():
-			break loop
+			return
 		default:
 		}
 
-		newFrame, err := frame.ReadFrame(c.tlsConn)
+		newFrame, err := c.fr.ReadFrame()
+		if err == nil {
+			err = c.processFrame(&newFrame)
+			c.lastReceivedFrame = &newFrame
+		}
+		if err != nil && !c.handleError(err) {
+			return
+		}
+	}
+}
+
+// ProcessFrame handles a frame received from the client. Returns a constants.ConnectionError or
+// constants.StreamError if the client breaks the protocol.
+func (c *Conn) processFrame(f *frame.Frame) error {
+	if c.headerBlock != nil && (f.Type != frame.ContinuationType || f.ID != c.headerBlock.streamID) {
+		// A header block must be sent as a contiguous sequence of frames - RFC7540 Section 4.3
+		return constants.ConnectionError{Code: constants.ProtocolError, Reason: "header block is interrupted"}
+	}
+
+	switch f.Type {
+	case frame.DataType:
+		// Data should always be associated with a stream
+		if f.ID == 0 {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "DATA frame on stream 0"}
+		}
+		// The whole frame, including padding, counts against the receive windows - RFC7540 Section 6.9.1
+		// The windows are compared as signed values, as they become negative if the initial window size is reduced
+		if int64(f.Length) > int64(atomic.LoadInt32(&c.recvWindow)) {
+			return constants.ConnectionError{Code: constants.FlowControlError, Reason: "DATA frame exceeds the connection window"}
+		}
+		atomic.AddInt32(&c.recvWindow, -int32(f.Length))
+		stream, ok := c.GetStream(f.ID)
+		if !ok {
+			c.returnCredit(nil, f.Length)
+			return c.unknownStream(f)
+		}
+		state, err := stream.recvFrame(f)
 		if err != nil {
-			c.server.nonBlockingErrorChanSend(err)
-			break loop
+			// Stream is not in a state where it can receive data frames
+			c.returnCredit(nil, f.Length)
+			return err
+		}
+		if int64(f.Length) > int64(atomic.LoadInt32(&stream.recvWindow)) {
+			c.returnCredit(nil, f.Length)
+			return constants.StreamError{StreamID: stream.id, Code: constants.FlowControlError}
 		}
+		atomic.AddInt32(&stream.recvWindow, -int32(f.Length))
 
-		switch newFrame.Type {
-		case frame.DataType:
-			// Data should always be associated with a stream
-			stream, ok := c.GetStream(newFrame.ID)
-			if !ok {
-				continue loop
-			}
-			if !(stream.state == Open || stream.state == HalfClosedLocal) {
-				// Stream is not in a state where it can receive data frames
-				c.outChanFrame <- frame.NewErrorFrame(stream.id, constants.StreamClosed)
-				continue loop
-			}
-			if stream.id == 0 {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			if stream.data == nil {
-				stream.data = newFrame.Payload.(*types.DataPayload).Data
-			} else {
-				stream.data = append(stream.data, newFrame.Payload.(*types.DataPayload).Data...)
-			}
-			if newFrame.Flags.(*types.DataFlags).EndStream {
-				stream.state = HalfClosedRemote
-				c.inChan <- stream
-			}
-		case frame.HeadersType:
-			// New stream
-			if newFrame.ID == 0 {
-				// Error, a header should always be associated with a stream
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			streamState := Idle
-			if newFrame.Flags.(*types.HeadersFlags).EndHeaders {
-				streamState = Open
-			}
-			if newFrame.Flags.(*types.HeadersFlags).EndStream && streamState == Open {
-				streamState = HalfClosedRemote
-			}
-			newStream := &Stream{
-				id:               newFrame.ID,
-				state:            streamState,
-				lastFrame:        &newFrame,
-				headers:          newFrame.Payload.(*types.HeadersPayload).Fragment,
-				streamDependency: newFrame.Payload.(*types.HeadersPayload).StreamDependency,
-				priorityWeight:   newFrame.Payload.(*types.HeadersPayload).PriorityWeight,
-			}
-			c.SetStream(newStream)
-			if newStream.state == HalfClosedRemote {
-				c.inChan <- newStream
-			}
-		case frame.PriorityType:
-			stream, ok := c.GetStream(newFrame.ID)
-			if newFrame.ID == 0 {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			if newFrame.Length != 5 {
-				c.outChanFrame <- frame.NewErrorFrame(stream.id, constants.FrameSizeError)
-				continue loop
-			}
-			if !ok {
-				stream = &Stream{
-					id:        newFrame.ID,
-					state:     Idle,
-					lastFrame: &newFrame,
-					headers:   make([]byte, 0),
-				}
-			}
-			stream.priorityWeight = newFrame.Payload.(*types.PriorityPayload).PriorityWeight
-			stream.streamDependency = newFrame.Payload.(*types.PriorityPayload).StreamDependency
-		case frame.RstStreamType:
-			stream, ok := c.GetStream(newFrame.ID)
-			if newFrame.ID == 0 {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			if newFrame.Length != 4 {
-				c.outChanFrame <- frame.NewErrorFrame(stream.id, constants.FrameSizeError)
-				continue loop
-			}
-			if !ok {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			stream.state = Closed
-			// TODO HANDLE ERROR CODE SENT IN FRAME
-		case frame.SettingsType:
-			if newFrame.ID != 0 {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			if newFrame.Flags.(*types.SettingsFlags).Ack {
-				if newFrame.Length != 0 {
-					c.outChanFrame <- NewConnErr(constants.FrameSizeError)
+		endStream := f.Flags.(*types.DataFlags).EndStream
+		data := f.Payload.(*types.DataPayload).Data
+		stream.received += int64(len(data))
+		if stream.contentLength >= 0 && (stream.received > stream.contentLength || (endStream && stream.received != stream.contentLength)) {
+			// The body must have the length of the content-length header - RFC7540 Section 8.1.2.6
+			c.returnCredit(nil, f.Length)
+			stream.body.closeWithError(ErrBodyReset)
+			return constants.StreamError{StreamID: stream.id, Code: constants.ProtocolError}
+		}
+
+		tooLarge := stream.received > c.server.bodyLimit()
+		if tooLarge {
+			// The rest of the body is discarded, and the handler answers with 413. The stream window
+			// is not restored, so the client stops sending until it gets the response.
+			stream.body.closeWithError(http.ErrBodyTooLarge)
+		}
+
+		// Credit for the data is returned as the handler reads the body, padding is returned right away.
+		// The stream window is not restored if the client will not send more data on the stream.
+		padding := f.Length - uint32(len(data))
+		if !stream.body.write(data) {
+			padding = f.Length // The body is closed by the handler, and the data is discarded
+		}
+		c.returnCredit(nil, padding)
+		if !endStream && !tooLarge {
+			c.returnCredit(stream, padding)
+		}
+		if endStream {
+			stream.body.closeWithError(io.EOF)
+		}
+		if state == Closed {
+			c.removeStream(stream.id)
+		}
+	case frame.HeadersType:
+		// New stream
+		if f.ID == 0 {
+			// Error, a header should always be associated with a stream
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "HEADERS frame on stream 0"}
+		}
+		headersPayload := f.Payload.(*types.HeadersPayload)
+		endHeaders := f.Flags.(*types.HeadersFlags).EndHeaders
+		if stream, ok := c.GetStream(f.ID); ok {
+			// A header block on a stream that is already open carries trailers - RFC7540 Section 8.1
+			state, err := stream.recvFrame(f)
+			if _, ok := err.(constants.ConnectionError); ok {
+				return err
+			}
+			endStream := f.Flags.(*types.HeadersFlags).EndStream
+			return c.startHeaderBlock(f.ID, headersPayload.Fragment, endHeaders, func(hfs []*hpack.HeaderField) error {
+				if err != nil {
+					return err
 				}
-				continue loop
-			}
-			if newFrame.Length%6 != 0 {
-				c.outChanFrame <- NewConnErr(constants.FrameSizeError)
-				continue loop
+				return c.trailersComplete(stream, state, endStream, hfs)
+			})
+		}
+		if f.ID%2 == 0 {
+			// Clients initiate streams with odd identifiers - RFC7540 Section 5.1.1
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "HEADERS frame on even stream"}
+		}
+		if !c.isIdle(f.ID) && !c.ignoredStream(f.ID) {
+			// New streams must have higher identifiers than all streams before them - RFC7540 Section 5.1.1
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "stream identifier is not increasing"}
+		}
+		// The header blocks of streams that are not opened are still decoded, so the HPACK state is kept in sync
+		if !c.acceptStream(f.ID) {
+			// A GOAWAY has been sent, streams initiated after it are ignored
+			return c.startHeaderBlock(f.ID, headersPayload.Fragment, endHeaders, discardHeaders(nil))
+		}
+		if headersPayload.StreamDependency == f.ID {
+			// A stream can not depend on itself - RFC7540 Section 5.3.1
+			err := constants.StreamError{StreamID: f.ID, Code: constants.ProtocolError}
+			return c.startHeaderBlock(f.ID, headersPayload.Fragment, endHeaders, discardHeaders(err))
+		}
+		if !c.openStream(f.ID) {
+			// Too many concurrent streams - RFC7540 Section 5.1.2
+			err := constants.StreamError{StreamID: f.ID, Code: constants.RefusedStream}
+			return c.startHeaderBlock(f.ID, headersPayload.Fragment, endHeaders, discardHeaders(err))
+		}
+		newStream := &Stream{
+			id:               f.ID,
+			state:            Idle,
+			recvWindow:       c.recvInitial,
+			lastFrame:        f,
+			streamDependency: headersPayload.StreamDependency,
+			priorityWeight:   headersPayload.PriorityWeight,
+			contentLength:    -1,
+		}
+		newStream.recvFrame(f) // Opens the stream, and half-closes it if END_STREAM is set
+		c.SetStream(newStream)
+		priority := defaultPriority
+		if f.Flags.(*types.HeadersFlags).Priority {
+			priority = Priority{
+				StreamDependency: headersPayload.StreamDependency,
+				Weight:           headersPayload.PriorityWeight,
+				Exclusive:        headersPayload.StreamExclusive,
 			}
-			if settingsFrame.Length > 0 {
-				for key, value := range settingsFrame.Payload.(*types.SettingsPayload).IDValuePair {
-					if key >= 0x1 && key <= 0x6 {
-						// Any other key is out of range and is ignored
-						c.settings[key] = value
-					}
-				}
+		}
+		c.withScheduler(func(ws WriteScheduler) { ws.OpenStream(newStream.id, priority) })
+		endStream := f.Flags.(*types.HeadersFlags).EndStream
+		return c.startHeaderBlock(f.ID, headersPayload.Fragment, endHeaders, func(hfs []*hpack.HeaderField) error {
+			contentLength, ok := validRequestHeaders(hfs, c.localSettings.EnableConnectProtocol)
+			if !ok || (endStream && contentLength > 0) {
+				// Malformed requests are reset, and their body is discarded - RFC7540 Section 8.1.2.6
+				newStream.body = newRequestBody(c, newStream)
+				newStream.body.closeWithError(ErrBodyReset)
+				return constants.StreamError{StreamID: f.ID, Code: constants.ProtocolError}
+			}
+			newStream.fields = hfs
+			newStream.contentLength = contentLength
+			c.headersComplete(newStream)
+			return nil
+		})
+	case frame.PriorityType:
+		stream, ok := c.GetStream(f.ID)
+		if f.ID == 0 {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "PRIORITY frame on stream 0"}
+		}
+		priorityPayload := f.Payload.(*types.PriorityPayload)
+		if priorityPayload.StreamDependency == f.ID {
+			// A stream can not depend on itself - RFC7540 Section 5.3.1
+			return constants.StreamError{StreamID: f.ID, Code: constants.ProtocolError}
+		}
+		if !ok {
+			stream = &Stream{
+				id:        f.ID,
+				state:     Idle,
+				lastFrame: f,
 			}
-			settingsResponse := &frame.Frame{
-				ID:     0,
-				Type:   frame.SettingsType,
-				Length: 0,
-				Flags: &types.SettingsFlags{
+		}
+		stream.priorityWeight = priorityPayload.PriorityWeight
+		stream.streamDependency = priorityPayload.StreamDependency
+		c.withScheduler(func(ws WriteScheduler) {
+			ws.AdjustStream(f.ID, Priority{
+				StreamDependency: priorityPayload.StreamDependency,
+				Weight:           priorityPayload.PriorityWeight,
+				Exclusive:        priorityPayload.StreamExclusive,
+			})
+		})
+	case frame.RstStreamType:
+		if f.ID == 0 {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "RST_STREAM frame on stream 0"}
+		}
+		stream, ok := c.GetStream(f.ID)
+		if !ok {
+			return c.unknownStream(f)
+		}
+		stream.recvFrame(f) // Closes the stream
+		if stream.body != nil {
+			stream.body.closeWithError(ErrBodyReset)
+		}
+		c.closeStream(stream.id) // Frames that are not written yet are dropped
+		c.removeStream(stream.id)
+		// TODO HANDLE ERROR CODE SENT IN FRAME
+	case frame.SettingsType:
+		if f.ID != 0 {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "SETTINGS frame on a stream"}
+		}
+		if f.Flags.(*types.SettingsFlags).Ack {
+			c.settingsAcked()
+			return nil
+		}
+		values := f.Payload.(*types.SettingsPayload).IDValuePair
+		if err := c.applySettings(values); err != nil {
+			return err
+		}
+		if size, ok := values[0x1]; ok {
+			c.resizeEncoder(size)
+		}
+		settingsResponse := &frame.Frame{
+			ID:     0,
+			Type:   frame.SettingsType,
+			Length: 0,
+			Flags: &types.SettingsFlags{
+				Ack: true,
+			},
+		}
+		c.sendFrame(settingsResponse)
+	case frame.PushPromiseType:
+		// Clients can not push streams - RFC7540 Section 8.2
+		return constants.ConnectionError{Code: constants.ProtocolError, Reason: "PUSH_PROMISE frame from client"}
+	case frame.PingType:
+		if f.ID != 0 {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "PING frame on a stream"}
+		}
+		if !f.Flags.(*types.PingFlags).Ack {
+			pingResponse := &frame.Frame{
+				ID:   0,
+				Type: frame.PingType,
+				Flags: &types.PingFlags{
 					Ack: true,
 				},
+				Payload: f.Payload,
+				Length:  8,
 			}
-			c.outChanFrame <- settingsResponse
-		case frame.PushPromiseType:
-			// Server does not handle PushPromises
-		case frame.PingType:
-			if newFrame.ID != 0 {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			if newFrame.Length != 8 {
-				c.outChanFrame <- NewConnErr(constants.FrameSizeError)
-				continue loop
-			}
-			if !newFrame.Flags.(*types.PingFlags).Ack {
-				pingResponse := &frame.Frame{
-					ID:   0,
-					Type: frame.PingType,
-					Flags: &types.PingFlags{
-						Ack: true,
-					},
-					Payload: newFrame.Payload,
-					Length:  8,
-				}
-				c.outChanFrame <- pingResponse
-			}
-		case frame.GoAwayType:
-			if newFrame.ID != 0 {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			if newFrame.Payload.(*types.GoAwayPayload).ErrorCode != constants.NoError {
-				c.server.nonBlockingErrorChanSend(error.New(fmt.Sprint(newFrame.Payload.(*types.GoAwayPayload).ErrorCode)))
-				break loop
-			} else {
-				c.cancel()
-				continue loop
-			}
-		case frame.WindowUpdateType:
-			// Update the window size
-			if newFrame.Payload.(*types.WindowUpdatePayload).WindowSizeIncrement == 0 {
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
-				continue loop
-			}
-			if newFrame.Length != 4 {
-				c.outChanFrame <- NewConnErr(constants.FrameSizeError)
-				continue loop
-			}
-			if newFrame.ID == 0 {
-				c.windowSize += newFrame.Payload.(*types.WindowUpdatePayload).WindowSizeIncrement
-			}
-		case frame.ContinuationType:
-			// Append headerfragment
-			stream, ok := c.GetStream(newFrame.ID)
-			if !ok || newFrame.ID == 0 {
-				// Error continuation should always only follow a header
-				c.outChanFrame <- NewConnErr(constants.ProtocolError)
+			c.sendFrame(pingResponse)
+		}
+	case frame.GoAwayType:
+		if f.ID != 0 {
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "GOAWAY frame on a stream"}
+		}
+		if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.NoError {
+			return fmt.Errorf("opal: Client closed the connection with %v", code)
+		}
+		c.cancel()
+	case frame.WindowUpdateType:
+		// Update the window size
+		increment := f.Payload.(*types.WindowUpdatePayload).WindowSizeIncrement
+		if f.ID == 0 {
+			if increment == 0 {
+				return constants.ConnectionError{Code: constants.ProtocolError, Reason: "WINDOW_UPDATE with zero increment"}
+			}
+			if !c.sendFlow.addConn(increment) {
+				return constants.ConnectionError{Code: constants.FlowControlError, Reason: "connection window exceeds 2^31-1"}
+			}
+		} else if _, ok := c.GetStream(f.ID); ok {
+			if increment == 0 {
+				return constants.StreamError{StreamID: f.ID, Code: constants.ProtocolError}
+			}
+			if !c.sendFlow.addStream(f.ID, increment) {
+				return constants.StreamError{StreamID: f.ID, Code: constants.FlowControlError}
+			}
+		} else if err := c.unknownStream(f); err != nil {
+			return err
+		}
+		c.signalFlow()
+	case frame.ContinuationType:
+		if c.headerBlock == nil {
+			// Error continuation should always only follow a header
+			return constants.ConnectionError{Code: constants.ProtocolError, Reason: "CONTINUATION frame without HEADERS"}
+		}
+		// Append headerfragment
+		return c.appendHeaderBlock(f.Payload.(*types.ContinuationPayload).HeaderFragment, f.Flags.(*types.ContinuationFlags).EndHeaders)
+	}
+	return nil
+}
+
+// HandleError handles an error from reading or processing a frame. A stream error resets the stream, and a
+// connection error sends a GOAWAY frame and closes the connection - RFC7540 Section 5.4.
+// Returns false if the connection is closed.
+func (c *Conn) handleError(err error) bool {
+	switch e := err.(type) {
+	case constants.StreamError:
+		c.sendFrame(frame.NewErrorFrame(e.StreamID, e.Code))
+		return true
+	case constants.ConnectionError:
+		// The writer closes the connection when the GOAWAY frame is written
+		c.sendFrame(c.newGoAwayFrame(e.Code))
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(goAwayTimeout):
+		}
+		return false
+	default:
+		c.server.nonBlockingErrorChanSend(err)
+		return false
+	}
+}
+
+// ------- HELPERS ---------
+
+// SendFrame queues a single frame for writing, unless the connection is closed
+func (c *Conn) sendFrame(f *frame.Frame) {
+	select {
+	case c.outChanFrame <- f:
+	case <-c.ctx.Done():
+	}
+}
+
+// SendStream queues a stream with encoded headers and data for writing, unless the connection is closed
+func (c *Conn) sendStream(s *Stream) {
+	select {
+	case c.outChan <- s:
+	case <-c.ctx.Done():
+	}
+}
+
+// Setting returns the value of one of the client's settings
+func (c *Conn) setting(id uint16) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings[id]
+}
+
+// ApplySettings stores the client's settings. Returns a connection error if any of the values are invalid.
+func (c *Conn) applySettings(settings map[uint16]uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, value := range settings {
+		switch key {
+		case 0x2: // Enable Push
+			if value > 1 {
+				return constants.ConnectionError{Code: constants.ProtocolError, Reason: "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case 0x4: // Initial Window Size
+			if value > maxWindowSize || !c.sendFlow.setInitial(value) {
+				return constants.ConnectionError{Code: constants.FlowControlError, Reason: "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+		case 0x5: // Max Frame Size
+			if value < 16384 || value > frame.MaxFrameSizeLimit {
+				return constants.ConnectionError{Code: constants.ProtocolError, Reason: "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+		case 0x8: // Enable Connect Protocol, which only matters when sent by the server
+			if value > 1 {
+				return constants.ConnectionError{Code: constants.ProtocolError, Reason: "invalid SETTINGS_ENABLE_CONNECT_PROTOCOL"}
 			}
-			if newFrame.Flags.(*types.ContinuationFlags).EndHeaders {
-				stream.state = Open
+		}
+		if key >= 0x1 && key <= 0x6 {
+			// Any other key is out of range and is ignored
+			c.settings[key] = value
+		}
+	}
+	c.signalFlow()
+	return nil
+}
+
+// ResizeEncoder resizes the dynamic table of the response encoder to the client's SETTINGS_HEADER_TABLE_SIZE,
+// up to initialHeaderTableSize. The resize is signaled at the start of the next header block - RFC7541 Section 4.2.
+func (c *Conn) resizeEncoder(size uint32) {
+	if size > initialHeaderTableSize {
+		size = initialHeaderTableSize
+	}
+	c.hpackMu.Lock()
+	c.hpack.Encoder.SetMaxDynamicTableSize(size)
+	c.hpackMu.Unlock()
+}
+
+// SignalFlow wakes up the writer if it is waiting for flow-control credit
+func (c *Conn) signalFlow() {
+	select {
+	case c.flowSignal <- struct{}{}:
+	default:
+	}
+}
+
+// ReturnCredit gives the client credit to send more data. A nil stream restores the connection window.
+func (c *Conn) returnCredit(s *Stream, increment uint32) {
+	if increment == 0 {
+		return
+	}
+	streamID := uint32(0)
+	if s == nil {
+		atomic.AddInt32(&c.recvWindow, int32(increment))
+	} else {
+		atomic.AddInt32(&s.recvWindow, int32(increment))
+		streamID = s.id
+	}
+	c.sendFrame(&frame.Frame{
+		ID:    streamID,
+		Type:  frame.WindowUpdateType,
+		Flags: &types.WindowUpdateFlags{},
+		Payload: &types.WindowUpdatePayload{
+			WindowSizeIncrement: increment,
+		},
+		Length: 4,
+	})
+}
+
+// DataWritten wakes up a handler waiting for its streamed response to be written
+func (c *Conn) dataWritten(f *frame.Frame) {
+	s, ok := c.GetStream(f.ID)
+	if ok && atomic.AddInt64(&s.queued, -int64(f.Length)) <= 0 {
+		signalFlushed(s)
+	}
+}
+
+// SignalFlushed wakes up a handler waiting for the stream, if any
+func signalFlushed(s *Stream) {
+	if s.flushed == nil {
+		return
+	}
+	select {
+	case s.flushed <- struct{}{}:
+	default:
+	}
+}
+
+// WithScheduler runs a function while holding the write scheduler lock
+func (c *Conn) withScheduler(fn func(ws WriteScheduler)) {
+	c.schedulerMu.Lock()
+	defer c.schedulerMu.Unlock()
+	fn(c.scheduler)
+}
+
+// CloseStream releases everything the writer keeps for a stream that is done
+func (c *Conn) closeStream(id uint32) {
+	if s, ok := c.GetStream(id); ok {
+		s.markClosed()
+	}
+	c.withScheduler(func(ws WriteScheduler) { ws.CloseStream(id) })
+	c.sendFlow.closeStream(id)
+	c.streamFinished(id)
+}
+
+// HeadersComplete dispatches a stream when its request headers are received. The request
+// body is fed by the DATA frames received later, unless the client has ended the stream.
+func (c *Conn) headersComplete(s *Stream) {
+	c.initStream(s)
+	s.body = newRequestBody(c, s)
+	if s.contentLength > c.server.bodyLimit() {
+		s.body.closeWithError(http.ErrBodyTooLarge) // Nothing is read of a body that is announced to be too large
+	}
+	if s.getState() == HalfClosedRemote {
+		s.body.closeWithError(io.EOF)
+	}
+	c.dispatch(s)
+}
+
+// TrailersComplete ends the request body of a stream with the trailers received after its data.
+// Trailers must end the stream, and must not contain pseudo-header fields - RFC7540 Section 8.1.
+func (c *Conn) trailersComplete(s *Stream, state StreamState, endStream bool, hfs []*hpack.HeaderField) error {
+	malformed := !endStream
+	for _, hf := range hfs {
+		if strings.HasPrefix(hf.Name, ":") {
+			malformed = true
+		}
+	}
+	if malformed {
+		s.body.closeWithError(ErrBodyReset)
+		return constants.StreamError{StreamID: s.id, Code: constants.ProtocolError}
+	}
+	s.body.closeWithTrailer(hfs)
+	if state == Closed {
+		c.removeStream(s.id)
+	}
+	return nil
+}
+
+// CloseStreams marks all streams as closed when the connection is closed. Reads of request
+// bodies that are not fully received return ErrBodyReset.
+func (c *Conn) closeStreams() {
+	streamMapMutex.Lock()
+	defer streamMapMutex.Unlock()
+	for _, stream := range c.streams {
+		if stream.body != nil {
+			stream.body.closeWithError(ErrBodyReset)
+		}
+		stream.markClosed()
+	}
+}
+
+// InitStream prepares a client-initiated stream for being handled
+func (c *Conn) initStream(s *Stream) {
+	s.flushed = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancel(c.ctx) // The connection's context is cancelled on GOAWAY and teardown
+}
+
+// Dispatch hands a stream with a complete request over to the stream handler
+func (c *Conn) dispatch(s *Stream) {
+	c.mu.Lock()
+	c.active[s.id] = struct{}{}
+	c.mu.Unlock()
+
+	c.inChan <- s
+}
+
+// AcceptStream records a new client-initiated stream. Returns false if the stream
+// was initiated after a GOAWAY was sent, in which case it should be ignored.
+func (c *Conn) acceptStream(id uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining && id > c.goAwayStreamID {
+		return false
+	}
+	if id > c.lastStreamID {
+		c.lastStreamID = id
+	}
+	return true
+}
+
+// OpenStream marks a client-initiated stream as active. Returns false if
+// the stream would exceed the limit of concurrent streams.
+func (c *Conn) openStream(id uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localSettings.MaxConcurrentStreams != 0 {
+		concurrent := uint32(0)
+		for activeID := range c.active {
+			if activeID%2 == 1 { // Streams pushed by the server does not count
+				concurrent++
 			}
-			stream.headers = append(stream.headers, newFrame.Payload.(*types.ContinuationPayload).HeaderFragment...)
 		}
-		c.lastReceivedFrame = &newFrame
+		if concurrent+uint32(c.overdue) >= c.localSettings.MaxConcurrentStreams {
+			return false
+		}
+	}
+	c.active[id] = struct{}{}
+	return true
+}
+
+// StreamFinished marks a stream as fully written
+func (c *Conn) streamFinished(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.active, id)
+}
+
+// Drained reports if a GOAWAY has been sent and all in-flight streams are finished
+func (c *Conn) drained() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining && len(c.active) == 0
+}
+
+// NewGoAwayFrame creates a GOAWAY frame announcing the last processed stream
+func (c *Conn) newGoAwayFrame(errorCode constants.ErrorCode) *frame.Frame {
+	c.mu.Lock()
+	lastStreamID := c.lastStreamID
+	c.mu.Unlock()
+
+	return &frame.Frame{
+		ID:    0,
+		Type:  frame.GoAwayType,
+		Flags: &types.GoAwayFlags{},
+		Payload: &types.GoAwayPayload{
+			LastStreamID: lastStreamID,
+			ErrorCode:    errorCode,
+		},
+		Length: 8,
 	}
 }
+
+// Shutdown starts a graceful shutdown of the connection. A GOAWAY frame is sent, and the
+// connection is closed by the writer as soon as all in-flight streams are written.
+func (c *Conn) shutdown() {
+	c.mu.Lock()
+	if c.isHTTP1 {
+		// HTTP/1.1 has no GOAWAY, the connection is closed when the current request is done
+		c.draining = true
+		idle := c.idle
+		c.mu.Unlock()
+		if idle {
+			c.close()
+		}
+		return
+	}
+	if !c.ready {
+		// The connection preface is not done, there is nothing to drain
+		c.mu.Unlock()
+		c.close()
+		return
+	}
+	if c.draining {
+		c.mu.Unlock()
+		return
+	}
+	c.draining = true
+	c.goAwayStreamID = c.lastStreamID
+	c.mu.Unlock()
+
+	c.sendFrame(c.newGoAwayFrame(constants.NoError))
+}
+
+// Close cancels the connection context and closes the underlying network connection
+func (c *Conn) close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.mu.Lock()
+		if c.settingsTimer != nil {
+			c.settingsTimer.Stop()
+		}
+		c.mu.Unlock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
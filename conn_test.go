@@ -0,0 +1,171 @@
+package opal
+
+import (
+	"bufio"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameTooLarge(t *testing.T) {
+	srv := NewServer()
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/", "POST", false)
+	client.writeFrame(newTestData(1, string(make([]byte, 16385)), true))
+
+	f := client.readFrame(t, frame.GoAwayType, 0)
+	if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.FrameSizeError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.FrameSizeError, code)
+	}
+}
+
+func TestPrefaceWithoutSettings(t *testing.T) {
+	srv := NewServer()
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.conn.Write([]byte(clientPreface))
+	client.writeFrame(&frame.Frame{
+		Type:    frame.PingType,
+		Flags:   &types.PingFlags{},
+		Payload: &types.PingPayload{Data: make([]byte, 8)},
+		Length:  8,
+	})
+	client.startReading()
+
+	f := client.readFrame(t, frame.GoAwayType, 0)
+	if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.ProtocolError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+	}
+
+	// The connection is closed after a connection error
+	select {
+	case _, ok := <-client.frames:
+		if ok {
+			t.Error("Frame received after GOAWAY")
+		}
+	case <-time.After(time.Second):
+		t.Error("Connection was not closed after GOAWAY")
+	}
+}
+
+// ---------- HELPERS --------------
+
+// pipeClient is a minimal HTTP/2 client speaking to a Conn over an in-memory pipe
+type pipeClient struct {
+	conn   net.Conn
+	server *Conn // The server side of the pipe
+	br     *bufio.Reader
+	hpack  *hpack.Context
+	frames chan frame.Frame
+}
+
+func newPipeClient(srv *Server) *pipeClient {
+	clientConn, serverConn := net.Pipe()
+	c := srv.createConn(serverConn)
+	go c.serve()
+
+	return &pipeClient{
+		conn:   clientConn,
+		server: c,
+		br:     bufio.NewReader(clientConn),
+		hpack:  hpack.NewContext(4096, 4096),
+		frames: make(chan frame.Frame, 100),
+	}
+}
+
+func (pc *pipeClient) startReading() {
+	go func() {
+		defer close(pc.frames)
+		for {
+			f, err := frame.ReadFrame(pc.br)
+			if err != nil {
+				return
+			}
+			pc.frames <- f
+		}
+	}()
+}
+
+// Handshake sends the connection preface and an empty SETTINGS frame, and starts reading frames
+func (pc *pipeClient) handshake() {
+	pc.conn.Write([]byte(clientPreface))
+	pc.writeFrame(newTestSettingsFrame())
+	pc.startReading()
+}
+
+// ReadFrame waits for the next frame matching a given type and stream
+func (pc *pipeClient) readFrame(t *testing.T, frameType byte, streamID uint32) frame.Frame {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case f, ok := <-pc.frames:
+			if !ok {
+				t.Fatalf("Connection closed before frame of type %d was received", frameType)
+			}
+			if f.Type == frameType && f.ID == streamID {
+				return f
+			}
+		case <-timeout:
+			t.Fatalf("Frame of type %d on stream %d was not received", frameType, streamID)
+		}
+	}
+}
+
+// WriteHeaders sends a request without body on a new stream
+func (pc *pipeClient) writeHeaders(streamID uint32, path, method string, endStream bool) {
+	fragment := newEncodedTestHeaders(pc.hpack, path, method)
+	pc.writeFrame(&frame.Frame{
+		ID:      streamID,
+		Type:    frame.HeadersType,
+		Flags:   &types.HeadersFlags{EndHeaders: true, EndStream: endStream},
+		Payload: &types.HeadersPayload{Fragment: fragment},
+		Length:  uint32(len(fragment)),
+	})
+}
+
+func (pc *pipeClient) writeFrame(f *frame.Frame) {
+	pc.conn.Write(f.ToBytes())
+}
+
+// ReadHeaders waits for a HEADERS frame on a given stream and decodes it
+func (pc *pipeClient) readHeaders(t *testing.T, streamID uint32) []*hpack.HeaderField {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case f, ok := <-pc.frames:
+			if !ok {
+				t.Fatal("Connection closed before headers were received")
+			}
+			if f.Type != frame.HeadersType || f.ID != streamID {
+				continue
+			}
+			headers, err := pc.hpack.Decode(f.Payload.(*types.HeadersPayload).Fragment)
+			if err != nil {
+				t.Fatalf("Decoding error at stream %d", streamID)
+			}
+			return headers
+		case <-timeout:
+			t.Fatalf("Headers for stream %d were not received", streamID)
+		}
+	}
+}
+
+func newTestSettingsFrame() *frame.Frame {
+	return &frame.Frame{
+		ID:      0,
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{},
+		Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{}},
+		Length:  0,
+	}
+}
+
+func validateHeaderFields(t *testing.T, actual []*hpack.HeaderField, expected []*hpack.HeaderField) {
+	validateHeaders(t, &Stream{}, actual, expected)
+}
@@ -1,8 +1,13 @@
 package constants
 
+import "strconv"
+
+// ErrorCode is the reason a stream or connection is closed, sent in RST_STREAM and GOAWAY frames - RFC7540 Section 7
+type ErrorCode uint32
+
 const (
 	// NoError : The associated condition is not a result of an error. For example, a GOAWAY might include this code to indicate graceful shutdown of a connection.
-	NoError uint32 = iota
+	NoError ErrorCode = iota
 	// ProtocolError : The endpoint detected an unspecific protocol error. This error is for use when a more specific code is not available.
 	ProtocolError
 	// InternalError : The enpoint encountered an unexpected internal error.
@@ -32,3 +37,52 @@ const (
 )
 
 // Any other error should be treated as InternalError
+
+var errorCodeNames = map[ErrorCode]string{
+	NoError:            "NO_ERROR",
+	ProtocolError:      "PROTOCOL_ERROR",
+	InternalError:      "INTERNAL_ERROR",
+	FlowControlError:   "FLOW_CONTROL_ERROR",
+	SettingsTimeout:    "SETTINGS_TIMEOUT",
+	StreamClosed:       "STREAM_CLOSED",
+	FrameSizeError:     "FRAME_SIZE_ERROR",
+	RefusedStream:      "REFUSED_STREAM",
+	Cancel:             "CANCEL",
+	CompressionError:   "COMPRESSION_ERROR",
+	ConnectError:       "CONNECT_ERROR",
+	EnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	InadequateSecurity: "INADEQUATE_SECURITY",
+	HTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+// String returns the name of the error code, as written in RFC7540 Section 7
+func (code ErrorCode) String() string {
+	if name, ok := errorCodeNames[code]; ok {
+		return name
+	}
+	return "UNKNOWN_ERROR_0x" + strconv.FormatUint(uint64(code), 16)
+}
+
+// ConnectionError is an error that makes the connection unusable. It is sent in a GOAWAY frame,
+// and the connection is closed - RFC7540 Section 5.4.1
+type ConnectionError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	if e.Reason == "" {
+		return "connection error: " + e.Code.String()
+	}
+	return "connection error: " + e.Code.String() + ": " + e.Reason
+}
+
+// StreamError is an error that only affects a single stream. It is sent in a RST_STREAM frame - RFC7540 Section 5.4.2
+type StreamError struct {
+	StreamID uint32
+	Code     ErrorCode
+}
+
+func (e StreamError) Error() string {
+	return "stream error on stream " + strconv.FormatUint(uint64(e.StreamID), 10) + ": " + e.Code.String()
+}
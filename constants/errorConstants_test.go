@@ -87,3 +87,28 @@ func TestHTTP11Required(t *testing.T) {
 		t.Fatal("HTTP11Required has wrong error code")
 	}
 }
+
+func TestErrorCodeString(t *testing.T) {
+	for code := NoError; code <= HTTP11Required; code++ {
+		if _, ok := errorCodeNames[code]; !ok {
+			t.Errorf("Error code %d has no name", code)
+		}
+	}
+	if name := FlowControlError.String(); name != "FLOW_CONTROL_ERROR" {
+		t.Errorf("Incorrect name! Expected %s, got %s", "FLOW_CONTROL_ERROR", name)
+	}
+	if name := ErrorCode(0xff).String(); name != "UNKNOWN_ERROR_0xff" {
+		t.Errorf("Incorrect name! Expected %s, got %s", "UNKNOWN_ERROR_0xff", name)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	connErr := ConnectionError{Code: ProtocolError, Reason: "invalid stream id"}
+	if msg := connErr.Error(); msg != "connection error: PROTOCOL_ERROR: invalid stream id" {
+		t.Errorf("Incorrect message! Got %s", msg)
+	}
+	streamErr := StreamError{StreamID: 3, Code: RefusedStream}
+	if msg := streamErr.Error(); msg != "stream error on stream 3: REFUSED_STREAM" {
+		t.Errorf("Incorrect message! Got %s", msg)
+	}
+}
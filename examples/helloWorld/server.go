@@ -40,5 +40,8 @@ func main() {
 
 	srv.Register(r)
 
+	// Served requests are printed to the console
+	srv.SetAccessLogger(opal.NewColorLogger())
+
 	log.Fatal(srv.Listen(5000))
 }
@@ -0,0 +1,121 @@
+package opal
+
+import (
+	"sync"
+)
+
+/*
+	This file contains flow control, as described in RFC7540 Section 5.2 and 6.9.
+	Every DATA frame sent consumes credit from both the connection and the stream
+	window, which the peer restores by sending WINDOW_UPDATE frames.
+*/
+
+// The initial window size of both connections and streams - RFC7540 Section 6.9.2
+const initialWindowSize = 65535
+
+// The largest window size allowed - RFC7540 Section 6.9.1
+const maxWindowSize = 1<<31 - 1
+
+// sendFlow keeps track of how many bytes the peer allows the server to send
+type sendFlow struct {
+	mu      sync.Mutex
+	conn    int64            // Connection-level window
+	streams map[uint32]int64 // Stream-level windows, streams without an entry has the initial window
+	initial int64            // The peer's SETTINGS_INITIAL_WINDOW_SIZE
+
+	// Closed says if a stream is closed, in which case no window is kept for it. Nil if streams are never closed.
+	closed func(streamID uint32) bool
+}
+
+func newSendFlow() *sendFlow {
+	return &sendFlow{
+		conn:    initialWindowSize,
+		streams: make(map[uint32]int64),
+		initial: initialWindowSize,
+	}
+}
+
+// AddConn adds credit to the connection window. Returns false if the window overflows.
+func (f *sendFlow) addConn(increment uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn+int64(increment) > maxWindowSize {
+		return false
+	}
+	f.conn += int64(increment)
+	return true
+}
+
+// AddStream adds credit to a stream window. Returns false if the window overflows.
+// Credit for a closed stream is ignored, as WINDOW_UPDATE frames may arrive after a stream is closed.
+func (f *sendFlow) addStream(streamID uint32, increment uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isClosed(streamID) {
+		return true
+	}
+	window := f.window(streamID) + int64(increment)
+	if window > maxWindowSize {
+		return false
+	}
+	f.streams[streamID] = window
+	return true
+}
+
+// SetInitial changes the initial window size, and adjusts all existing stream windows
+// by the difference - RFC7540 Section 6.9.2. Returns false if any window overflows.
+func (f *sendFlow) setInitial(size uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delta := int64(size) - f.initial
+	for id, window := range f.streams {
+		if window+delta > maxWindowSize {
+			return false
+		}
+		f.streams[id] = window + delta // Windows are allowed to become negative
+	}
+	f.initial = int64(size)
+	return true
+}
+
+// Take consumes up to n bytes of credit from both the connection and the stream window.
+// Returns the number of bytes that can be sent, which is 0 if any of the windows are exhausted.
+func (f *sendFlow) take(streamID uint32, n uint32) uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isClosed(streamID) {
+		return 0 // The frame is dropped along with the stream
+	}
+	allowed := int64(n)
+	if f.conn < allowed {
+		allowed = f.conn
+	}
+	if window := f.window(streamID); window < allowed {
+		allowed = window
+	}
+	if allowed <= 0 {
+		return 0
+	}
+	f.conn -= allowed
+	f.streams[streamID] = f.window(streamID) - allowed
+	return uint32(allowed)
+}
+
+// CloseStream removes the window of a stream that is done
+func (f *sendFlow) closeStream(streamID uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.streams, streamID)
+}
+
+// IsClosed is checked under the lock, so a stream can not be closed between the check and creating its window
+func (f *sendFlow) isClosed(streamID uint32) bool {
+	return f.closed != nil && f.closed(streamID)
+}
+
+func (f *sendFlow) window(streamID uint32) int64 {
+	if window, ok := f.streams[streamID]; ok {
+		return window
+	}
+	return f.initial
+}
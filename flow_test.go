@@ -0,0 +1,177 @@
+package opal
+
+import (
+	"bytes"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+	"time"
+)
+
+func TestSendFlowTake(t *testing.T) {
+	flow := newSendFlow()
+
+	if n := flow.take(1, 70000); n != initialWindowSize {
+		t.Errorf("Incorrect credit taken. Expected %d, got %d", initialWindowSize, n)
+	}
+	if n := flow.take(3, 10); n != 0 {
+		t.Errorf("Credit was taken from an exhausted connection window. Got %d", n)
+	}
+
+	flow.addConn(100)
+	if n := flow.take(1, 10); n != 0 {
+		t.Errorf("Credit was taken from an exhausted stream window. Got %d", n)
+	}
+	if n := flow.take(3, 200); n != 100 {
+		t.Errorf("Incorrect credit taken. Expected %d, got %d", 100, n)
+	}
+}
+
+func TestSendFlowOverflow(t *testing.T) {
+	flow := newSendFlow()
+	if flow.addConn(maxWindowSize) {
+		t.Error("Connection window was allowed to overflow")
+	}
+	if flow.addStream(1, maxWindowSize) {
+		t.Error("Stream window was allowed to overflow")
+	}
+	flow.addStream(1, maxWindowSize-initialWindowSize)
+	if flow.setInitial(initialWindowSize + 1) {
+		t.Error("Stream window was allowed to overflow by SETTINGS_INITIAL_WINDOW_SIZE")
+	}
+}
+
+func TestSendFlowSetInitial(t *testing.T) {
+	flow := newSendFlow()
+	flow.take(1, 1000)
+
+	// Changing the initial window size adjusts existing windows, which may become negative
+	flow.setInitial(500)
+	flow.addConn(10000)
+	if n := flow.take(1, 10); n != 0 {
+		t.Errorf("Credit was taken from a negative stream window. Got %d", n)
+	}
+	if n := flow.take(3, 1000); n != 500 {
+		t.Errorf("New stream did not get the new initial window. Expected %d, got %d", 500, n)
+	}
+}
+
+func TestSendFlowClosedStream(t *testing.T) {
+	flow := newSendFlow()
+	closed := map[uint32]bool{}
+	flow.closed = func(streamID uint32) bool { return closed[streamID] }
+	flow.take(1, 100)
+	closed[1] = true
+	flow.closeStream(1)
+
+	// WINDOW_UPDATE frames arriving after the stream is closed do not bring back its window
+	if !flow.addStream(1, 100) {
+		t.Error("Credit for a closed stream was treated as an overflow")
+	}
+	if n := flow.take(1, 10); n != 0 {
+		t.Errorf("Credit was taken for a closed stream. Got %d", n)
+	}
+	if len(flow.streams) != 0 {
+		t.Errorf("Window was kept for a closed stream. Expected %d windows, got %d", 0, len(flow.streams))
+	}
+}
+
+func TestNegativeReceiveWindow(t *testing.T) {
+	conn := newTestConn()
+	conn.SetStream(&Stream{id: 1, state: Open, recvWindow: -10, contentLength: -1})
+	conn.cancel() // The credit of the rejected frame is returned, which is not written without a writer
+
+	// A window made negative by a smaller SETTINGS_INITIAL_WINDOW_SIZE has no credit left - RFC7540 Section 6.9.2
+	err := conn.processFrame(newTestData(1, "a", false))
+	expected := constants.StreamError{StreamID: 1, Code: constants.FlowControlError}
+	if err != expected {
+		t.Errorf("Incorrect error! Expected %v, got %v", expected, err)
+	}
+}
+
+func TestWriteBlocksOnFlowControl(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), initialWindowSize+1000)
+	r := router.NewRouter("/")
+	r.Get("/large", func(req *http.Request, res *http.Response) {
+		res.Body = body
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/large", "GET", true)
+
+	// The server may only send as much as the initial window allows
+	received := 0
+	for received < initialWindowSize {
+		f := client.readFrame(t, frame.DataType, 1)
+		received += int(f.Length)
+	}
+	if received != initialWindowSize {
+		t.Fatalf("Server exceeded the send window. Expected %d bytes, got %d", initialWindowSize, received)
+	}
+	select {
+	case f := <-client.frames:
+		if f.Type == frame.DataType {
+			t.Fatal("Server sent data without flow-control credit")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Give credit for the rest of the body
+	client.writeFrame(newTestWindowUpdate(0, 1000))
+	client.writeFrame(newTestWindowUpdate(1, 1000))
+	rest := 0
+	for {
+		f := client.readFrame(t, frame.DataType, 1)
+		rest += int(f.Length)
+		if f.Flags.(*types.DataFlags).EndStream {
+			break
+		}
+	}
+	if rest != 1000 {
+		t.Errorf("Incorrect size of the rest of the body. Expected %d, got %d", 1000, rest)
+	}
+}
+
+func TestReceiveReturnsCredit(t *testing.T) {
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/test", "POST", false)
+
+	client.writeFrame(&frame.Frame{
+		ID:      1,
+		Type:    frame.DataType,
+		Flags:   &types.DataFlags{},
+		Payload: &types.DataPayload{Data: []byte("TE")},
+		Length:  2,
+	})
+
+	// Both the connection and the stream window should be restored
+	for _, streamID := range []uint32{0, 1} {
+		f := client.readFrame(t, frame.WindowUpdateType, streamID)
+		if increment := f.Payload.(*types.WindowUpdatePayload).WindowSizeIncrement; increment != 2 {
+			t.Errorf("Incorrect window increment on stream %d. Expected %d, got %d", streamID, 2, increment)
+		}
+	}
+}
+
+// ---------- HELPERS --------------
+
+func newTestWindowUpdate(streamID, increment uint32) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.WindowUpdateType,
+		Flags:   &types.WindowUpdateFlags{},
+		Payload: &types.WindowUpdatePayload{WindowSizeIncrement: increment},
+		Length:  4,
+	}
+}
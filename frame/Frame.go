@@ -3,8 +3,10 @@ package frame
 import (
 	"encoding/binary"
 	// "fmt"
+	"github.com/SveinungOverland/opal/constants"
 	"github.com/SveinungOverland/opal/frame/types"
 	"io"
+	"io/ioutil"
 )
 
 // Create an enum for known types
@@ -43,86 +45,126 @@ type Frame struct {
 	Payload types.IPayload
 }
 
-// ReadFrame takes a reader and returns a frame with type
+// MaxFrameSizeLimit is the largest frame payload that can be advertised with SETTINGS_MAX_FRAME_SIZE
+const MaxFrameSizeLimit = 1<<24 - 1
+
+// defaultMaxFrameSize is the max frame size until another one is advertised - RFC7540 Section 6.5.2
+const defaultMaxFrameSize = 16384
+
+// Reader reads frames from a connection
+type Reader struct {
+	r            io.Reader
+	header       [9]byte
+	MaxFrameSize uint32 // Frames with a larger payload are rejected with a FRAME_SIZE_ERROR
+}
+
+// NewReader creates a frame reader, accepting frames up to the default max frame size of 16384
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, MaxFrameSize: defaultMaxFrameSize}
+}
+
+// ReadFrame takes a reader and returns a frame with type. Frames of any size are accepted.
 func ReadFrame(r io.Reader) (Frame, error) {
-	// fmt.Println("Reading frame")
+	return (&Reader{r: r, MaxFrameSize: MaxFrameSizeLimit}).ReadFrame()
+}
+
+// ReadFrame reads the next frame. Frames of unknown types are returned without flags and payload, and should be ignored - RFC7540 Section 4.1.
+// Invalid frames are returned along with a constants.ConnectionError or constants.StreamError, and the next frame
+// can still be read. Any other error comes from the underlying reader.
+func (fr *Reader) ReadFrame() (Frame, error) {
 	frame := Frame{}
 
-	lengthBuffer := make([]byte, 3)
-	if _, err := r.Read(lengthBuffer); err != nil {
+	// Partial reads are retried, as frames may be split across TLS records and TCP segments
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
 		return frame, err
 	}
-	length := binary.BigEndian.Uint32(append([]byte{0}, lengthBuffer...))
-	// fmt.Println("Read frame length equal to", length)
+	length := uint32(fr.header[0])<<16 | uint32(fr.header[1])<<8 | uint32(fr.header[2])
 	frame.Length = length
+	frame.Type = fr.header[3]
+	frame.ID = binary.BigEndian.Uint32(fr.header[5:]) & 0x7FFFFFFF // Bitwise 'and' is used to remove the very first bit, as this is a reserved bit
+	flags := fr.header[4]
 
-	typeFlagBuffer := make([]byte, 2)
-	r.Read(typeFlagBuffer)
-
-	identifierBuffer := make([]byte, 4)
-	r.Read(identifierBuffer)
-	identifier := binary.BigEndian.Uint32(identifierBuffer) & 0x7FFFFFFF // Bitwise 'and' is used to remove the very first bit, as this is a reserved bit
-	frame.ID = identifier
+	// The payload of a frame that is too large is not buffered, only skipped
+	if length > fr.MaxFrameSize {
+		return frame, fr.discard(length, constants.ConnectionError{Code: constants.FrameSizeError, Reason: "frame is larger than the max frame size"})
+	}
+	if frame.Type > ContinuationType {
+		return frame, fr.discard(length, nil) // Unknown types are not parsed
+	}
 
 	payloadBuffer := make([]byte, length)
-	r.Read(payloadBuffer)
+	if _, err := io.ReadFull(fr.r, payloadBuffer); err != nil {
+		return frame, err
+	}
 
 	// Handle frame payload dependent on frame type
-	switch frameType := typeFlagBuffer[0]; frameType {
+	var err error
+	switch frame.Type {
 	case DataType: // Frame is of type Data  |  Carries request or response data
-		data := types.CreateData(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = DataType
+		var data *types.Data
+		data, err = types.CreateData(flags, payloadBuffer, length)
 		frame.Flags = &data.Flags
 		frame.Payload = &data.Payload
 	case HeadersType: // Frame is of type Headers  |  Carries request/response headers/trailers; can initiate a stream
-		headers := types.CreateHeaders(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = HeadersType
+		var headers *types.Headers
+		headers, err = types.CreateHeaders(flags, payloadBuffer, length)
 		frame.Flags = &headers.Flags
 		frame.Payload = &headers.Payload
 	case PriorityType: // Frame is of type Priority  |  Indicates priority of a stream
-		priority := types.CreatePriority(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = PriorityType
+		var priority *types.Priority
+		priority, err = types.CreatePriority(flags, payloadBuffer, length)
 		frame.Flags = &priority.Flags
 		frame.Payload = &priority.Payload
 	case RstStreamType: // Frame is of type RstStream  |  Terminates a stream
-		rstStream := types.CreateRstStream(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = RstStreamType
+		var rstStream *types.RstStream
+		rstStream, err = types.CreateRstStream(flags, payloadBuffer, length)
 		frame.Flags = &rstStream.Flags
 		frame.Payload = &rstStream.Payload
 	case SettingsType: // Frame is of type Settings  |  Defines parameters for the connection only
-		settings := types.CreateSettings(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = SettingsType
-		// fmt.Printf("%+v\n", settings.Flags)
+		var settings *types.Settings
+		settings, err = types.CreateSettings(flags, payloadBuffer, length)
 		frame.Flags = &settings.Flags
 		frame.Payload = &settings.Payload
 	case PushPromiseType: // Frame is of type PushPromise  |  Signals peer for server push
-		pushPromise := types.CreatePushPromise(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = PushPromiseType
+		var pushPromise *types.PushPromise
+		pushPromise, err = types.CreatePushPromise(flags, payloadBuffer, length)
 		frame.Flags = &pushPromise.Flags
 		frame.Payload = &pushPromise.Payload
 	case PingType: // Frame is of type Ping  |  Maintenance frame for checking RTT, connection, etc
-		ping := types.CreatePing(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = PingType
+		var ping *types.Ping
+		ping, err = types.CreatePing(flags, payloadBuffer, length)
 		frame.Flags = &ping.Flags
 		frame.Payload = &ping.Payload
 	case GoAwayType: // Frame is of type GoAway  |  For shutting down a connection
-		goAway := types.CreateGoAway(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = GoAwayType
+		var goAway *types.GoAway
+		goAway, err = types.CreateGoAway(flags, payloadBuffer, length)
 		frame.Flags = &goAway.Flags
 		frame.Payload = &goAway.Payload
 	case WindowUpdateType: // Frame is of type WindowUpdate  |  Frame responsible for flow control adjustments
-		windowUpdate := types.CreateWindowUpdate(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = WindowUpdateType
+		var windowUpdate *types.WindowUpdate
+		windowUpdate, err = types.CreateWindowUpdate(flags, payloadBuffer, length)
 		frame.Flags = &windowUpdate.Flags
 		frame.Payload = &windowUpdate.Payload
 	case ContinuationType: // Frame is of type Continuation  |  Extends a HEADERS frame and can carry more headers
-		continuation := types.CreateContinuation(typeFlagBuffer[1], payloadBuffer, length)
-		frame.Type = ContinuationType
+		var continuation *types.Continuation
+		continuation, err = types.CreateContinuation(flags, payloadBuffer, length)
 		frame.Flags = &continuation.Flags
 		frame.Payload = &continuation.Payload
 	}
+	if connErr, ok := err.(constants.ConnectionError); ok && frame.Type == PriorityType && frame.ID != 0 {
+		// A PRIORITY frame of the wrong size only affects its stream - RFC7540 Section 6.3
+		err = constants.StreamError{StreamID: frame.ID, Code: connErr.Code}
+	}
+
+	return frame, err
+}
 
-	return frame, nil
+// Discard skips the payload of a frame that is not read, and returns err if it succeeds
+func (fr *Reader) discard(length uint32, err error) error {
+	if _, discardErr := io.CopyN(ioutil.Discard, fr.r, int64(length)); discardErr != nil {
+		return discardErr
+	}
+	return err
 }
 
 // ToBytes turnes a frame into sendable bytes
@@ -145,7 +187,7 @@ func (f *Frame) ToBytes() []byte {
 }
 
 // NewErrorFrame is a helper function for easily creating RstStream frames that occur on various errors
-func NewErrorFrame(streamID, errorCode uint32) *Frame {
+func NewErrorFrame(streamID uint32, errorCode constants.ErrorCode) *Frame {
 	return &Frame{
 		ID:    streamID,
 		Type:  RstStreamType,
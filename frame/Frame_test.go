@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"github.com/SveinungOverland/opal/constants"
 	"github.com/SveinungOverland/opal/frame/types"
+	"io"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 var testFrame = &Frame{
@@ -49,6 +51,47 @@ func TestFrameRead(t *testing.T) {
 	}
 }
 
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []*Frame{
+		&Frame{
+			ID:      1,
+			Type:    PushPromiseType,
+			Flags:   &types.PushPromiseFlags{EndHeaders: true},
+			Payload: &types.PushPromisePayload{StreamID: 2, Fragment: []byte{0x82}},
+			Length:  5,
+		},
+		&Frame{
+			Type:    GoAwayType,
+			Flags:   &types.GoAwayFlags{},
+			Payload: &types.GoAwayPayload{LastStreamID: 0x10001, ErrorCode: constants.ProtocolError, DebugData: []byte{}},
+			Length:  8,
+		},
+		&Frame{
+			ID:      3,
+			Type:    PriorityType,
+			Flags:   &types.PriorityFlags{},
+			Payload: &types.PriorityPayload{StreamExclusive: true, StreamDependency: 1, PriorityWeight: 15},
+			Length:  5,
+		},
+		&Frame{
+			ID:      3,
+			Type:    HeadersType,
+			Flags:   &types.HeadersFlags{EndHeaders: true, Priority: true},
+			Payload: &types.HeadersPayload{StreamExclusive: true, StreamDependency: 1, PriorityWeight: 15, Fragment: []byte{0x82}},
+			Length:  6,
+		},
+	}
+	for _, f := range frames {
+		read, err := ReadFrame(bytes.NewReader(f.ToBytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read.Flags, f.Flags) || !reflect.DeepEqual(read.Payload, f.Payload) {
+			t.Errorf("Frame of type %d was not read correctly. Expected %+v, got %+v", f.Type, f.Payload, read.Payload)
+		}
+	}
+}
+
 func TestNewErrorFrame(t *testing.T) {
 	testErrorBytes := []byte{0, 0, 4, 3, 0, 0, 0, 0, 0, 0, 0, 0, 11}
 
@@ -58,3 +101,47 @@ func TestNewErrorFrame(t *testing.T) {
 		t.Error("Bytes did not match")
 	}
 }
+
+func TestFrameReadShortReads(t *testing.T) {
+	frame, err := ReadFrame(iotest.OneByteReader(bytes.NewReader(testBytes)))
+	if err != nil {
+		t.Error("ReadFrame could not read frame split into single bytes")
+	}
+	if frame.Type != PingType || frame.Length != 8 || len(frame.Payload.(*types.PingPayload).Data) != 8 {
+		t.Error("Frame split into single bytes was not read correctly")
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tooLarge := append([]byte{0, 0, 9, 0, 0, 0, 0, 0, 1}, make([]byte, 9)...)
+	invalidLength := []byte{0, 0, 1, 6, 0, 0, 0, 0, 0, 0}
+	invalidPriority := []byte{0, 0, 1, 2, 0, 0, 0, 0, 3, 0}
+	unknownType := []byte{0, 0, 2, 0xff, 0, 0, 0, 0, 0, 0, 0}
+	input := append(append(append(append(tooLarge, invalidLength...), invalidPriority...), unknownType...), testBytes...)
+
+	fr := NewReader(bytes.NewReader(input))
+	fr.MaxFrameSize = 8
+
+	frameSizeErr := constants.ConnectionError{Code: constants.FrameSizeError, Reason: "frame is larger than the max frame size"}
+	if f, err := fr.ReadFrame(); err != frameSizeErr || f.Type != DataType || f.ID != 1 {
+		t.Errorf("Expected %v for DATA frame on stream 1, got %v for type %d on stream %d", frameSizeErr, err, f.Type, f.ID)
+	}
+	if f, err := fr.ReadFrame(); f.Type != PingType {
+		t.Errorf("Expected PING frame, got type %d", f.Type)
+	} else if connErr, ok := err.(constants.ConnectionError); !ok || connErr.Code != constants.FrameSizeError {
+		t.Errorf("Expected connection error %v for PING frame, got %v", constants.FrameSizeError, err)
+	}
+	streamErr := constants.StreamError{StreamID: 3, Code: constants.FrameSizeError}
+	if _, err := fr.ReadFrame(); err != streamErr {
+		t.Errorf("Expected %v for PRIORITY frame, got %v", streamErr, err)
+	}
+	if f, err := fr.ReadFrame(); err != nil || f.Type != 0xff || f.Payload != nil {
+		t.Errorf("Unknown frame type was not skipped. Got error %v and type %d", err, f.Type)
+	}
+	if f, err := fr.ReadFrame(); err != nil || f.Type != PingType {
+		t.Errorf("Frame after invalid frames was not read. Got error %v and type %d", err, f.Type)
+	}
+	if _, err := fr.ReadFrame(); err != io.EOF {
+		t.Errorf("Expected %v, got %v", io.EOF, err)
+	}
+}
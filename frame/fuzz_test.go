@@ -0,0 +1,73 @@
+//go:build go1.18
+// +build go1.18
+
+package frame
+
+import (
+	"bytes"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame/types"
+	"testing"
+)
+
+/*
+	This file contains a fuzz target for reading frames. Any sequence of
+	bytes from a peer must be read as frames or rejected with an error.
+*/
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(testBytes)
+	f.Add(NewErrorFrame(1, constants.Cancel).ToBytes())
+	seeds := []*Frame{
+		&Frame{
+			ID:      1,
+			Type:    DataType,
+			Flags:   &types.DataFlags{EndStream: true},
+			Payload: &types.DataPayload{Data: []byte("data")},
+			Length:  4,
+		},
+		&Frame{
+			Type:    SettingsType,
+			Flags:   &types.SettingsFlags{},
+			Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{3: 100, 4: 65535}},
+			Length:  12,
+		},
+		&Frame{
+			ID:      1,
+			Type:    WindowUpdateType,
+			Flags:   &types.WindowUpdateFlags{},
+			Payload: &types.WindowUpdatePayload{WindowSizeIncrement: 1000},
+			Length:  4,
+		},
+		&Frame{
+			ID:      1,
+			Type:    ContinuationType,
+			Flags:   &types.ContinuationFlags{EndHeaders: true},
+			Payload: &types.ContinuationPayload{HeaderFragment: []byte{0x82, 0x86}},
+			Length:  2,
+		},
+	}
+	for _, frame := range seeds {
+		f.Add(frame.ToBytes())
+	}
+	f.Add([]byte{0, 0, 4, 0, 0x8, 0, 0, 0, 1, 2, 'd', 0, 0}) // Padded DATA frame
+	f.Add([]byte{0, 0, 2, 0xff, 0, 0, 0, 0, 0, 0, 0})        // Unknown type
+	f.Add([]byte{0, 0, 1, 2, 0, 0, 0, 0, 3, 0})              // PRIORITY frame of the wrong size
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fr := NewReader(bytes.NewReader(data))
+		for {
+			frame, err := fr.ReadFrame()
+			switch err.(type) {
+			case nil:
+			case constants.ConnectionError, constants.StreamError:
+				continue
+			default:
+				return // The input is used up
+			}
+			if frame.Payload != nil {
+				frame.ToBytes()
+			}
+		}
+	})
+}
@@ -22,8 +22,9 @@ type ContinuationPayload struct {
 	HeaderFragment []byte
 }
 
-func (c *ContinuationPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
+func (c *ContinuationPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
 	c.HeaderFragment = payload
+	return nil
 }
 
 func (c ContinuationPayload) Bytes(flags IFlags) []byte {
@@ -35,10 +36,10 @@ type Continuation struct {
 	Payload ContinuationPayload
 }
 
-func CreateContinuation(flags byte, payload []byte, payloadLength uint32) *Continuation {
+func CreateContinuation(flags byte, payload []byte, payloadLength uint32) (*Continuation, error) {
 	continuation := &Continuation{}
 	continuation.Flags.ReadFlags(flags)
-	continuation.Payload.ReadPayload(payload, payloadLength, &continuation.Flags)
+	err := continuation.Payload.ReadPayload(payload, payloadLength, &continuation.Flags)
 
-	return continuation
+	return continuation, err
 }
@@ -24,12 +24,19 @@ type DataPayload struct {
 	Data []byte
 }
 
-func (d *DataPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
+func (d *DataPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
 	if flags.(*DataFlags).Padded {
+		if length < 1 {
+			return sizeError("DATA frame has no Pad Length")
+		}
+		if uint32(payload[0]) >= length {
+			return paddingError("DATA frame padding is too long")
+		}
 		d.Data = payload[:length-uint32(payload[0])][1:]
-		return
+		return nil
 	}
 	d.Data = payload
+	return nil
 }
 
 func (d DataPayload) Bytes(flags IFlags) []byte {
@@ -41,10 +48,10 @@ type Data struct {
 	Payload DataPayload
 }
 
-func CreateData(flags byte, payload []byte, payloadLength uint32) *Data {
+func CreateData(flags byte, payload []byte, payloadLength uint32) (*Data, error) {
 	data := &Data{}
 	data.Flags.ReadFlags(flags)
-	data.Payload.ReadPayload(payload, payloadLength, &data.Flags)
+	err := data.Payload.ReadPayload(payload, payloadLength, &data.Flags)
 
-	return data
+	return data, err
 }
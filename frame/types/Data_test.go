@@ -2,6 +2,7 @@ package types
 
 import (
 	"bytes"
+	"github.com/SveinungOverland/opal/constants"
 	"reflect"
 	"testing"
 )
@@ -48,7 +49,10 @@ func TestDataReadPayload(t *testing.T) {
 }
 
 func TestCreateData(t *testing.T) {
-	data := CreateData(testFlagsByte, testPayloadBytes, uint32(len(testPayloadBytes)))
+	data, err := CreateData(testFlagsByte, testPayloadBytes, uint32(len(testPayloadBytes)))
+	if err != nil {
+		t.Errorf("CreateData returned an error: %v", err)
+	}
 	if !reflect.DeepEqual(data.Flags, testFlagsStruct) {
 		t.Error("CreateData did not return flags correctly")
 	}
@@ -56,3 +60,15 @@ func TestCreateData(t *testing.T) {
 		t.Error("CreateData did not return payload correctly")
 	}
 }
+
+func TestDataInvalidPadding(t *testing.T) {
+	payload := DataPayload{}
+	err := payload.ReadPayload([]byte{3, 'a', 'b'}, 3, &DataFlags{Padded: true})
+	if connErr, ok := err.(constants.ConnectionError); !ok || connErr.Code != constants.ProtocolError {
+		t.Errorf("Padding longer than the payload was not rejected. Got %v", err)
+	}
+	err = payload.ReadPayload([]byte{}, 0, &DataFlags{Padded: true})
+	if connErr, ok := err.(constants.ConnectionError); !ok || connErr.Code != constants.FrameSizeError {
+		t.Errorf("Padded payload without Pad Length was not rejected. Got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/binary"
+	"github.com/SveinungOverland/opal/constants"
 )
 
 type GoAwayFlags struct{}
@@ -14,20 +15,24 @@ func (g GoAwayFlags) Byte() (flags byte) {
 
 type GoAwayPayload struct {
 	LastStreamID uint32
-	ErrorCode    uint32
+	ErrorCode    constants.ErrorCode
 	DebugData    []byte
 }
 
-func (g *GoAwayPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
-	g.LastStreamID = binary.BigEndian.Uint32(payload[0:4]) & 0x8000
-	g.ErrorCode = binary.BigEndian.Uint32(payload[4:8])
+func (g *GoAwayPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
+	if length < 8 {
+		return sizeError("GOAWAY frame is too short")
+	}
+	g.LastStreamID = binary.BigEndian.Uint32(payload[0:4]) & 0x7FFFFFFF // To remove the reserved bit
+	g.ErrorCode = constants.ErrorCode(binary.BigEndian.Uint32(payload[4:8]))
 	g.DebugData = payload[8:]
+	return nil
 }
 
 func (g GoAwayPayload) Bytes(flags IFlags) []byte {
 	buffer := make([]byte, 8+len(g.DebugData))
 	binary.BigEndian.PutUint32(buffer[:4], g.LastStreamID)
-	binary.BigEndian.PutUint32(buffer[4:8], g.ErrorCode)
+	binary.BigEndian.PutUint32(buffer[4:8], uint32(g.ErrorCode))
 	copy(buffer[8:], g.DebugData)
 	return buffer
 }
@@ -37,10 +42,10 @@ type GoAway struct {
 	Payload GoAwayPayload
 }
 
-func CreateGoAway(flags byte, payload []byte, payloadLength uint32) *GoAway {
+func CreateGoAway(flags byte, payload []byte, payloadLength uint32) (*GoAway, error) {
 	goAway := &GoAway{}
 	goAway.Flags.ReadFlags(flags)
-	goAway.Payload.ReadPayload(payload, payloadLength, goAway.Flags)
+	err := goAway.Payload.ReadPayload(payload, payloadLength, goAway.Flags)
 
-	return goAway
+	return goAway, err
 }
@@ -42,19 +42,29 @@ type HeadersPayload struct {
 	PadLength        byte
 }
 
-func (h *HeadersPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
+func (h *HeadersPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
 	index := 0
 	if flags.(*HeadersFlags).Padded {
+		if length < 1 {
+			return sizeError("HEADERS frame has no Pad Length")
+		}
 		h.PadLength = payload[0]
 		index = 1
 	}
 	if flags.(*HeadersFlags).Priority {
+		if length < uint32(index)+5 {
+			return sizeError("HEADERS frame is too short for its priority")
+		}
 		h.StreamDependency = binary.BigEndian.Uint32(payload[index:][:4]) & 0x7FFFFFFF
 		h.StreamExclusive = payload[index]&0x80 != 0x00
 		h.PriorityWeight = payload[index+4]
 		index += 5
 	}
+	if uint32(h.PadLength) > length-uint32(index) {
+		return paddingError("HEADERS frame padding is too long")
+	}
 	h.Fragment = payload[:length-uint32(h.PadLength)][index:]
+	return nil
 }
 
 func (h HeadersPayload) Bytes(flags IFlags) []byte {
@@ -67,7 +77,7 @@ func (h HeadersPayload) Bytes(flags IFlags) []byte {
 		binary.BigEndian.PutUint32(priBuffer[:4], h.StreamDependency)
 		priBuffer[4] = h.PriorityWeight
 		if h.StreamExclusive {
-			priBuffer[0] |= 0x8
+			priBuffer[0] |= 0x80
 		}
 		buffer = append(priBuffer, buffer...)
 	}
@@ -84,10 +94,10 @@ type Headers struct {
 	Payload HeadersPayload
 }
 
-func CreateHeaders(flags byte, payload []byte, payloadLength uint32) *Headers {
+func CreateHeaders(flags byte, payload []byte, payloadLength uint32) (*Headers, error) {
 	headers := &Headers{}
 	headers.Flags.ReadFlags(flags)
-	headers.Payload.ReadPayload(payload, payloadLength, &headers.Flags)
+	err := headers.Payload.ReadPayload(payload, payloadLength, &headers.Flags)
 
-	return headers
+	return headers, err
 }
@@ -1,5 +1,7 @@
 package types
 
+import "github.com/SveinungOverland/opal/constants"
+
 // IFlags is an interface implemented by the different frame types so that the generic Frame struct can handle all the different frame types
 type IFlags interface {
 	ReadFlags(byte)
@@ -8,6 +10,16 @@ type IFlags interface {
 
 // IPayload is an interface implemented by the different frame types so that the generic Frame struct can handle all the different payload types
 type IPayload interface {
-	ReadPayload(payload []byte, length uint32, flags IFlags)
+	ReadPayload(payload []byte, length uint32, flags IFlags) error
 	Bytes(flags IFlags) []byte
 }
+
+// SizeError is returned when a payload is too short or too long for its frame type - RFC7540 Section 4.2
+func sizeError(reason string) error {
+	return constants.ConnectionError{Code: constants.FrameSizeError, Reason: reason}
+}
+
+// PaddingError is returned when the padding is longer than the rest of the payload - RFC7540 Section 6.1
+func paddingError(reason string) error {
+	return constants.ConnectionError{Code: constants.ProtocolError, Reason: reason}
+}
@@ -19,8 +19,12 @@ type PingPayload struct {
 	Data []byte
 }
 
-func (p *PingPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
+func (p *PingPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
+	if length != 8 {
+		return sizeError("PING frame must be 8 octets")
+	}
 	p.Data = payload
+	return nil
 }
 
 func (p PingPayload) Bytes(flags IFlags) []byte {
@@ -32,10 +36,10 @@ type Ping struct {
 	Payload PingPayload
 }
 
-func CreatePing(flags byte, payload []byte, payloadLength uint32) *Ping {
+func CreatePing(flags byte, payload []byte, payloadLength uint32) (*Ping, error) {
 	ping := &Ping{}
 	ping.Flags.ReadFlags(flags)
-	ping.Payload.ReadPayload(payload, payloadLength, &ping.Flags)
+	err := ping.Payload.ReadPayload(payload, payloadLength, &ping.Flags)
 
-	return ping
+	return ping, err
 }
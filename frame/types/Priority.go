@@ -18,19 +18,22 @@ type PriorityPayload struct {
 	PriorityWeight   byte
 }
 
-func (p *PriorityPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
-
+func (p *PriorityPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
+	if length != 5 {
+		return sizeError("PRIORITY frame must be 5 octets")
+	}
 	p.StreamExclusive = (payload[0] & 0x80) != 0x00
 	p.StreamDependency = binary.BigEndian.Uint32(payload[:4]) & 0x7FFFFFFF
 
 	p.PriorityWeight = payload[4]
+	return nil
 }
 
 func (p PriorityPayload) Bytes(flags IFlags) []byte {
 	buffer := make([]byte, 5)
 	binary.BigEndian.PutUint32(buffer[:4], p.StreamDependency)
 	if p.StreamExclusive {
-		buffer[0] |= 0x8
+		buffer[0] |= 0x80
 	}
 	buffer[4] = p.PriorityWeight
 
@@ -42,10 +45,10 @@ type Priority struct {
 	Payload PriorityPayload
 }
 
-func CreatePriority(flags byte, payload []byte, payloadLength uint32) *Priority {
+func CreatePriority(flags byte, payload []byte, payloadLength uint32) (*Priority, error) {
 	priority := &Priority{}
 	priority.Flags.ReadFlags(flags)
-	priority.Payload.ReadPayload(payload, payloadLength, priority.Flags)
+	err := priority.Payload.ReadPayload(payload, payloadLength, priority.Flags)
 
-	return priority
+	return priority, err
 }
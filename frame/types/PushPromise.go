@@ -9,7 +9,7 @@ type PushPromiseFlags struct {
 	Padded     bool
 }
 
-func (p PushPromiseFlags) ReadFlags(flags byte) {
+func (p *PushPromiseFlags) ReadFlags(flags byte) {
 	p.EndHeaders = (flags & 0x4) != 0x0
 	p.Padded = (flags & 0x8) != 0x0
 }
@@ -30,14 +30,24 @@ type PushPromisePayload struct {
 	PadLength byte
 }
 
-func (p PushPromisePayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
+func (p *PushPromisePayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
 	index := 0
 	if flags.(*PushPromiseFlags).Padded {
+		if length < 1 {
+			return sizeError("PUSH_PROMISE frame has no Pad Length")
+		}
 		p.PadLength = payload[0]
 		index = 1
 	}
+	if length < uint32(index)+4 {
+		return sizeError("PUSH_PROMISE frame is too short for its stream id")
+	}
+	if uint32(p.PadLength) > length-uint32(index)-4 {
+		return paddingError("PUSH_PROMISE frame padding is too long")
+	}
 	p.StreamID = binary.BigEndian.Uint32(payload[index:][:4]) & 0x7FFFFFFF // To remove the reserved bit
 	p.Fragment = payload[:length-uint32(p.PadLength)][index+4:]
+	return nil
 }
 
 func (p PushPromisePayload) Bytes(flags IFlags) []byte {
@@ -55,10 +65,10 @@ type PushPromise struct {
 	Payload PushPromisePayload
 }
 
-func CreatePushPromise(flags byte, payload []byte, payloadLength uint32) *PushPromise {
+func CreatePushPromise(flags byte, payload []byte, payloadLength uint32) (*PushPromise, error) {
 	push := &PushPromise{}
 	push.Flags.ReadFlags(flags)
-	push.Payload.ReadPayload(payload, payloadLength, &push.Flags)
+	err := push.Payload.ReadPayload(payload, payloadLength, &push.Flags)
 
-	return push
+	return push, err
 }
@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/binary"
+	"github.com/SveinungOverland/opal/constants"
 )
 
 type RstStreamFlags struct{}
@@ -13,16 +14,20 @@ func (r RstStreamFlags) Byte() (flags byte) {
 }
 
 type RstStreamPayload struct {
-	ErrorCode uint32
+	ErrorCode constants.ErrorCode
 }
 
-func (rst *RstStreamPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
-	rst.ErrorCode = binary.BigEndian.Uint32(payload[:4])
+func (rst *RstStreamPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
+	if length != 4 {
+		return sizeError("RST_STREAM frame must be 4 octets")
+	}
+	rst.ErrorCode = constants.ErrorCode(binary.BigEndian.Uint32(payload[:4]))
+	return nil
 }
 
 func (rst RstStreamPayload) Bytes(flags IFlags) []byte {
 	buffer := make([]byte, 4)
-	binary.BigEndian.PutUint32(buffer, rst.ErrorCode)
+	binary.BigEndian.PutUint32(buffer, uint32(rst.ErrorCode))
 	return buffer
 }
 
@@ -31,10 +36,10 @@ type RstStream struct {
 	Payload RstStreamPayload
 }
 
-func CreateRstStream(flags byte, payload []byte, payloadLength uint32) *RstStream {
+func CreateRstStream(flags byte, payload []byte, payloadLength uint32) (*RstStream, error) {
 	rstStream := &RstStream{}
 	rstStream.Flags.ReadFlags(flags)
-	rstStream.Payload.ReadPayload(payload, payloadLength, rstStream.Flags)
+	err := rstStream.Payload.ReadPayload(payload, payloadLength, rstStream.Flags)
 
-	return rstStream
+	return rstStream, err
 }
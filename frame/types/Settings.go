@@ -2,7 +2,6 @@ package types
 
 import (
 	"encoding/binary"
-	"fmt"
 )
 
 type SettingsFlags struct {
@@ -24,13 +23,18 @@ type SettingsPayload struct {
 	IDValuePair map[uint16]uint32
 }
 
-func (s *SettingsPayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
+func (s *SettingsPayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
+	if flags.(*SettingsFlags).Ack && length != 0 {
+		return sizeError("SETTINGS frame with ACK must be empty")
+	}
+	if length%6 != 0 {
+		return sizeError("SETTINGS frame must be a multiple of 6 octets")
+	}
 	s.IDValuePair = make(map[uint16]uint32)
-	fmt.Println(length / 6)
 	for i := uint32(0); i < length/6; i++ {
 		s.IDValuePair[binary.BigEndian.Uint16(payload[i*6:][:2])] = binary.BigEndian.Uint32(payload[i*6+2:][:4])
 	}
-	fmt.Printf("%+v\n", s.IDValuePair)
+	return nil
 }
 
 func (s SettingsPayload) Bytes(flags IFlags) []byte {
@@ -50,10 +54,10 @@ type Settings struct {
 	Payload SettingsPayload
 }
 
-func CreateSettings(flags byte, payload []byte, payloadLength uint32) *Settings {
+func CreateSettings(flags byte, payload []byte, payloadLength uint32) (*Settings, error) {
 	settings := &Settings{}
 	settings.Flags.ReadFlags(flags)
-	settings.Payload.ReadPayload(payload, payloadLength, &settings.Flags)
+	err := settings.Payload.ReadPayload(payload, payloadLength, &settings.Flags)
 
-	return settings
+	return settings, err
 }
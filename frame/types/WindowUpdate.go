@@ -16,8 +16,12 @@ type WindowUpdatePayload struct {
 	WindowSizeIncrement uint32
 }
 
-func (w *WindowUpdatePayload) ReadPayload(payload []byte, length uint32, flags IFlags) {
+func (w *WindowUpdatePayload) ReadPayload(payload []byte, length uint32, flags IFlags) error {
+	if length != 4 {
+		return sizeError("WINDOW_UPDATE frame must be 4 octets")
+	}
 	w.WindowSizeIncrement = binary.BigEndian.Uint32(payload[:4]) & 0x7FFFFFFF
+	return nil
 }
 
 func (w WindowUpdatePayload) Bytes(flags IFlags) []byte {
@@ -31,10 +35,10 @@ type WindowUpdate struct {
 	Payload WindowUpdatePayload
 }
 
-func CreateWindowUpdate(flags byte, payload []byte, payloadLength uint32) *WindowUpdate {
+func CreateWindowUpdate(flags byte, payload []byte, payloadLength uint32) (*WindowUpdate, error) {
 	window := &WindowUpdate{}
 	window.Flags.ReadFlags(flags)
-	window.Payload.ReadPayload(payload, payloadLength, window.Flags)
+	err := window.Payload.ReadPayload(payload, payloadLength, window.Flags)
 
-	return window
+	return window, err
 }
@@ -0,0 +1,123 @@
+//go:build go1.18
+// +build go1.18
+
+package types
+
+import (
+	"testing"
+)
+
+/*
+	This file contains fuzz targets for the payload parsers of every frame
+	type. The payloads come from peers, so a parser must return an error
+	for any input instead of panicking.
+*/
+
+func FuzzCreateData(f *testing.F) {
+	f.Add(testFlagsByte, testPayloadBytes)
+	f.Add(byte(0x1), []byte("Hello World"))
+	f.Add(byte(0x8), []byte{})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		data, err := CreateData(flags, payload, uint32(len(payload)))
+		return &data.Flags, &data.Payload, err
+	})
+}
+
+func FuzzCreateHeaders(f *testing.F) {
+	f.Add(byte(0x5), []byte{0x82, 0x86, 0x84})
+	f.Add(byte(0x2D), []byte{2, 0x80, 0, 0, 1, 15, 0x82, 0, 0})
+	f.Add(byte(0x20), []byte{0, 0, 0})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		headers, err := CreateHeaders(flags, payload, uint32(len(payload)))
+		return &headers.Flags, &headers.Payload, err
+	})
+}
+
+func FuzzCreatePriority(f *testing.F) {
+	f.Add(byte(0x0), []byte{0x80, 0, 0, 1, 15})
+	f.Add(byte(0x0), []byte{0, 0, 0})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		priority, err := CreatePriority(flags, payload, uint32(len(payload)))
+		return &priority.Flags, &priority.Payload, err
+	})
+}
+
+func FuzzCreateRstStream(f *testing.F) {
+	f.Add(byte(0x0), []byte{0, 0, 0, 8})
+	f.Add(byte(0x0), []byte{0, 0})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		rstStream, err := CreateRstStream(flags, payload, uint32(len(payload)))
+		return &rstStream.Flags, &rstStream.Payload, err
+	})
+}
+
+func FuzzCreateSettings(f *testing.F) {
+	f.Add(byte(0x0), []byte{0, 3, 0, 0, 0, 100, 0, 4, 0, 0, 0xFF, 0xFF})
+	f.Add(byte(0x1), []byte{})
+	f.Add(byte(0x0), []byte{0, 3, 0})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		settings, err := CreateSettings(flags, payload, uint32(len(payload)))
+		return &settings.Flags, &settings.Payload, err
+	})
+}
+
+func FuzzCreatePushPromise(f *testing.F) {
+	f.Add(byte(0x4), []byte{0, 0, 0, 2, 0x82})
+	f.Add(byte(0xC), []byte{1, 0, 0, 0, 2, 0x82, 0})
+	f.Add(byte(0x8), []byte{4})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		pushPromise, err := CreatePushPromise(flags, payload, uint32(len(payload)))
+		return &pushPromise.Flags, &pushPromise.Payload, err
+	})
+}
+
+func FuzzCreatePing(f *testing.F) {
+	f.Add(byte(0x0), []byte("pingdata"))
+	f.Add(byte(0x1), []byte("ping"))
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		ping, err := CreatePing(flags, payload, uint32(len(payload)))
+		return &ping.Flags, &ping.Payload, err
+	})
+}
+
+func FuzzCreateGoAway(f *testing.F) {
+	f.Add(byte(0x0), []byte{0x80, 0, 0, 1, 0, 0, 0, 1, 'd', 'e', 'b', 'u', 'g'})
+	f.Add(byte(0x0), []byte{0, 0, 0, 1})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		goAway, err := CreateGoAway(flags, payload, uint32(len(payload)))
+		return &goAway.Flags, &goAway.Payload, err
+	})
+}
+
+func FuzzCreateWindowUpdate(f *testing.F) {
+	f.Add(byte(0x0), []byte{0x7F, 0xFF, 0xFF, 0xFF})
+	f.Add(byte(0x0), []byte{0, 1})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		windowUpdate, err := CreateWindowUpdate(flags, payload, uint32(len(payload)))
+		return &windowUpdate.Flags, &windowUpdate.Payload, err
+	})
+}
+
+func FuzzCreateContinuation(f *testing.F) {
+	f.Add(byte(0x4), []byte{0x82, 0x86})
+	f.Add(byte(0x0), []byte{})
+	fuzzPayload(f, func(flags byte, payload []byte) (IFlags, IPayload, error) {
+		continuation, err := CreateContinuation(flags, payload, uint32(len(payload)))
+		return &continuation.Flags, &continuation.Payload, err
+	})
+}
+
+// ------- HELPERS ---------
+
+// FuzzPayload fuzzes a frame parser with random flags and payloads. A parsed payload must also be
+// possible to write back.
+func fuzzPayload(f *testing.F, parse func(flags byte, payload []byte) (IFlags, IPayload, error)) {
+	f.Fuzz(func(t *testing.T, flags byte, payload []byte) {
+		parsedFlags, parsedPayload, err := parse(flags, payload)
+		if err != nil {
+			return
+		}
+		parsedFlags.Byte()
+		parsedPayload.Bytes(parsedFlags)
+	})
+}
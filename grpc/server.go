@@ -0,0 +1,168 @@
+package grpc
+
+import (
+	"context"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	This file contains the server of gRPC methods, as described by the
+	gRPC over HTTP2 protocol. Methods are routed by their path,
+	/package.Service/Method, and messages are passed to the handlers as
+	bytes, so any codec can be used to marshal and unmarshal them.
+*/
+
+// UnaryHandler handles a call with a single request message, and returns a single response message
+type UnaryHandler func(req *http.Request, msg []byte) ([]byte, error)
+
+// StreamHandler handles a call where the client, the server or both send any number of messages
+type StreamHandler func(stream *Stream) error
+
+// Server routes gRPC calls to the registered handlers
+type Server struct {
+	router         *router.Router
+	services       map[string]bool // The services with registered methods, like "/helloworld.Greeter"
+	maxMessageSize uint32
+}
+
+// NewServer creates a new gRPC server. Calls of methods that are not registered get the status UNIMPLEMENTED.
+func NewServer() *Server {
+	s := &Server{
+		router:         router.NewRouter("/"),
+		services:       make(map[string]bool),
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+	s.routeUnimplemented("/:service/:method")
+	return s
+}
+
+// Unary registers a handler of a unary method. The method is the full name, like "/helloworld.Greeter/SayHello".
+func (s *Server) Unary(method string, handler UnaryHandler) {
+	s.Stream(method, func(stream *Stream) error {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return Errorf(Internal, "missing request message of unary call")
+		}
+		if err != nil {
+			return err
+		}
+		// The client must end the stream after the request message
+		if _, err := stream.Recv(); err != io.EOF {
+			if err == nil {
+				return Errorf(Internal, "more than one request message of unary call")
+			}
+			return err
+		}
+		reply, err := handler(stream.req, msg)
+		if err != nil {
+			return err
+		}
+		stream.write(reply) // Sent along with the trailers when the handler is done
+		return nil
+	})
+}
+
+// Stream registers a handler of a streaming method. The method is the full name, like "/routeguide.RouteGuide/RouteChat".
+func (s *Server) Stream(method string, handler StreamHandler) {
+	// Other methods of the service are not matched by the route of all services, as routes are matched one
+	// segment at a time, so the service gets its own route for methods that are not registered
+	if slash := strings.LastIndex(method, "/"); slash > 0 && !s.services[method[:slash]] {
+		s.services[method[:slash]] = true
+		s.routeUnimplemented(method[:slash] + "/:method")
+	}
+	s.router.Streaming(method)
+	s.router.Post(method, s.serve(handler))
+}
+
+// SetMaxMessageSize sets the largest message received from clients. The default is DefaultMaxMessageSize.
+func (s *Server) SetMaxMessageSize(size uint32) {
+	s.maxMessageSize = size
+}
+
+// Router returns the router of the registered methods, which is registered to an Opal server.
+// Methods are registered before the router is registered.
+func (s *Server) Router() *router.Router {
+	return s.router
+}
+
+// ------- HELPERS ---------
+
+// Serve creates the route handler of a method
+func (s *Server) serve(handler StreamHandler) router.HandleFunc {
+	return func(req *http.Request, res *http.Response) {
+		if req.Proto != "HTTP/2" {
+			res.String(505, "gRPC requires HTTP/2") // Trailers can not be sent over HTTP/1.1
+			return
+		}
+		if !strings.HasPrefix(req.Header["content-type"], "application/grpc") {
+			res.String(415, "gRPC requests must have content-type application/grpc")
+			return
+		}
+		res.Header["content-type"] = "application/grpc"
+
+		if timeout, ok := parseTimeout(req.Header["grpc-timeout"]); ok {
+			ctx, cancel := context.WithTimeout(req.Context(), timeout)
+			defer cancel()
+			req.SetContext(ctx)
+		}
+
+		err := handler(&Stream{req: req, res: res, maxMessageSize: s.maxMessageSize})
+		if err == nil && req.Context().Err() == context.DeadlineExceeded {
+			err = req.Context().Err()
+		}
+		status := statusFromError(err)
+		res.Trailer["grpc-status"] = strconv.Itoa(int(status.Code))
+		if status.Message != "" {
+			res.Trailer["grpc-message"] = encodeMessage(status.Message)
+		}
+	}
+}
+
+// RouteUnimplemented registers a route answering calls of methods that are not registered. The route is
+// streaming, so the call is answered without waiting for the request messages.
+func (s *Server) routeUnimplemented(path string) {
+	s.router.Streaming(path)
+	s.router.Post(path, unimplemented)
+}
+
+// Unimplemented answers a call of a method that is not registered with a trailers-only response, where the
+// status is sent in the headers of an empty response. Requests that are not gRPC get 404, like other paths
+// that are not routed.
+func unimplemented(req *http.Request, res *http.Response) {
+	if !strings.HasPrefix(req.Header["content-type"], "application/grpc") {
+		res.NotFound()
+		return
+	}
+	res.Header["content-type"] = "application/grpc"
+	res.Header["grpc-status"] = strconv.Itoa(int(Unimplemented))
+	res.Header["grpc-message"] = encodeMessage("unknown method " + req.URI)
+}
+
+// ParseTimeout parses the grpc-timeout header, which is a number followed by a unit
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
@@ -0,0 +1,301 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/SveinungOverland/opal/http"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUnary(t *testing.T) {
+	s := NewServer()
+	s.Unary("/test.Echo/Echo", func(req *http.Request, msg []byte) ([]byte, error) {
+		return append([]byte("echo: "), msg...), nil
+	})
+
+	res := call(t, s, "/test.Echo/Echo", newTestRequest(frameMessages("hello")))
+	if res.Header["content-type"] != "application/grpc" {
+		t.Errorf("Incorrect content-type! Expected %s, got %s", "application/grpc", res.Header["content-type"])
+	}
+	validateMessages(t, res.Body, "echo: hello")
+	validateStatus(t, res, OK, "")
+}
+
+func TestUnaryMessageCount(t *testing.T) {
+	tests := map[string]struct {
+		body    []byte
+		message string
+	}{
+		"missing":  {frameMessages(), "missing request message of unary call"},
+		"multiple": {frameMessages("hello", "again"), "more than one request message of unary call"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			called := false
+			s := NewServer()
+			s.Unary("/test.Echo/Echo", func(req *http.Request, msg []byte) ([]byte, error) {
+				called = true
+				return msg, nil
+			})
+
+			res := call(t, s, "/test.Echo/Echo", newTestRequest(test.body))
+			if called {
+				t.Error("Handler was called without exactly one request message")
+			}
+			validateMessages(t, res.Body)
+			validateStatus(t, res, Internal, test.message)
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := NewServer()
+	s.Stream("/test.Echo/Chat", func(stream *Stream) error {
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	})
+
+	writer := &testWriter{}
+	req := newTestRequest(frameMessages("first", "second"))
+	res := http.NewResponse(req)
+	res.SetStreamWriter(writer)
+	callWithResponse(t, s, "/test.Echo/Chat", req, res)
+
+	if writer.status != 200 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 200, writer.status)
+	}
+	validateMessages(t, writer.data.Bytes(), "first", "second")
+	validateStatus(t, res, OK, "")
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		code    Code
+		message string
+	}{
+		{"status", Errorf(NotFound, "no user with id %d", 5), NotFound, "no user with id 5"},
+		{"error", errors.New("100% broken\n"), Unknown, "100%25 broken%0A"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer()
+			s.Unary("/test.Echo/Echo", func(req *http.Request, msg []byte) ([]byte, error) {
+				return nil, test.err
+			})
+
+			res := call(t, s, "/test.Echo/Echo", newTestRequest(frameMessages("hello")))
+			validateMessages(t, res.Body)
+			validateStatus(t, res, test.code, test.message)
+		})
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	compressed := frameMessages("hello")
+	compressed[0] = 1
+	tests := map[string]struct {
+		body []byte
+		code Code
+	}{
+		"compressed": {compressed, Unimplemented},
+		"truncated":  {frameMessages("hello")[:7], Internal},
+		"too large":  {frameMessages(string(make([]byte, 11))), ResourceExhausted},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := NewServer()
+			s.SetMaxMessageSize(10)
+			s.Unary("/test.Echo/Echo", func(req *http.Request, msg []byte) ([]byte, error) {
+				return msg, nil
+			})
+
+			res := call(t, s, "/test.Echo/Echo", newTestRequest(test.body))
+			if status := res.Trailer["grpc-status"]; status != codeString(test.code) {
+				t.Errorf("Incorrect grpc-status! Expected %s, got %s", codeString(test.code), status)
+			}
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	s := NewServer()
+	s.Unary("/test.Echo/Slow", func(req *http.Request, msg []byte) ([]byte, error) {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(time.Second):
+			return msg, nil
+		}
+	})
+
+	req := newTestRequest(frameMessages("hello"))
+	req.Header["grpc-timeout"] = "10m"
+	res := call(t, s, "/test.Echo/Slow", req)
+	validateStatus(t, res, DeadlineExceeded, "context deadline exceeded")
+}
+
+func TestNotGRPC(t *testing.T) {
+	s := NewServer()
+	s.Unary("/test.Echo/Echo", func(req *http.Request, msg []byte) ([]byte, error) {
+		t.Error("Handler was called with a request that is not gRPC")
+		return nil, nil
+	})
+
+	req := newTestRequest(frameMessages("hello"))
+	req.Header["content-type"] = "application/json"
+	if res := call(t, s, "/test.Echo/Echo", req); res.Status != 415 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 415, res.Status)
+	}
+}
+
+func TestUnimplemented(t *testing.T) {
+	s := NewServer()
+	s.Unary("/test.Echo/Echo", func(req *http.Request, msg []byte) ([]byte, error) {
+		return msg, nil
+	})
+
+	for _, method := range []string{"/test.Echo/Missing", "/test.Missing/Echo"} {
+		res := call(t, s, method, newTestRequest(frameMessages("hello")))
+		// The status is sent in the headers of an empty response, without trailers
+		if res.Status != 200 {
+			t.Errorf("Incorrect status of %s! Expected %d, got %d", method, 200, res.Status)
+		}
+		if code := res.Header["grpc-status"]; code != strconv.Itoa(int(Unimplemented)) {
+			t.Errorf("Incorrect grpc-status of %s! Expected %d, got %s", method, Unimplemented, code)
+		}
+		if len(res.Body) != 0 || len(res.Trailer) != 0 {
+			t.Errorf("Response to %s is not trailers-only", method)
+		}
+	}
+
+	// Requests that are not gRPC are not found
+	req := newTestRequest(nil)
+	req.Header["content-type"] = "application/json"
+	if res := call(t, s, "/test.Echo/Missing", req); res.Status != 404 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 404, res.Status)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := map[string]time.Duration{
+		"1H":   time.Hour,
+		"2M":   2 * time.Minute,
+		"30S":  30 * time.Second,
+		"100m": 100 * time.Millisecond,
+		"5u":   5 * time.Microsecond,
+		"7n":   7,
+	}
+	for value, expected := range tests {
+		if timeout, ok := parseTimeout(value); !ok || timeout != expected {
+			t.Errorf("Incorrect timeout of %s! Expected %v, got %v", value, expected, timeout)
+		}
+	}
+	for _, value := range []string{"", "S", "10", "10x", "-1S", "123456789S"} {
+		if _, ok := parseTimeout(value); ok {
+			t.Errorf("Invalid timeout %q was parsed", value)
+		}
+	}
+}
+
+// ---------- HELPERS --------------
+
+// testWriter is a http.StreamWriter keeping what is written
+type testWriter struct {
+	status uint16
+	data   bytes.Buffer
+}
+
+func (w *testWriter) WriteHeader(status uint16, header map[string]string) error {
+	w.status = status
+	return nil
+}
+
+func (w *testWriter) WriteData(data []byte) error {
+	w.data.Write(data)
+	return nil
+}
+
+func (w *testWriter) Done() <-chan struct{} {
+	return nil
+}
+
+func newTestRequest(body []byte) *http.Request {
+	req := http.NewRequest()
+	req.Method = "POST"
+	req.Proto = "HTTP/2"
+	req.Header["content-type"] = "application/grpc+proto"
+	req.SetBodyReader(ioutil.NopCloser(bytes.NewReader(body)))
+	return req
+}
+
+// Call runs the route of a method, and returns the response
+func call(t *testing.T, s *Server, method string, req *http.Request) *http.Response {
+	res := http.NewResponse(req)
+	callWithResponse(t, s, method, req, res)
+	return res
+}
+
+func callWithResponse(t *testing.T, s *Server, method string, req *http.Request, res *http.Response) {
+	req.URI = method
+	match, route, _, _ := s.Router().Root().Search(method)
+	if !match {
+		t.Fatalf("Method %s was not routed", method)
+	}
+	if !route.IsStreaming() {
+		t.Errorf("Route of method %s is not streaming", method)
+	}
+	for _, handler := range route.GetHandlers("POST") {
+		handler(req, res)
+	}
+}
+
+// FrameMessages prefixes every message with the compressed-flag and its length
+func frameMessages(msgs ...string) []byte {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		var prefix [5]byte
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+		buf.Write(prefix[:])
+		buf.WriteString(msg)
+	}
+	return buf.Bytes()
+}
+
+func validateMessages(t *testing.T, body []byte, expected ...string) {
+	if actual := body; !bytes.Equal(actual, frameMessages(expected...)) {
+		t.Errorf("Incorrect messages! Expected %q, got %q", frameMessages(expected...), actual)
+	}
+}
+
+func validateStatus(t *testing.T, res *http.Response, code Code, message string) {
+	if status := res.Trailer["grpc-status"]; status != codeString(code) {
+		t.Errorf("Incorrect grpc-status! Expected %s, got %s", codeString(code), status)
+	}
+	if msg := res.Trailer["grpc-message"]; msg != message {
+		t.Errorf("Incorrect grpc-message! Expected %q, got %q", message, msg)
+	}
+}
+
+func codeString(code Code) string {
+	return strconv.Itoa(int(code))
+}
@@ -0,0 +1,78 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Code is a gRPC status code, sent in the grpc-status trailer
+type Code uint32
+
+// The status codes of gRPC
+const (
+	OK Code = iota
+	Canceled
+	Unknown
+	InvalidArgument
+	DeadlineExceeded
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	ResourceExhausted
+	FailedPrecondition
+	Aborted
+	OutOfRange
+	Unimplemented
+	Internal
+	Unavailable
+	DataLoss
+	Unauthenticated
+)
+
+// Status is an error with a status code. Handlers return a Status to send a status other than Unknown.
+type Status struct {
+	Code    Code
+	Message string // Sent in the grpc-message trailer
+}
+
+// Errorf creates a Status with a formatted message
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc: code = %d desc = %s", s.Code, s.Message)
+}
+
+// ------- HELPERS ---------
+
+// StatusFromError converts an error returned by a handler into a Status
+func statusFromError(err error) *Status {
+	switch err {
+	case nil:
+		return &Status{Code: OK}
+	case context.DeadlineExceeded:
+		return &Status{Code: DeadlineExceeded, Message: err.Error()}
+	case context.Canceled:
+		return &Status{Code: Canceled, Message: err.Error()}
+	}
+	if status, ok := err.(*Status); ok {
+		return status
+	}
+	return &Status{Code: Unknown, Message: err.Error()}
+}
+
+// EncodeMessage percent-encodes a status message, as bytes outside of printable ASCII and '%' can not be sent in grpc-message
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package grpc
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/SveinungOverland/opal/http"
+	"io"
+)
+
+// DefaultMaxMessageSize is the largest message received by default
+const DefaultMaxMessageSize = 4 << 20
+
+// Stream is a call of a method, on which messages are received from and sent to the client
+type Stream struct {
+	req            *http.Request
+	res            *http.Response
+	maxMessageSize uint32
+}
+
+// Context returns the context of the call, which is cancelled when the client cancels the call or the deadline expires
+func (s *Stream) Context() context.Context {
+	return s.req.Context()
+}
+
+// Request returns the HTTP/2 request of the call. The metadata sent by the client is found in Request.Header.
+func (s *Stream) Request() *http.Request {
+	return s.req
+}
+
+// Recv receives the next message. Returns io.EOF when the client has sent all messages.
+func (s *Stream) Recv() ([]byte, error) {
+	// Every message is prefixed with a compressed-flag and the length of the message
+	var prefix [5]byte
+	if _, err := io.ReadFull(s.req.BodyReader(), prefix[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, Errorf(Internal, "receiving message prefix: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > s.maxMessageSize {
+		return nil, Errorf(ResourceExhausted, "message of %d bytes is larger than the max of %d bytes", length, s.maxMessageSize)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(s.req.BodyReader(), msg); err != nil {
+		return nil, Errorf(Internal, "receiving message: %v", err)
+	}
+	return msg, nil
+}
+
+// Send sends a message, and returns when it is written
+func (s *Stream) Send(msg []byte) error {
+	s.write(msg)
+	return s.res.Flush()
+}
+
+// ------- HELPERS ---------
+
+// Write adds a length-prefixed message to the response body
+func (s *Stream) write(msg []byte) {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	s.res.Write(prefix[:])
+	s.res.Write(msg)
+}
@@ -0,0 +1,67 @@
+package opal
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/http"
+	"strings"
+)
+
+/*
+	This file contains the handling of cleartext HTTP/2 (h2c) connections
+	that starts as HTTP/1.1 and upgrades to HTTP/2, as described in
+	RFC7540 Section 3.2
+*/
+
+const switchingProtocols = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+
+// Headers that are connection-specific, and must not be carried over to HTTP/2 - RFC7540 Section 8.1.2.2
+var connectionHeaders = []string{"connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection", "transfer-encoding"}
+
+// HasPreface checks if the client starts with the HTTP/2 connection preface (prior knowledge).
+// "PRI" is a reserved method in HTTP/1.1, so it is enough to peek at the first three bytes.
+func (c *Conn) hasPreface() bool {
+	b, err := c.br.Peek(3)
+	return err == nil && string(b) == clientPreface[:3]
+}
+
+// IsH2CUpgrade checks if a HTTP/1.1 request asks to be upgraded to cleartext HTTP/2
+func isH2CUpgrade(req *http.Request) bool {
+	_, hasSettings := req.Header["http2-settings"]
+	return hasSettings &&
+		http.HeaderContains(req.Header["upgrade"], "h2c") &&
+		http.HeaderContains(req.Header["connection"], "upgrade")
+}
+
+// UpgradeH2C applies the settings in the "HTTP2-Settings" header of a HTTP/1.1 request with an
+// "Upgrade: h2c" header, and switches protocol. The returned stream holds the request that was
+// sent with the upgrade.
+func (c *Conn) upgradeH2C(req *http.Request) (*Stream, error) {
+	// HTTP2-Settings is the payload of a SETTINGS frame, base64url-encoded - RFC7540 Section 3.2.1
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Header["http2-settings"], "="))
+	if err != nil {
+		return nil, errors.New("opal: invalid HTTP2-Settings header")
+	}
+	settings, err := types.CreateSettings(0, payload, uint32(len(payload)))
+	if err != nil || c.applySettings(settings.Payload.IDValuePair) != nil {
+		return nil, errors.New("opal: invalid HTTP2-Settings header")
+	}
+
+	// Build the request as a HTTP/2 request
+	for _, name := range connectionHeaders {
+		delete(req.Header, name)
+	}
+	req.Scheme = "http"
+	req.Proto = "HTTP/2"
+
+	if _, err := c.rw.Write([]byte(switchingProtocols)); err != nil {
+		return nil, err
+	}
+
+	return &Stream{
+		id:      1,
+		state:   HalfClosedRemote,
+		request: req,
+	}, nil
+}
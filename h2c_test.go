@@ -0,0 +1,69 @@
+package opal
+
+import (
+	"bufio"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"strings"
+	"testing"
+)
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+
+	client.conn.Write([]byte(clientPreface))
+	client.writeFrame(newTestSettingsFrame())
+	client.startReading()
+
+	fragment := newEncodedTestHeaders(client.hpack, "/", "GET")
+	client.writeFrame(&frame.Frame{
+		ID:      1,
+		Type:    frame.HeadersType,
+		Flags:   &types.HeadersFlags{EndHeaders: true, EndStream: true},
+		Payload: &types.HeadersPayload{Fragment: fragment},
+		Length:  uint32(len(fragment)),
+	})
+
+	headers := client.readHeaders(t, 1)
+	validateHeaderFields(t, headers, []*hpack.HeaderField{hf(":status", "400")})
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+
+	client.conn.Write([]byte("POST /test HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\n" +
+		"HTTP2-Settings: AAMAAABkAAQAAP__\r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"TEST"))
+
+	// Server should switch protocols
+	br := bufio.NewReader(client.conn)
+	status, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Fatalf("Expected 101 Switching Protocols, got %q", status)
+	}
+	for line, _ := br.ReadString('\n'); line != "\r\n"; line, _ = br.ReadString('\n') {
+	}
+
+	go client.conn.Write(append([]byte(clientPreface), newTestSettingsFrame().ToBytes()...))
+	client.br = br
+	client.startReading()
+
+	// The upgrade request should be answered on stream 1
+	headers := client.readHeaders(t, 1)
+	validateHeaderFields(t, headers, []*hpack.HeaderField{
+		hf(":status", "200"),
+		hf("content-type", "application/json"),
+	})
+}
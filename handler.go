@@ -1,18 +1,17 @@
 package opal
 
 import (
-	"fmt"
 	"github.com/SveinungOverland/opal/constants"
 	"github.com/SveinungOverland/opal/frame"
 	"github.com/SveinungOverland/opal/frame/types"
 	"github.com/SveinungOverland/opal/hpack"
 	"github.com/SveinungOverland/opal/http"
 	"github.com/SveinungOverland/opal/router"
+	"io/ioutil"
 	"strconv"
 	"strings"
-	"sync"
-
-	"github.com/fatih/color"
+	"sync/atomic"
+	"time"
 )
 
 // The purpose of this file is to handle streams.
@@ -29,11 +28,8 @@ type responseWrapper struct {
 // ServeStreamHandler handles incoming streams, build and sends responses, and handles push reqests
 func serveStreamHandler(conn *Conn) {
 	// A channel to handle finished requests (responses)
+	// The channel is not closed, as handlers may still run when the connection is closed
 	reqDoneChan := make(chan responseWrapper, 10)
-	defer close(reqDoneChan)
-
-	// Check if server push is enabled
-	serverPushEnabled := conn.settings[2] != 0
 
 	for {
 		select {
@@ -46,26 +42,29 @@ func serveStreamHandler(conn *Conn) {
 			if s == nil {
 				return
 			}
-			req, err := createRequest(conn, s) // Header decompression, creating request
-			if err != nil {
-				fmt.Println(err)
-				conn.outChanFrame <- frame.NewErrorFrame(s.id, constants.CompressionError)
-				continue
-			}
-
+			req := createRequest(s)
 			go handleRequest(conn, reqDoneChan, req, s) // Serve and build response
 
 		// Check for and handle incoming responses
 		case resWrp := <-reqDoneChan:
-			// Initialize server push requests
+			// Initialize server push requests. The client may disable push in any SETTINGS frame
+			serverPushEnabled := conn.setting(2) != 0 && conn.localSettings.EnablePush
 			pushRequests := resWrp.res.PushRequests()
 			var pushResponses []*responseWrapper
 			if serverPushEnabled {
 				pushResponses = sendPushRequest(conn, pushRequests, resWrp.s)
 			}
 
-			// Send original response
-			sendResponse(conn, resWrp.s, resWrp.res)
+			// Send original response, or the rest of it if it is streamed
+			if resWrp.res.Committed() {
+				hasTrailer := len(resWrp.res.Trailer) > 0
+				conn.queueData(resWrp.s, resWrp.res.Body, !hasTrailer)
+				if hasTrailer {
+					conn.queueTrailer(resWrp.s, encodeTrailer(resWrp.res.Trailer))
+				}
+			} else {
+				sendResponse(conn, resWrp.s, resWrp.res)
+			}
 
 			// Send push responses
 			if serverPushEnabled {
@@ -79,73 +78,115 @@ func serveStreamHandler(conn *Conn) {
 
 // ------------ REQUEST FUNCTIONS ---------------
 
-// CreateRequest takes a stream and builds a request out of it. Internally it performs a header decompression.
-func createRequest(conn *Conn, s *Stream) (*http.Request, error) {
+// CreateRequest takes a stream and builds a request out of it. The headers are already decoded when the stream is received.
+func createRequest(s *Stream) *http.Request {
 	// Build request
-	req, err := s.toRequest(conn.hpack) // Header decompression
-	if err != nil {
-		return nil, err
+	req := s.toRequest()
+	if s.ctx != nil {
+		req.SetContext(s.ctx)
 	}
 
-	return req, nil
+	return req
 }
 
 // HandleRequest builds a response based on given request and sends it to provided out-channel
 func handleRequest(conn *Conn, reqDoneChan chan responseWrapper, req *http.Request, s *Stream) {
-	res := serveRequest(conn, req)
-	reqDoneChan <- responseWrapper{req, res, s}
-	go printResponse(req, res)
+	start := time.Now()
+	writer := &responseWriter{conn: conn, stream: s}
+	res := http.NewResponse(req)
+	res.SetStreamWriter(writer)
+	res = runHandlers(conn, req, res, writer)
+	if res != nil && s.body != nil && s.body.tooLarge() {
+		res = rejectLargeBody(conn, req, res, s)
+	}
+	req.BodyReader().Close() // Data the handlers did not read is discarded
+	if res == nil {
+		return // The stream is reset
+	}
+	select {
+	case reqDoneChan <- responseWrapper{req, res, s}:
+	case <-conn.ctx.Done():
+	}
+	conn.logAccess(req, res, s.id, start, writer.bytesWritten()+len(res.Body))
 }
 
 // ServeRequest handles an incoming request. Runs all endpoint-methods
 func serveRequest(conn *Conn, req *http.Request) *http.Response {
 	// Build response
 	res := http.NewResponse(req)
+	serveResponse(conn, req, res, conn.server.findRoute(req))
+	return res
+}
 
-	// Find route and build response
-	match, route, params, fh := conn.server.rootRoute.Search(req.URI)
-	if match {
-		// Found route, run handlers and build response
-		req.Params = params
-		middlewares := conn.server.middlewares
-		handlers := route.GetHandlers(req.Method)
-		handleRoute(middlewares, handlers, req, res)
-	} else if fh != nil { // Handle static file response
-		handleFile(res, fh)
-	} else {
-		res.NotFound() // Neither route or file found
-	}
+// ServeResponse runs all endpoint-methods of a request's route, building the given response.
+// Returns false if the handlers panicked.
+func serveResponse(conn *Conn, req *http.Request, res *http.Response, m *routeMatch) bool {
+	ok := runRoute(conn, req, res, m)
 
-	// Set Content-Length if body is provided
+	// Set Content-Length if body is provided, and the headers are not sent yet
 	contentLength := len(res.Body)
-	if contentLength > 0 {
+	if contentLength > 0 && !res.Committed() {
 		res.Header["content-length"] = strconv.Itoa(contentLength)
 	}
-	return res
+	return ok
 }
 
-// ------------ RESPONSE FUNCTIONS ---------------
+// RouteMatch is the result of looking up the route of a request
+type routeMatch struct {
+	found  bool
+	route  *router.Route // The matching route, or the farthest route found if there is no match
+	params map[string]string
+	fh     *router.FileHandler
+}
 
-// SendResponse encodes a response and sends it to a connection's out-channel
-func sendResponse(conn *Conn, s *Stream, res *http.Response) {
-	// Initialize headers to send
-	hfs := make([]*hpack.HeaderField, 0)
-	hfs = append(hfs, &hpack.HeaderField{Name: ":status", Value: strconv.Itoa(int(res.Status))})
+// FindRoute looks up the route of a request
+func (s *Server) findRoute(req *http.Request) *routeMatch {
+	found, route, params, fh := s.rootRoute.Search(req.URI)
+	return &routeMatch{found: found, route: route, params: params, fh: fh}
+}
 
-	for k, v := range res.Header {
-		hfs = append(hfs, &hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+// RunRoute runs the handlers of a request's route. Returns false if the handlers panicked.
+func runRoute(conn *Conn, req *http.Request, res *http.Response, m *routeMatch) (ok bool) {
+	ok = true
+	defer recoverPanic(conn, req, res, &ok)
+
+	if m.found {
+		// Found route, run handlers and build response
+		req.Params = m.params
+		middlewares := conn.server.middlewares
+		handlers := m.route.GetHandlers(req.Method)
+		var err error
+		if !m.route.IsStreaming() {
+			err = readBody(req)
+		}
+		switch err {
+		case nil:
+			handleRoute(middlewares, handlers, req, res)
+		case http.ErrBodyTooLarge:
+			res.String(413, "Payload Too Large")
+		default:
+			res.BadRequest() // The body was not fully received
+		}
+	} else if m.fh != nil { // Handle static file response
+		handleFile(res, m.fh)
+	} else {
+		res.NotFound() // Neither route or file found
 	}
+	return ok
+}
 
-	// Encode headers
-	encodedHeaders := conn.hpack.Encode(hfs) // Header compression
+// ------------ RESPONSE FUNCTIONS ---------------
 
-	// Store headers and data in stream
-	s.headers = encodedHeaders
+// SendResponse encodes a response and sends it to a connection's out-channel
+func sendResponse(conn *Conn, s *Stream, res *http.Response) {
+	// Store data and trailers in stream
 	s.data = res.Body
-	s.state = HalfClosedRemote
+	if len(res.Trailer) > 0 {
+		s.trailer = encodeTrailer(res.Trailer)
+	}
 
-	// Send stream to outChannel
-	conn.outChan <- s
+	// Encode headers and send stream to outChannel
+	conn.writeHeaders(s, responseHeaderFields(res.Status, res.Header))
 }
 
 // ------------ PUSH RESPONSE FUNCTIONS -------------
@@ -160,18 +201,25 @@ func sendPushRequest(conn *Conn, reqs []*http.Request, s *Stream) []*responseWra
 		// Serve request
 		res := serveRequest(conn, pshReq)
 
-		// Build PUSH_PROMISE frame
+		// Build and send PUSH_PROMISE frame. The headers are encoded and queued under the same lock as responses.
+		conn.hpackMu.Lock()
 		pushPromiseFrame := newPushPromise(conn, pshReq, s)
-
-		// Send PUSH_PROMISE frame
-		conn.outChanFrame <- pushPromiseFrame
+		conn.sendFrame(pushPromiseFrame)
+		conn.hpackMu.Unlock()
 
 		// Create new stream for request
 		stream := &Stream{
-			id:    pushPromiseFrame.Payload.(types.PushPromisePayload).StreamID,
+			id:    pushPromiseFrame.Payload.(*types.PushPromisePayload).StreamID,
 			state: ReservedLocal,
 		}
 		conn.SetStream(stream) // Register stream at conn
+		conn.mu.Lock()
+		conn.active[stream.id] = struct{}{} // Push streams must also be written before the connection can be drained
+		conn.mu.Unlock()
+		// Pushed streams depend on the stream they are associated with - RFC7540 Section 5.3.5
+		conn.withScheduler(func(ws WriteScheduler) {
+			ws.OpenStream(stream.id, Priority{StreamDependency: s.id, Weight: defaultPriority.Weight})
+		})
 
 		// Append stream and response
 		pushResponses = append(pushResponses, &responseWrapper{nil, res, stream})
@@ -182,6 +230,30 @@ func sendPushRequest(conn *Conn, reqs []*http.Request, s *Stream) []*responseWra
 
 // ---- HELPERS -----
 
+// ReadBody reads the whole request body into Request.Body. Returns http.ErrBodyTooLarge if the body
+// is larger than the server accepts.
+func readBody(req *http.Request) error {
+	body, err := ioutil.ReadAll(req.BodyReader())
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+// RejectLargeBody answers a request whose body is larger than the server accepts with 413, as the handlers
+// did not get the whole body. The stream is reset instead if the response headers are already sent.
+func rejectLargeBody(conn *Conn, req *http.Request, res *http.Response, s *Stream) *http.Response {
+	if res.Committed() {
+		conn.sendFrame(frame.NewErrorFrame(s.id, constants.Cancel))
+		return nil
+	}
+	tooLarge := http.NewResponse(req)
+	tooLarge.String(413, "Payload Too Large")
+	tooLarge.Header["content-length"] = strconv.Itoa(len(tooLarge.Body))
+	return tooLarge
+}
+
 // HandleRoute runs endpoint-handlers and builds a response
 func handleRoute(middlewares []router.HandleFunc, handlers []router.HandleFunc, req *http.Request, res *http.Response) {
 	// Run all middlewares
@@ -245,17 +317,17 @@ func newPushPromise(conn *Conn, req *http.Request, s *Stream) *frame.Frame {
 
 	// Choose next stream identifier
 	// RFC7540 - Section 5.1.1 states that new stream ids from the server must be even
-	conn.prevStreamID = conn.prevStreamID + 2 // prevStreamID starts at zero, so it is always even
+	streamID := atomic.AddUint32(&conn.prevStreamID, 2) // prevStreamID starts at zero, so it is always even
 
 	pushFrame := &frame.Frame{
 		ID:   s.id,
 		Type: frame.PushPromiseType,
-		Flags: types.PushPromiseFlags{
+		Flags: &types.PushPromiseFlags{
 			EndHeaders: true,
 			Padded:     false,
 		},
-		Payload: types.PushPromisePayload{
-			StreamID:  conn.prevStreamID,
+		Payload: &types.PushPromisePayload{
+			StreamID:  streamID,
 			Fragment:  encodedHeaders,
 			PadLength: 0,
 		},
@@ -282,20 +354,3 @@ func initReqHFs(req *http.Request) []*hpack.HeaderField {
 
 	return hfs
 }
-
-// PrintResponse prints the request and response status code
-var mutex = &sync.Mutex{}
-
-func printResponse(req *http.Request, res *http.Response) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	var statusColor func(a ...interface{}) string
-	if res.Status < 300 {
-		statusColor = color.New(color.FgGreen).SprintFunc()
-	} else if res.Status < 400 {
-		statusColor = color.New(color.FgYellow).SprintFunc()
-	} else {
-		statusColor = color.New(color.FgRed).SprintFunc()
-	}
-	fmt.Fprintf(color.Output, "HTTP/2 %s %s %s\n", req.Method, req.URI, statusColor(strconv.Itoa(int(res.Status))))
-}
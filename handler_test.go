@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"github.com/SveinungOverland/opal/constants"
 	"github.com/SveinungOverland/opal/frame"
 	"github.com/SveinungOverland/opal/frame/types"
 	"github.com/SveinungOverland/opal/hpack"
@@ -24,13 +25,13 @@ func TestStreamHandlerIntegration(t *testing.T) {
 	conn := srv.createConn(nil)
 	conn.hpack = hpack.NewContext(4096, 4096) // Initialize hpack context
 
-	// Initialize HPACK (streams must include encoded headers)
+	// Initialize HPACK (responses are encoded by the connection)
 	hpackCtx := hpack.NewContext(4096, 4096)
 
 	// Initialize incoming streams
-	s1Headers := newEncodedTestHeaders(hpackCtx, "/", "GET")
-	s2Headers := newEncodedTestHeaders(hpackCtx, "/test", "POST")
-	s3Headers := newEncodedTestHeaders(hpackCtx, "/invalid", "PUT") // Should result in 404
+	s1Headers := newTestHeaders("/", "GET")
+	s2Headers := newTestHeaders("/test", "POST")
+	s3Headers := newTestHeaders("/invalid", "PUT") // Should result in 404
 	s1 := newTestStream(1, s1Headers, []byte{})
 	s2 := newTestStream(3, s2Headers, []byte("TEST"))
 	s3 := newTestStream(5, s3Headers, []byte{})
@@ -98,6 +99,38 @@ func TestStreamHandlerIntegration(t *testing.T) {
 	cancelFunc()
 }
 
+func TestRequestContextCancelled(t *testing.T) {
+	type ctxKey string
+	errChan := make(chan error, 1)
+	r := router.NewRouter("/")
+	r.Get("/slow", func(req *http.Request, res *http.Response) {
+		if req.Context().Value(ctxKey("user")) != "tester" {
+			t.Error("Value set by middleware was not found in the request context")
+		}
+		select {
+		case <-req.Context().Done():
+			errChan <- req.Context().Err()
+		case <-time.After(time.Second):
+			errChan <- nil
+		}
+	})
+
+	srv := NewServer()
+	srv.Use(func(req *http.Request, res *http.Response) {
+		req.SetContext(context.WithValue(req.Context(), ctxKey("user"), "tester"))
+	})
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/slow", "GET", true)
+	client.writeFrame(frame.NewErrorFrame(1, constants.Cancel))
+
+	if err := <-errChan; err != context.Canceled {
+		t.Errorf("Request context was not cancelled when the stream was reset. Got %v", err)
+	}
+}
+
 func TestSendResponse(t *testing.T) {
 	conn := newTestConn()
 
@@ -108,8 +141,8 @@ func TestSendResponse(t *testing.T) {
 	res.Unauthorized()
 
 	// Send response
-	stream := newTestStream(1, []byte{}, []byte{})
-	sendResponse(conn, stream, res)
+	stream := newTestStream(1, nil, []byte{})
+	go sendResponse(conn, stream, res) // The out-channel is unbuffered
 	outStream := <-conn.outChan
 
 	// Check stream id
@@ -141,7 +174,7 @@ func TestNewPushPromise(t *testing.T) {
 	req.URI = "/test"
 	req.Authority = "https://example.com"
 
-	stream := newTestStream(4, []byte{}, []byte{})
+	stream := newTestStream(4, nil, []byte{})
 
 	pushPromise := newPushPromise(conn, req, stream)
 
@@ -150,7 +183,7 @@ func TestNewPushPromise(t *testing.T) {
 		t.Errorf("PushPromise frame has invalid id! Expected %d, got %d", stream.id, pushPromise.ID)
 	}
 	// Check if promised stream identifier
-	payload, ok := pushPromise.Payload.(types.PushPromisePayload)
+	payload, ok := pushPromise.Payload.(*types.PushPromisePayload)
 	if !ok {
 		t.Error("PushPromiseFrame does not include a PushPromisePayload!")
 	}
@@ -171,6 +204,7 @@ func newTestServer() *Server {
 		isTLS:         true,
 		connErrorChan: nil,
 		rootRoute:     router.NewRoot(),
+		settings:      DefaultSettings(),
 	}
 }
 
@@ -200,21 +234,25 @@ func newTestRouter() *router.Router {
 	return r
 }
 
-func newEncodedTestHeaders(hpackCtx *hpack.Context, path, method string) []byte {
-	// Initialize and encode headers
-	hfs := []*hpack.HeaderField{
+func newTestHeaders(path, method string) []*hpack.HeaderField {
+	return []*hpack.HeaderField{
 		&hpack.HeaderField{Name: ":method", Value: method},
+		&hpack.HeaderField{Name: ":scheme", Value: "https"},
 		&hpack.HeaderField{Name: ":path", Value: path},
 	}
-	return hpackCtx.Encode(hfs)
 }
 
-func newTestStream(id uint32, header, data []byte) *Stream {
+func newEncodedTestHeaders(hpackCtx *hpack.Context, path, method string) []byte {
+	// Initialize and encode headers
+	return hpackCtx.Encode(newTestHeaders(path, method))
+}
+
+func newTestStream(id uint32, fields []*hpack.HeaderField, data []byte) *Stream {
 	return &Stream{
-		id:      id,
-		state:   Open,
-		headers: header,
-		data:    data,
+		id:     id,
+		state:  Open,
+		fields: fields,
+		data:   data,
 	}
 }
 
@@ -0,0 +1,71 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/hpack"
+)
+
+/*
+	This file contains the assembling of header blocks. A header block is
+	sent as a HEADERS frame followed by CONTINUATION frames, and no other
+	frames may be sent in between - RFC7540 Section 4.3. Every header block
+	is decoded in the order it is received, also when the stream is refused
+	or ignored, so the HPACK state of the connection is kept in sync.
+*/
+
+// defaultMaxHeaderListSize limits the size of the request headers when SETTINGS_MAX_HEADER_LIST_SIZE is not set
+const defaultMaxHeaderListSize = 1 << 20
+
+// headerBlock is a header block that is not fully received
+type headerBlock struct {
+	streamID uint32
+	fragment []byte
+	complete func(hfs []*hpack.HeaderField) error // Called with the decoded header fields
+}
+
+// ------- HELPERS ---------
+
+// StartHeaderBlock starts assembling the header block of a HEADERS frame. The complete function is called
+// with the decoded header fields when the END_HEADERS flag is received, and its error is returned.
+func (c *Conn) startHeaderBlock(streamID uint32, fragment []byte, endHeaders bool, complete func(hfs []*hpack.HeaderField) error) error {
+	c.headerBlock = &headerBlock{streamID: streamID, complete: complete}
+	return c.appendHeaderBlock(fragment, endHeaders)
+}
+
+// AppendHeaderBlock appends the fragment of a HEADERS or CONTINUATION frame to the header block being received,
+// and decodes the header block if it is complete. Header blocks larger than the limit close the connection,
+// and so do header lists that are larger than the limit when decoded.
+func (c *Conn) appendHeaderBlock(fragment []byte, endHeaders bool) error {
+	block := c.headerBlock
+	if len(block.fragment)+len(fragment) > c.maxHeaderBlockSize() {
+		return constants.ConnectionError{Code: constants.ProtocolError, Reason: "header block exceeds SETTINGS_MAX_HEADER_LIST_SIZE"}
+	}
+	block.fragment = append(block.fragment, fragment...)
+	if !endHeaders {
+		return nil
+	}
+
+	c.headerBlock = nil
+	hfs, err := c.hpack.Decode(block.fragment) // Header decompression
+	if err == hpack.ErrHeaderListTooLarge {
+		return constants.ConnectionError{Code: constants.ProtocolError, Reason: "header list exceeds SETTINGS_MAX_HEADER_LIST_SIZE"}
+	}
+	if err != nil {
+		// The HPACK state can not be recovered - RFC7540 Section 4.3
+		return constants.ConnectionError{Code: constants.CompressionError, Reason: err.Error()}
+	}
+	return block.complete(hfs)
+}
+
+// DiscardHeaders returns a complete function of a header block that is decoded, but not used
+func discardHeaders(err error) func(hfs []*hpack.HeaderField) error {
+	return func(hfs []*hpack.HeaderField) error {
+		return err
+	}
+}
+
+// MaxHeaderBlockSize returns the largest header block accepted from the client. Header fields take up at
+// least as many bytes decoded as encoded, so blocks within the limit are never rejected.
+func (c *Conn) maxHeaderBlockSize() int {
+	return int(c.localSettings.headerListLimit())
+}
@@ -0,0 +1,184 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+)
+
+func TestContinuation(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Post("/", func(req *http.Request, res *http.Response) {
+		res.String(200, "body: "+string(req.Body))
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	// END_STREAM is set on the HEADERS frame, before the header block is complete
+	fragment := newEncodedTestHeaders(client.hpack, "/", "POST")
+	client.writeFrame(newTestHeadersFrame(1, fragment[:1], false, true))
+	client.writeFrame(newTestContinuationFrame(1, fragment[1:2], false))
+	client.writeFrame(newTestContinuationFrame(1, fragment[2:], true))
+
+	headers := client.readHeaders(t, 1)
+	validateHeaderFields(t, headers, []*hpack.HeaderField{hf(":status", "200")})
+	data := client.readFrame(t, frame.DataType, 1)
+	if body := string(data.Payload.(*types.DataPayload).Data); body != "body: " {
+		t.Errorf("Incorrect body! Expected %q, got %q", "body: ", body)
+	}
+}
+
+func TestInterruptedHeaderBlock(t *testing.T) {
+	tests := map[string]*frame.Frame{
+		"ping":                     newTestPingFrame(),
+		"continuation on a stream": newTestContinuationFrame(3, []byte{}, true),
+		"headers":                  newTestHeadersFrame(3, []byte{}, true, true),
+	}
+
+	for name, interruption := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := NewServer()
+			client := newPipeClient(srv)
+			defer client.conn.Close()
+			client.handshake()
+
+			fragment := newEncodedTestHeaders(client.hpack, "/", "GET")
+			client.writeFrame(newTestHeadersFrame(1, fragment, false, true))
+			client.writeFrame(interruption)
+
+			f := client.readFrame(t, frame.GoAwayType, 0)
+			if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.ProtocolError {
+				t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+			}
+		})
+	}
+}
+
+func TestContinuationWithoutHeaders(t *testing.T) {
+	srv := NewServer()
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/", "GET", true)
+	client.writeFrame(newTestContinuationFrame(1, []byte{}, true))
+
+	f := client.readFrame(t, frame.GoAwayType, 0)
+	if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.ProtocolError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+	}
+}
+
+func TestHeaderBlockTooLarge(t *testing.T) {
+	srv := NewServer()
+	settings := DefaultSettings()
+	settings.MaxHeaderListSize = 100
+	srv.SetSettings(settings)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	fragment := client.hpack.Encode([]*hpack.HeaderField{hf("x-large", string(make([]byte, 80)))})
+	client.writeFrame(newTestHeadersFrame(1, fragment, false, true))
+	client.writeFrame(newTestContinuationFrame(1, fragment, true))
+
+	f := client.readFrame(t, frame.GoAwayType, 0)
+	if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.ProtocolError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+	}
+}
+
+func TestHeaderListTooLarge(t *testing.T) {
+	srv := NewServer()
+	settings := DefaultSettings()
+	settings.MaxHeaderListSize = 1000
+	srv.SetSettings(settings)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	// The field is indexed, so the encoded block is far smaller than the decoded header list
+	fields := newTestHeaders("/", "GET")
+	for i := 0; i < 20; i++ {
+		fields = append(fields, hf("x-large", string(make([]byte, 80))))
+	}
+	fragment := client.hpack.Encode(fields)
+	if len(fragment) > 1000 {
+		t.Fatalf("Header block is not smaller than the limit, got %d bytes", len(fragment))
+	}
+	client.writeFrame(newTestHeadersFrame(1, fragment, true, true))
+
+	f := client.readFrame(t, frame.GoAwayType, 0)
+	if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.ProtocolError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+	}
+}
+
+func TestResetStreamHeadersDecoded(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Get("/other", func(req *http.Request, res *http.Response) {
+		res.String(200, "other")
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	// The stream depends on itself and is reset, but its header block adds "/other" to the dynamic table
+	f := newTestHeadersFrame(1, newEncodedTestHeaders(client.hpack, "/other", "GET"), true, true)
+	f.Flags.(*types.HeadersFlags).Priority = true
+	f.Payload.(*types.HeadersPayload).StreamDependency = 1
+	f.Length += 5
+	client.writeFrame(f)
+	rst := client.readFrame(t, frame.RstStreamType, 1)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.ProtocolError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+	}
+
+	// The next header block refers to the dynamic table entry
+	client.writeHeaders(3, "/other", "GET", true)
+	data := client.readFrame(t, frame.DataType, 3)
+	if body := string(data.Payload.(*types.DataPayload).Data); body != "other" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "other", body)
+	}
+}
+
+// ---------- HELPERS --------------
+
+func newTestHeadersFrame(streamID uint32, fragment []byte, endHeaders, endStream bool) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.HeadersType,
+		Flags:   &types.HeadersFlags{EndHeaders: endHeaders, EndStream: endStream},
+		Payload: &types.HeadersPayload{Fragment: fragment},
+		Length:  uint32(len(fragment)),
+	}
+}
+
+func newTestContinuationFrame(streamID uint32, fragment []byte, endHeaders bool) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.ContinuationType,
+		Flags:   &types.ContinuationFlags{EndHeaders: endHeaders},
+		Payload: &types.ContinuationPayload{HeaderFragment: fragment},
+		Length:  uint32(len(fragment)),
+	}
+}
+
+func newTestPingFrame() *frame.Frame {
+	return &frame.Frame{
+		Type:    frame.PingType,
+		Flags:   &types.PingFlags{},
+		Payload: &types.PingPayload{Data: make([]byte, 8)},
+		Length:  8,
+	}
+}
@@ -4,29 +4,52 @@ import (
 	"errors"
 	"fmt"
 	huff "github.com/SveinungOverland/opal/hpack/huffman"
+	"math"
 )
 
+// ErrHeaderListTooLarge is returned when a decoded header list is larger than the limit of the decoder
+var ErrHeaderListTooLarge = errors.New("hpack: Header list is too large")
+
 // Decoder manages the decoding of headerfields
 type Decoder struct {
-	dynTab *dynamicTable
+	dynTab      *dynamicTable
+	maxTabSize  uint32 // The largest size a dynamic table size update may set, as announced to the encoder
+	maxListSize uint32 // The largest decoded header list, zero means no limit
 
 	buf []byte // The current working buffer
 
-	onHeaderParsed func(hf *HeaderField) // A function for handling when a headerfield is successfully parsed
+	onHeaderParsed func(hf *HeaderField) error // A function for handling when a headerfield is successfully parsed
 }
 
 // NewDecoder creates a new decoder with given table size
 func NewDecoder(dynTabMaxSize uint32) *Decoder {
 	dynT := newDynamicTable(dynTabMaxSize)
 	return &Decoder{
-		dynTab: dynT,
+		dynTab:     dynT,
+		maxTabSize: dynTabMaxSize,
 	}
 }
 
+// SetMaxHeaderListSize limits the size of a decoded header list, which is the size of its fields counted
+// as in the dynamic table - RFC7540 Section 6.5.2. Decoding stops with ErrHeaderListTooLarge when the
+// limit is exceeded, and the decoder is then out of sync with the encoder. Zero means no limit.
+func (d *Decoder) SetMaxHeaderListSize(size uint32) {
+	d.maxListSize = size
+}
+
 // Decode decodes a byte array of headers
 func (d *Decoder) Decode(buf []byte) ([]*HeaderField, error) {
 	hfields := make([]*HeaderField, 0)
-	d.onHeaderParsed = func(hf *HeaderField) { hfields = append(hfields, hf) }
+	listSize := uint64(0)
+	d.onHeaderParsed = func(hf *HeaderField) error {
+		// Indexed fields are small encoded, so the size is checked as the list is decoded
+		listSize += uint64(hf.size())
+		if d.maxListSize != 0 && listSize > uint64(d.maxListSize) {
+			return ErrHeaderListTooLarge
+		}
+		hfields = append(hfields, hf)
+		return nil
+	}
 	err := d.decodeHeaders(buf)
 	if err != nil {
 		return nil, err
@@ -135,8 +158,7 @@ func (d *Decoder) parseIndexedField() error {
 	}
 
 	d.buf = buf
-	d.onHeaderParsed(hf) // Successfully parsed hf
-	return nil
+	return d.onHeaderParsed(hf) // Successfully parsed hf
 }
 
 // Parses an literal string
@@ -181,8 +203,7 @@ func (d *Decoder) parseLiteralString(n byte, hfRepr headerFieldRepr) error {
 		d.dynTab.addEntry(hf)
 	}
 
-	d.onHeaderParsed(hf) // Successfully parsed hf
-	return nil
+	return d.onHeaderParsed(hf) // Successfully parsed hf
 }
 
 /* 0   1   2   3   4   5   6   7
@@ -192,14 +213,16 @@ func (d *Decoder) parseLiteralString(n byte, hfRepr headerFieldRepr) error {
 
 // Sets the max size of the dynamic table
 func (d *Decoder) parseDynTabSizeUpdate() error {
-	// Might have to check if allowed to change dynamic table size? RFC7541 - Section 4.2
-
 	// Read new max size
 	buf := d.buf
 	size, buf, err := readLSBValue(5, buf)
 	if err != nil {
 		return err
 	}
+	if size > d.maxTabSize {
+		// The size must not exceed the limit set by the decoder - RFC7541 Section 6.3
+		return decodingError{fmt.Errorf("Dynamic table size update exceeds limit: %d", size)}
+	}
 
 	// Set max size
 	d.dynTab.setMaxSize(size)
@@ -229,6 +252,11 @@ func readLiteralString(buf []byte) (s string, remaining []byte, err error) {
 		return "", nil, err
 	}
 
+	// The length comes from the peer, and may be longer than the block
+	if stringLength > uint32(len(buf)) {
+		return "", nil, decodingError{fmt.Errorf("String length exceeds header block: %d", stringLength)}
+	}
+
 	// Read string value
 	// If is not huffman encoded, return the bytes in form of a string
 	if !isHuffman {
@@ -303,7 +331,12 @@ func readLSBValue(n byte, buf []byte) (uint32, []byte, error) {
 	for len(tempBuf) > 0 {
 		b := tempBuf[0]
 		tempBuf = tempBuf[1:]
-		value += uint32(b&127) << m //  I + (B & 127) * 2^M
+		sum := uint64(value) + uint64(b&127)<<m //  I + (B & 127) * 2^M
+		if m > 28 || sum > math.MaxUint32 {
+			// Values that do not fit in 32 bits are treated as decoding errors - RFC7541 Section 5.1
+			return 0, tempBuf, decodingError{errors.New("Integer overflow")}
+		}
+		value = uint32(sum)
 
 		// Check if MSB is 0, then it is done
 		if b&128 == 0 {
@@ -20,6 +20,53 @@ func TestDecode02(t *testing.T) {
 	testContextDecode(t, context, testData)
 }
 
+// TestDynTabSizeUpdateLimit tests that a dynamic table size update can not exceed the decoder's limit
+func TestDynTabSizeUpdateLimit(t *testing.T) {
+	decoder := NewDecoder(4096)
+	if _, err := decoder.Decode([]byte{0x3F, 0xE1, 0x1F}); err != nil { // Size update to 4096
+		t.Errorf("Size update within the limit failed: %v", err)
+	}
+	if _, err := decoder.Decode([]byte{0x3F, 0xE1, 0x3F}); err == nil { // Size update to 8192
+		t.Error("Size update above the limit was accepted")
+	}
+}
+
+// TestDecodeHeaderListLimit tests that the decoded size of a header list is limited, also when its fields are indexed
+func TestDecodeHeaderListLimit(t *testing.T) {
+	context := NewContext(4096, 4096)
+	hfs := []*HeaderField{&HeaderField{Name: "custom-key", Value: "custom-value"}} // 54 bytes in the dynamic table
+	for i := 0; i < 9; i++ {
+		hfs = append(hfs, hfs[0])
+	}
+	block := context.Encode(hfs)
+
+	decoder := NewDecoder(4096)
+	decoder.SetMaxHeaderListSize(539)
+	if _, err := decoder.Decode(block); err != ErrHeaderListTooLarge {
+		t.Errorf("Incorrect error! Expected %v, got %v", ErrHeaderListTooLarge, err)
+	}
+	decoder = NewDecoder(4096)
+	decoder.SetMaxHeaderListSize(540)
+	if decoded, err := decoder.Decode(block); err != nil || len(decoded) != len(hfs) {
+		t.Errorf("Header list within the limit was not decoded: %v", err)
+	}
+}
+
+// TestDecodeMalformed tests that malformed header blocks are rejected without panicking
+func TestDecodeMalformed(t *testing.T) {
+	blocks := [][]byte{
+		[]byte("A00000"), // Literal string longer than the block
+		{0x82, 0x7F},     // Integer without its continuation bytes
+		{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, // Integer overflowing 32 bits
+		{0x40, 0x85, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, // Invalid Huffman padding
+	}
+	for _, block := range blocks {
+		if _, err := NewDecoder(4096).Decode(block); err == nil {
+			t.Errorf("Malformed header block %x was accepted", block)
+		}
+	}
+}
+
 // ----- HELPERS -------
 
 func testContextDecode(t *testing.T, context *Context, testData []hpackTest) {
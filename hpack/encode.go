@@ -6,7 +6,9 @@ import (
 
 // Encoder manages the encoding of headerfields
 type Encoder struct {
-	dynTab *dynamicTable
+	dynTab      *dynamicTable
+	sizeUpdated bool   // Set when the table size has changed since the last header block
+	minTabSize  uint32 // The smallest table size set since the last header block
 
 	buf []byte // Current working buffer
 }
@@ -46,6 +48,39 @@ func (e *Encoder) EncodeField(hf *HeaderField) []byte {
 	return e.buf
 }
 
+// SetMaxDynamicTableSize changes the max size of the dynamic table, like when the decoder announces a new
+// SETTINGS_HEADER_TABLE_SIZE. The change is signaled at the start of the next header block - RFC7541 Section 4.2.
+func (e *Encoder) SetMaxDynamicTableSize(size uint32) {
+	if size == e.dynTab.maxSize && !e.sizeUpdated {
+		return
+	}
+	if !e.sizeUpdated || size < e.minTabSize {
+		e.minTabSize = size
+	}
+	e.sizeUpdated = true
+	e.dynTab.setMaxSize(size)
+}
+
+// EncodeWithoutIndexing encodes a set of headers as literals that are not added to the dynamic table. Only the
+// static table is referred to, so the headers can be decoded regardless of the state of the dynamic table.
+func EncodeWithoutIndexing(hfs []*HeaderField) []byte {
+	e := &Encoder{}
+	var bytes []byte
+	for _, hf := range hfs {
+		e.buf = make([]byte, 0)
+		idx, perfectMatch := findStaticHF(hf)
+		if perfectMatch {
+			e.encodeIndexed(idx)
+		} else if idx != 0 {
+			e.encodeFieldIndexed(hf, idx, false)
+		} else {
+			e.encodeField(hf, false)
+		}
+		bytes = append(bytes, e.buf...)
+	}
+	return bytes
+}
+
 func (e *Encoder) encodeIndexed(idx uint32) {
 	l := len(e.buf)
 	e.buf = applyIndexOrLength(e.buf, 7, idx)
@@ -89,6 +124,28 @@ func (e *Encoder) encodeField(hf *HeaderField, isIndexed bool) {
 }
 
 // ----- HELPERS -----
+
+// Returns the dynamic table size updates to send at the start of a header block, if the size has changed since
+// the last one. The smallest size is sent first, if the size was reduced and then increased - RFC7541 Section 4.2.
+func (e *Encoder) encodeSizeUpdate() []byte {
+	if !e.sizeUpdated {
+		return nil
+	}
+	e.sizeUpdated = false
+	var buf []byte
+	if e.minTabSize < e.dynTab.maxSize {
+		buf = appendSizeUpdate(buf, e.minTabSize)
+	}
+	return appendSizeUpdate(buf, e.dynTab.maxSize)
+}
+
+func appendSizeUpdate(buf []byte, size uint32) []byte {
+	l := len(buf)
+	buf = applyIndexOrLength(buf, 5, size)
+	buf[l] |= 0x20 // Sets the first bits to 001 -> 0x20 = 001x xxxx
+	return buf
+}
+
 func encodeLitrString(buf []byte, s string) []byte {
 	// Decode string with huffman
 	huffDecoded := huff.Encode([]byte(s))
@@ -25,6 +25,57 @@ func TestEncodeDecodeLongHeaders(t *testing.T) {
 	}
 }
 
+func TestEncodeWithoutIndexing(t *testing.T) {
+	hfs := []*HeaderField{
+		&HeaderField{Name: "grpc-status", Value: "0"},
+		&HeaderField{Name: "content-type", Value: "text/plain"},
+		&HeaderField{Name: ":method", Value: "GET"},
+	}
+	context := NewContext(4096, 4096)
+	decoded, err := context.Decode(EncodeWithoutIndexing(hfs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(decoded, hfs); diff != nil {
+		t.Error(diff)
+	}
+	if table := context.DecoderDynamicTable(); len(table) != 0 {
+		t.Errorf("Headers were added to the dynamic table: %v", table)
+	}
+}
+
+func TestEncodeDynamicTableSizeUpdate(t *testing.T) {
+	encoder := NewContext(4096, 4096)
+	decoder := NewContext(4096, 4096)
+	hfs := []*HeaderField{&HeaderField{Name: "custom-key", Value: "custom-value"}}
+	if _, err := decoder.Decode(encoder.Encode(hfs)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The table is emptied and then resized, and both sizes are signaled in the next block
+	encoder.Encoder.SetMaxDynamicTableSize(0)
+	encoder.Encoder.SetMaxDynamicTableSize(100)
+	block := encoder.Encode(hfs)
+	if block[0] != 0x20 {
+		t.Errorf("Block did not start with a size update to 0, got %x", block[0])
+	}
+	decoded, err := decoder.Decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(decoded, hfs); diff != nil {
+		t.Error(diff)
+	}
+	if decoder.Decoder.dynTab.maxSize != 100 {
+		t.Errorf("Incorrect table size of decoder. Expected %d, got %d", 100, decoder.Decoder.dynTab.maxSize)
+	}
+
+	// The size is only signaled once
+	if block := encoder.Encode(hfs); block[0]&0xe0 == 0x20 {
+		t.Error("Size update was signaled twice")
+	}
+}
+
 // ----- HELPERS ------
 
 // Tests encode and decode
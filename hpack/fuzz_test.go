@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package hpack
+
+import (
+	"encoding/hex"
+	"github.com/go-test/deep"
+	"testing"
+)
+
+/*
+	This file contains a fuzz target for decoding header blocks. Any header
+	block from a peer must be decoded or rejected with an error.
+*/
+
+func FuzzDecode(f *testing.F) {
+	for _, test := range append(getTestData01(), getTestData02()...) {
+		testBytes, _ := hex.DecodeString(test.hex)
+		f.Add(testBytes)
+	}
+	f.Add([]byte{0x3F, 0xE1, 0x1F}) // Size update to 4096
+	f.Add([]byte("A00000"))         // Literal string longer than the block
+
+	f.Fuzz(func(t *testing.T, block []byte) {
+		context := NewContext(256, 256)
+		hfs, err := context.Decode(block)
+		if err != nil {
+			return
+		}
+		context.Decode(block) // Decoded again with the entries it added to the dynamic table
+
+		// Decoded headers must survive being encoded and decoded again
+		roundTrip := NewContext(256, 256)
+		decoded, err := roundTrip.Decode(roundTrip.Encode(hfs))
+		if err != nil {
+			t.Fatalf("Encoded headers could not be decoded: %v", err)
+		}
+		if diff := deep.Equal(decoded, hfs); diff != nil {
+			t.Error(diff)
+		}
+	})
+}
@@ -34,9 +34,9 @@ func (c *Context) Decode(bytes []byte) ([]*HeaderField, error) {
 	return c.Decoder.Decode(bytes)
 }
 
-// Encode encodes a set of headers
+// Encode encodes a set of headers as a header block. A change of the dynamic table size is signaled first.
 func (c *Context) Encode(hfs []*HeaderField) []byte {
-	var bytes []byte
+	bytes := c.Encoder.encodeSizeUpdate()
 	for _, hf := range hfs {
 		buf := c.Encoder.EncodeField(hf)
 		bytes = append(bytes, buf...)
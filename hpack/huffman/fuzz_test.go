@@ -0,0 +1,33 @@
+//go:build go1.18
+// +build go1.18
+
+package huff
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+/*
+	This file contains a fuzz target for Huffman decoding. Any string
+	literal from a peer must be decoded or rejected with an error.
+*/
+
+func FuzzDecode(f *testing.F) {
+	for _, test := range testData {
+		encoded, _ := hex.DecodeString(test.encodedHex)
+		f.Add(encoded)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := Decode(data)
+		if err != nil {
+			return
+		}
+		// Decoded strings must survive being encoded and decoded again
+		if again, err := Decode(Encode(decoded)); err != nil || !bytes.Equal(again, decoded) {
+			t.Errorf("Decoded string %q was not encoded correctly. Got %q and error %v", decoded, again, err)
+		}
+	})
+}
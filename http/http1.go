@@ -0,0 +1,238 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/*
+	This file contains a minimal parser for HTTP/1.1 requests and
+	a writer for HTTP/1.1 responses, as described in RFC7230. It is
+	used for upgrading cleartext connections to HTTP/2 (h2c), and
+	for serving clients that does not speak HTTP/2.
+*/
+
+// ErrMalformedRequest is returned when a HTTP/1.1 request can not be parsed
+var ErrMalformedRequest = errors.New("malformed HTTP/1.1 request")
+
+// ErrBodyTooLarge is returned when the body of a request is larger than the limit
+var ErrBodyTooLarge = errors.New("request body is too large")
+
+// ErrHeaderTooLarge is returned when the header section of a HTTP/1.1 request has too many fields or bytes
+var ErrHeaderTooLarge = errors.New("HTTP/1.1 request header is too large")
+
+// ErrUnsupportedCoding is returned when a HTTP/1.1 request body has a transfer coding other than chunked
+var ErrUnsupportedCoding = errors.New("unsupported transfer coding")
+
+// MaxHeaderBytes is the largest header section of a HTTP/1.1 request that is read, not counting the request line
+const MaxHeaderBytes = 64 << 10
+
+// MaxHeaderFields is the largest number of header fields in a HTTP/1.1 request
+const MaxHeaderFields = 100
+
+// ReadRequest reads and parses a HTTP/1.1 request, including its body, from a reader. Bodies larger than
+// maxBodySize are not read, and the request is returned without a body along with ErrBodyTooLarge.
+// The request is also returned along with ErrHeaderTooLarge and ErrUnsupportedCoding, and along with
+// ErrMalformedRequest when the request line could be read, so the client can be answered.
+func ReadRequest(r *bufio.Reader, maxBodySize int64) (*Request, error) {
+	// Read request line - RFC7230 Section 3.1.1
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	requestLine := strings.SplitN(line, " ", 3)
+	if len(requestLine) != 3 || !strings.HasPrefix(requestLine[2], "HTTP/1.") {
+		return nil, ErrMalformedRequest
+	}
+
+	req := NewRequest()
+	req.Method = requestLine[0]
+	req.Proto = requestLine[2]
+	target := strings.SplitN(requestLine[1], "?", 2)
+	req.URI = target[0]
+	if len(target) > 1 {
+		req.RawQuery = "?" + target[1]
+	}
+
+	// Read header fields - RFC7230 Section 3.2. Multiple fields with the same name are combined.
+	values := make(map[string][]string)
+	fields, size := 0, 0
+	for {
+		line, err := readLine(r)
+		if err == bufio.ErrBufferFull {
+			return req, ErrHeaderTooLarge
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break // Empty line marks the end of the header section
+		}
+		fields++
+		size += len(line)
+		if fields > MaxHeaderFields || size > MaxHeaderBytes {
+			return req, ErrHeaderTooLarge
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return req, ErrMalformedRequest
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:colon]))
+		values[name] = append(values[name], strings.TrimSpace(line[colon+1:]))
+	}
+	for name, value := range values {
+		req.Header[name] = strings.Join(value, ", ")
+	}
+	req.Authority = req.Header["host"]
+
+	// Read body - RFC7230 Section 3.3.3
+	_, hasContentLength := req.Header["content-length"]
+	if te, ok := req.Header["transfer-encoding"]; ok {
+		// Messages with both are used for request smuggling, and chunked is the only supported coding
+		if hasContentLength {
+			return req, ErrMalformedRequest
+		}
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return req, ErrUnsupportedCoding
+		}
+		body, err := readChunked(r, maxBodySize)
+		if err == ErrBodyTooLarge {
+			return req, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	} else if hasContentLength {
+		length, err := strconv.ParseInt(req.Header["content-length"], 10, 64)
+		if err != nil || length < 0 {
+			return req, ErrMalformedRequest
+		}
+		if length > maxBodySize {
+			return req, ErrBodyTooLarge // Nothing is allocated for a body the client only claims to send
+		}
+		if req.Body, err = readBody(r, length); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+// WriteResponse writes a response in HTTP/1.1-format. The request is used for deciding
+// if a body should be written, as responses to HEAD-requests never have one.
+// Returns the number of body bytes written.
+func WriteResponse(w io.Writer, req *Request, res *Response) (int, error) {
+	bw := bufio.NewWriter(w)
+
+	// Write status line - RFC7230 Section 3.1.2
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", res.Status, StatusText(res.Status))
+
+	// Responses with status 1xx, 204 and 304 never include a body
+	hasBody := res.Status >= 200 && res.Status != 204 && res.Status != 304
+	hasContentLength := false
+	for name, value := range res.Header {
+		if strings.EqualFold(name, "content-length") {
+			hasContentLength = true
+		}
+		fmt.Fprintf(bw, "%s: %s\r\n", name, headerValueReplacer.Replace(value))
+	}
+	if hasBody && !hasContentLength {
+		fmt.Fprintf(bw, "content-length: %d\r\n", len(res.Body))
+	}
+	bw.WriteString("\r\n")
+
+	written := 0
+	if hasBody && req.Method != "HEAD" {
+		written, _ = bw.Write(res.Body)
+	}
+	return written, bw.Flush()
+}
+
+// HeaderContains checks if a comma-separated header contains a given token, case-insensitive
+func HeaderContains(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// ------- HELPERS ---------
+
+// Removes line breaks from header values, so they can not inject new header fields
+var headerValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Reads a body with chunked transfer coding - RFC7230 Section 4.1. The sum of the chunks may not exceed maxBodySize.
+func readChunked(r *bufio.Reader, maxBodySize int64) ([]byte, error) {
+	body := make([]byte, 0)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		// Chunk extensions are ignored
+		sizeField := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		size, err := strconv.ParseUint(sizeField, 16, 31)
+		if err != nil {
+			return nil, ErrMalformedRequest
+		}
+		if size == 0 {
+			break
+		}
+
+		if int64(len(body))+int64(size) > maxBodySize {
+			return nil, ErrBodyTooLarge
+		}
+		chunk, err := readBody(r, int64(size))
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, chunk...)
+
+		// Every chunk ends with CRLF
+		if line, err := readLine(r); err != nil || line != "" {
+			return nil, ErrMalformedRequest
+		}
+	}
+
+	// Skip trailer section
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return body, nil
+		}
+	}
+}
+
+// Reads a body of a given length. The buffer grows as data arrives, so a length that is
+// claimed but never sent is not allocated.
+func readBody(r io.Reader, length int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return body, nil
+}
+
+// Reads a single line, without the trailing CRLF. Lines longer than the reader's
+// buffer results in bufio.ErrBufferFull.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
@@ -0,0 +1,167 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadRequest(t *testing.T) {
+	raw := "POST /test/path?name=anders HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Accept: text/html\r\n" +
+		"accept: application/json\r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"TEST"
+
+	req, err := ReadRequest(bufio.NewReader(strings.NewReader(raw)), 1024)
+	if err != nil {
+		t.Fatalf("Could not read request: %v", err)
+	}
+	if req.Method != "POST" {
+		t.Errorf("Incorrect method. Expected %s, got %s", "POST", req.Method)
+	}
+	if req.URI != "/test/path" {
+		t.Errorf("Incorrect URI. Expected %s, got %s", "/test/path", req.URI)
+	}
+	testQuery(t, req, "name", "anders")
+	if req.Authority != "example.com" {
+		t.Errorf("Incorrect authority. Expected %s, got %s", "example.com", req.Authority)
+	}
+	if req.Header["accept"] != "text/html, application/json" {
+		t.Errorf("Headers were not combined. Got %s", req.Header["accept"])
+	}
+	if string(req.Body) != "TEST" {
+		t.Errorf("Incorrect body. Expected %s, got %s", "TEST", string(req.Body))
+	}
+}
+
+func TestReadMalformedRequest(t *testing.T) {
+	raws := []string{
+		"GET /\r\n\r\n",
+		"GET / HTTP/2.0\r\n\r\n",
+		"GET / HTTP/1.1\r\nInvalid header\r\n\r\n",
+		"GET / HTTP/1.1\r\nContent-Length: abc\r\n\r\n",
+		"GET / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		"GET / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nshort",
+	}
+	for _, raw := range raws {
+		if _, err := ReadRequest(bufio.NewReader(strings.NewReader(raw)), 1024); err == nil {
+			t.Errorf("Expected an error when reading %q", raw)
+		}
+	}
+}
+
+func TestReadRequestBodyTooLarge(t *testing.T) {
+	raws := []string{
+		"POST / HTTP/1.1\r\nContent-Length: 9223372036854775807\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 1025\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n7fffffff\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + strings.Repeat("100\r\n"+strings.Repeat("a", 256)+"\r\n", 4) + "1\r\na\r\n0\r\n\r\n",
+	}
+	for _, raw := range raws {
+		req, err := ReadRequest(bufio.NewReader(strings.NewReader(raw)), 1024)
+		if err != ErrBodyTooLarge {
+			t.Errorf("Incorrect error when reading %q. Expected %v, got %v", raw[:40], ErrBodyTooLarge, err)
+		}
+		if req == nil || req.Method != "POST" {
+			t.Error("Request was not returned along with ErrBodyTooLarge")
+		}
+	}
+}
+
+func TestReadRequestHeaderTooLarge(t *testing.T) {
+	raws := []string{
+		"GET / HTTP/1.1\r\n" + strings.Repeat("Accept: */*\r\n", MaxHeaderFields+1) + "\r\n",
+		"GET / HTTP/1.1\r\n" + strings.Repeat("Cookie: "+strings.Repeat("a", 1000)+"\r\n", MaxHeaderBytes/1000+1) + "\r\n",
+		"GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", 8192) + "\r\n\r\n",
+	}
+	for _, raw := range raws {
+		req, err := ReadRequest(bufio.NewReader(strings.NewReader(raw)), 1024)
+		if err != ErrHeaderTooLarge {
+			t.Errorf("Incorrect error when reading %q. Expected %v, got %v", raw[:40], ErrHeaderTooLarge, err)
+		}
+		if req == nil || req.Method != "GET" {
+			t.Error("Request was not returned along with ErrHeaderTooLarge")
+		}
+	}
+}
+
+func TestReadRequestTransferEncoding(t *testing.T) {
+	tests := map[string]error{
+		"Transfer-Encoding: Chunked\r\n\r\n0\r\n\r\n":                      nil,
+		"Transfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n": ErrMalformedRequest,
+		"Transfer-Encoding: gzip\r\n\r\n":                                  ErrUnsupportedCoding,
+		"Transfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n":                ErrUnsupportedCoding,
+	}
+	for headers, expected := range tests {
+		raw := "POST / HTTP/1.1\r\n" + headers
+		if _, err := ReadRequest(bufio.NewReader(strings.NewReader(raw)), 1024); err != expected {
+			t.Errorf("Incorrect error when reading %q. Expected %v, got %v", raw, expected, err)
+		}
+	}
+}
+
+func TestHeaderContains(t *testing.T) {
+	if !HeaderContains("Upgrade, HTTP2-Settings", "upgrade") {
+		t.Error("Token upgrade was not found")
+	}
+	if HeaderContains("keep-alive", "upgrade") {
+		t.Error("Token upgrade was found, but should not")
+	}
+}
+
+func TestReadChunkedRequest(t *testing.T) {
+	raw := "POST / HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"4;ext=1\r\nTEST\r\n" +
+		"7\r\n_RESULT\r\n" +
+		"0\r\n" +
+		"Trailer: value\r\n" +
+		"\r\n"
+
+	req, err := ReadRequest(bufio.NewReader(strings.NewReader(raw)), 1024)
+	if err != nil {
+		t.Fatalf("Could not read request: %v", err)
+	}
+	if string(req.Body) != "TEST_RESULT" {
+		t.Errorf("Incorrect body. Expected %s, got %s", "TEST_RESULT", string(req.Body))
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	req := NewRequest()
+	req.Method = "GET"
+	res := NewResponse(req)
+	res.String(404, "Not here")
+
+	var buf bytes.Buffer
+	written, err := WriteResponse(&buf, req, res)
+	if err != nil {
+		t.Fatalf("Could not write response: %v", err)
+	}
+	if written != 8 {
+		t.Errorf("Incorrect number of body bytes written. Expected %d, got %d", 8, written)
+	}
+
+	expected := "HTTP/1.1 404 Not Found\r\n" +
+		"content-type: text/plain; charset=utf-8\r\n" +
+		"content-length: 8\r\n" +
+		"\r\n" +
+		"Not here"
+	if buf.String() != expected {
+		t.Errorf("Incorrect response. Expected %q, got %q", expected, buf.String())
+	}
+
+	// Responses to HEAD requests should not include a body
+	buf.Reset()
+	req.Method = "HEAD"
+	written, _ = WriteResponse(&buf, req, res)
+	if strings.HasSuffix(buf.String(), "Not here") || written != 0 {
+		t.Error("Response to HEAD request included a body")
+	}
+}
@@ -1,7 +1,11 @@
 package http
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"strings"
 )
 
@@ -14,12 +18,17 @@ type Request struct {
 	URI       string
 	Authority string // Host
 	Scheme    string
+	Proto     string // The protocol version, "HTTP/2" or "HTTP/1.1"
+	Protocol  string // The protocol of an extended CONNECT request, like "websocket" - RFC8441
 	RawQuery  string
 	Params    map[string]string
 	Header    map[string]string
 	Body      []byte
+	Trailer   map[string]string // Headers sent after the body. Complete when the body is fully read
 
-	finished bool // Bool for deciding if next request can be handled
+	bodyReader io.ReadCloser   // Reader of the body as it is received
+	ctx        context.Context // Cancelled when the client does not want the response anymore
+	finished   bool            // Bool for deciding if next request can be handled
 }
 
 // JSON parses the request body as JSON into a target interface.
@@ -57,6 +66,35 @@ func (r *Request) Param(name string) string {
 	return r.Params[name]
 }
 
+// BodyReader returns a reader of the request body. On streaming routes the body is read as it
+// is received, and Body is empty. Otherwise it reads Body.
+func (r *Request) BodyReader() io.ReadCloser {
+	if r.bodyReader == nil {
+		return ioutil.NopCloser(bytes.NewReader(r.Body))
+	}
+	return r.bodyReader
+}
+
+// SetBodyReader sets the reader of a body that is not received yet
+func (r *Request) SetBodyReader(body io.ReadCloser) {
+	r.bodyReader = body
+}
+
+// Context returns the context of the request. It is cancelled when the client resets the stream,
+// or the connection is closed. It defaults to context.Background().
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the context of the request, like when a middleware adds request-scoped values.
+// The new context should be derived from the request's context, so it is still cancelled.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
 // Finish makes the request finished. Which means next handler in the function won't run.
 func (r *Request) Finish() {
 	r.finished = true
@@ -75,6 +113,7 @@ func NewRequest() *Request {
 		finished: false,
 		Body:     make([]byte, 0),
 		Header:   make(map[string]string),
+		Trailer:  make(map[string]string),
 		Params:   make(map[string]string),
 	}
 	return req
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"context"
 	"testing"
 )
 
@@ -16,7 +17,23 @@ func TestRequestQuery(t *testing.T) {
 	testQuery(t, req, "tokentoken", "asdfasdf%20asdfasdf%20")
 }
 
+func TestRequestContext(t *testing.T) {
+	req := NewRequest()
+	if req.Context() != context.Background() {
+		t.Error("Request without a context does not default to context.Background()")
+	}
+	ctx := context.WithValue(req.Context(), testContextKey{}, "value")
+	req.SetContext(ctx)
+	if req.Context().Value(testContextKey{}) != "value" {
+		t.Error("Request context was not replaced")
+	}
+}
+
 // -------- HELPERS -------
+
+// testContextKey is the key of the value stored in a request context by the tests
+type testContextKey struct{}
+
 func testQuery(t *testing.T, req *Request, name, expected string) {
 	actual := req.Query(name)
 	if actual != expected {
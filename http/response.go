@@ -10,11 +10,30 @@ import (
 	"strings"
 )
 
+// StreamWriter writes a response to the client as it is built. It is set by the server
+// on responses that can be streamed.
+type StreamWriter interface {
+	// WriteHeader sends the status and headers of the response
+	WriteHeader(status uint16, header map[string]string) error
+
+	// WriteData sends a part of the body, and returns when it is written
+	WriteData(data []byte) error
+
+	// Done returns a channel that is closed when the response can not be written anymore,
+	// like when the client has disconnected
+	Done() <-chan struct{}
+}
+
 // Response represents a http-response
 type Response struct {
 	Status uint16
-	Body   []byte
+	Body   []byte // Written to the client when the handlers are done, or when Flush is called
 	Header map[string]string
+	// Trailer is sent after the body, as the last frame of the stream. Trailers are only sent over HTTP/2
+	Trailer map[string]string
+
+	writer    StreamWriter // Nil if the response can not be streamed
+	committed bool         // Set when the status and headers are sent
 
 	// RFC 7540 - Section 8.2 - Server Push
 	req         *Request     // Requests corresponding to the Response. Is used for Server Push
@@ -102,6 +121,50 @@ func (res *Response) NotFound() {
 	res.Status = 404
 }
 
+// ----- STREAMING ------
+
+// Write appends data to the body. The data is sent to the client at the next call to Flush.
+func (res *Response) Write(p []byte) (int, error) {
+	res.Body = append(res.Body, p...)
+	return len(p), nil
+}
+
+// Flush sends the body written so far to the client. The status and headers are sent at the first
+// call, and can not be changed afterwards. If the response can not be streamed, like on HTTP/1.1
+// connections, Flush does nothing and the whole body is sent when the handlers are done.
+func (res *Response) Flush() error {
+	if res.writer == nil {
+		return nil
+	}
+	if !res.committed {
+		res.committed = true
+		if err := res.writer.WriteHeader(res.Status, res.Header); err != nil {
+			return err
+		}
+	}
+	if len(res.Body) == 0 {
+		return nil
+	}
+	body := res.Body
+	res.Body = nil // The writer may keep the flushed body
+	return res.writer.WriteData(body)
+}
+
+// Committed says if the status and headers are sent to the client
+func (res *Response) Committed() bool {
+	return res.committed
+}
+
+// SetStreamWriter sets the writer used by Flush
+func (res *Response) SetStreamWriter(writer StreamWriter) {
+	res.writer = writer
+}
+
+// StreamWriter returns the writer used by Flush, nil if the response can not be streamed
+func (res *Response) StreamWriter() StreamWriter {
+	return res.writer
+}
+
 // ------ SERVER PUSH ---------
 
 // Push performs a push server
@@ -127,10 +190,11 @@ func (res *Response) PushRequests() []*Request {
 // NewResponse creates a new response
 func NewResponse(req *Request) *Response {
 	res := &Response{
-		Status: 200,
-		Body:   make([]byte, 0),
-		Header: make(map[string]string),
-		req:    req,
+		Status:  200,
+		Body:    make([]byte, 0),
+		Header:  make(map[string]string),
+		Trailer: make(map[string]string),
+		req:     req,
 	}
 	res.Header["content-type"] = "text/plain; charset=utf-8"
 	return res
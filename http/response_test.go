@@ -47,6 +47,57 @@ func TestResponseJSON(t *testing.T) {
 }
 
 // -------- HELPERS ----------
+func TestResponseFlush(t *testing.T) {
+	res := NewResponse(nil)
+
+	// Without a StreamWriter, the body is only buffered
+	res.Write([]byte("A"))
+	if err := res.Flush(); err != nil || res.Committed() {
+		t.Error("Response without a StreamWriter was flushed")
+	}
+
+	writer := &testStreamWriter{}
+	res.SetStreamWriter(writer)
+	res.Status = 202
+	res.Write([]byte("B"))
+	res.Flush()
+	res.Write([]byte("C"))
+	res.Flush()
+
+	if !res.Committed() || writer.status != 202 || writer.headers != 1 {
+		t.Errorf("Headers were not sent once with the correct status. Got status %d, sent %d times", writer.status, writer.headers)
+	}
+	if string(writer.data) != "ABC" {
+		t.Errorf("Incorrect data flushed! Expected %s, got %s", "ABC", writer.data)
+	}
+	if len(res.Body) != 0 {
+		t.Error("Flushed data is still in the body")
+	}
+}
+
+// ----- HELPERS -----
+
+type testStreamWriter struct {
+	status  uint16
+	headers int
+	data    []byte
+}
+
+func (w *testStreamWriter) WriteHeader(status uint16, header map[string]string) error {
+	w.status = status
+	w.headers++
+	return nil
+}
+
+func (w *testStreamWriter) WriteData(data []byte) error {
+	w.data = append(w.data, data...)
+	return nil
+}
+
+func (w *testStreamWriter) Done() <-chan struct{} {
+	return nil
+}
+
 func checkResStatus(t *testing.T, res *Response, expected uint16) {
 	if res.Status != expected {
 		t.Errorf("Response has incorrect status code. Expected %d, got %d", expected, res.Status)
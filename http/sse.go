@@ -0,0 +1,93 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotStreamable is returned when streaming a response that can not be streamed, like on HTTP/1.1 connections
+var ErrNotStreamable = errors.New("response can not be streamed")
+
+// Event is a Server-Sent Event. Empty fields, except Data, are not sent.
+type Event struct {
+	ID    string
+	Event string // The type of the event
+	Data  string // Data containing newlines is sent on multiple data-lines
+	Retry time.Duration
+}
+
+// EventStream sends Server-Sent Events on a streamed response, as described by the HTML Living Standard
+type EventStream struct {
+	res *Response
+}
+
+// EventStream starts an event stream on the response, and sends the headers.
+// Returns ErrNotStreamable if the response can not be streamed.
+func (res *Response) EventStream() (*EventStream, error) {
+	if res.writer == nil {
+		return nil, ErrNotStreamable
+	}
+	res.Header["content-type"] = "text/event-stream"
+	res.Header["cache-control"] = "no-cache"
+	if err := res.Flush(); err != nil {
+		return nil, err
+	}
+	return &EventStream{res: res}, nil
+}
+
+// Send sends an event, and returns when it is written
+func (es *EventStream) Send(e Event) error {
+	var buf bytes.Buffer
+	if e.ID != "" {
+		writeField(&buf, "id", e.ID)
+	}
+	if e.Event != "" {
+		writeField(&buf, "event", e.Event)
+	}
+	if e.Retry > 0 {
+		writeField(&buf, "retry", strconv.FormatInt(int64(e.Retry/time.Millisecond), 10))
+	}
+	lines := strings.Split(strings.Replace(e.Data, "\r\n", "\n", -1), "\n")
+	for _, line := range lines {
+		writeField(&buf, "data", line)
+	}
+	buf.WriteByte('\n')
+	return es.write(buf.Bytes())
+}
+
+// Comment sends a comment, which is ignored by the client
+func (es *EventStream) Comment(comment string) error {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(comment, "\n") {
+		buf.WriteString(":" + strings.TrimRight(line, "\r") + "\n")
+	}
+	buf.WriteByte('\n')
+	return es.write(buf.Bytes())
+}
+
+// Heartbeat sends an empty comment, which keeps the stream from being closed by idle timeouts
+func (es *EventStream) Heartbeat() error {
+	return es.write([]byte(":\n\n"))
+}
+
+// Done returns a channel that is closed when the client has disconnected
+func (es *EventStream) Done() <-chan struct{} {
+	return es.res.writer.Done()
+}
+
+// ----- HELPERS -----
+
+func (es *EventStream) write(p []byte) error {
+	es.res.Write(p)
+	return es.res.Flush()
+}
+
+// WriteField writes a field, where newlines in the value would break the event
+func writeField(buf *bytes.Buffer, name, value string) {
+	value = strings.Replace(value, "\r", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	buf.WriteString(name + ": " + value + "\n")
+}
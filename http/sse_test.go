@@ -0,0 +1,36 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	res := NewResponse(nil)
+	if _, err := res.EventStream(); err != ErrNotStreamable {
+		t.Errorf("Event stream was started without a StreamWriter. Expected %v, got %v", ErrNotStreamable, err)
+	}
+
+	writer := &testStreamWriter{}
+	res.SetStreamWriter(writer)
+	es, err := res.EventStream()
+	if err != nil {
+		t.Fatalf("Starting event stream failed: %v", err)
+	}
+	if writer.headers != 1 || res.Header["content-type"] != "text/event-stream" {
+		t.Error("Event stream headers were not sent")
+	}
+
+	es.Send(Event{ID: "1", Event: "update", Data: "line1\nline2", Retry: 2 * time.Second})
+	es.Send(Event{Data: "injected\r\nid: 2"})
+	es.Comment("ping")
+	es.Heartbeat()
+
+	expected := "id: 1\nevent: update\nretry: 2000\ndata: line1\ndata: line2\n\n" +
+		"data: injected\ndata: id: 2\n\n" +
+		":ping\n\n" +
+		":\n\n"
+	if string(writer.data) != expected {
+		t.Errorf("Incorrect events written! Expected %q, got %q", expected, writer.data)
+	}
+}
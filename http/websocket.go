@@ -0,0 +1,296 @@
+package http
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+	This file contains WebSockets over HTTP/2, as described by RFC8441.
+	The client opens a WebSocket with an extended CONNECT request, and
+	the WebSocket frames of RFC6455 are sent in the DATA frames of the
+	stream.
+*/
+
+// MessageType is the type of a WebSocket message
+type MessageType byte
+
+// The types of data messages, with the value of their opcode
+const (
+	TextMessage   MessageType = 0x1
+	BinaryMessage MessageType = 0x2
+)
+
+// Opcodes of the WebSocket frames that are not data messages
+const (
+	continuationFrame = 0x0
+	closeFrame        = 0x8
+	pingFrame         = 0x9
+	pongFrame         = 0xA
+)
+
+// Status codes of close frames - RFC6455 Section 7.4.1
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	CloseMessageTooBig   = 1009
+)
+
+// DefaultMaxMessageSize is the largest message a WebSocket receives by default
+const DefaultMaxMessageSize = 32 << 20
+
+// ErrNotWebSocket is returned when opening a WebSocket on a request that is not an extended CONNECT request for a WebSocket
+var ErrNotWebSocket = errors.New("request is not a websocket request")
+
+// ErrWebSocketClosed is returned when writing to a WebSocket that is closed
+var ErrWebSocketClosed = errors.New("websocket is closed")
+
+// CloseError is returned by ReadMessage when the client closes the WebSocket
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// WebSocket is a message-oriented connection on a HTTP/2 stream. One goroutine may read
+// messages while another writes messages.
+type WebSocket struct {
+	res            *Response
+	r              io.Reader
+	MaxMessageSize int // Larger messages close the WebSocket with CloseMessageTooBig
+
+	mu         sync.Mutex // Guards writing to the response
+	sentClose  bool       // Set when a close frame is sent, nothing is written afterwards
+	readClosed bool       // Set when a close frame is received, or reading failed
+}
+
+// WebSocket accepts an extended CONNECT request for a WebSocket, and sends the headers.
+// Returns ErrNotWebSocket if the request is not a WebSocket request, and ErrNotStreamable
+// if the response can not be streamed.
+func (res *Response) WebSocket() (*WebSocket, error) {
+	req := res.req
+	if req == nil || req.Method != "CONNECT" || req.Protocol != "websocket" {
+		return nil, ErrNotWebSocket
+	}
+	if req.Header["sec-websocket-version"] != "13" {
+		res.Header["sec-websocket-version"] = "13"
+		return nil, ErrNotWebSocket
+	}
+	if res.writer == nil {
+		return nil, ErrNotStreamable
+	}
+	res.Status = 200
+	delete(res.Header, "content-type")
+	if err := res.Flush(); err != nil {
+		return nil, err
+	}
+	return &WebSocket{res: res, r: req.BodyReader(), MaxMessageSize: DefaultMaxMessageSize}, nil
+}
+
+// ReadMessage reads the next data message. Pings are answered while reading. Returns a
+// *CloseError when the client closes the WebSocket, or when it is closed because the client broke the protocol.
+func (ws *WebSocket) ReadMessage() (MessageType, []byte, error) {
+	if ws.readClosed {
+		return 0, nil, ErrWebSocketClosed
+	}
+	var msgType MessageType
+	var msg []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			ws.readClosed = true
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case pingFrame:
+			ws.writeFrame(pongFrame, payload)
+			continue
+		case pongFrame:
+			continue
+		case closeFrame:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(payload) == 1 {
+				return 0, nil, ws.fail(CloseProtocolError, "close frame with a partial status code")
+			}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+				if !validCloseCode(closeErr.Code) {
+					return 0, nil, ws.fail(CloseProtocolError, "invalid close status code")
+				}
+				if !utf8.ValidString(closeErr.Reason) {
+					return 0, nil, ws.fail(CloseInvalidPayload, "close reason is not valid UTF-8")
+				}
+			}
+			ws.readClosed = true
+			ws.Close(closeErr.Code, "") // The close frame is answered - RFC6455 Section 5.5.1
+			return 0, nil, closeErr
+		case continuationFrame:
+			if msgType == 0 {
+				return 0, nil, ws.fail(CloseProtocolError, "continuation frame without a message")
+			}
+		case byte(TextMessage), byte(BinaryMessage):
+			if msgType != 0 {
+				return 0, nil, ws.fail(CloseProtocolError, "message is interrupted by a new message")
+			}
+			msgType = MessageType(opcode)
+		default:
+			return 0, nil, ws.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		if len(msg)+len(payload) > ws.MaxMessageSize {
+			return 0, nil, ws.fail(CloseMessageTooBig, "message is too big")
+		}
+		msg = append(msg, payload...)
+		if !fin {
+			continue
+		}
+		if msgType == TextMessage && !utf8.Valid(msg) {
+			return 0, nil, ws.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+		}
+		return msgType, msg, nil
+	}
+}
+
+// WriteMessage sends a data message, and returns when it is written
+func (ws *WebSocket) WriteMessage(msgType MessageType, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", msgType)
+	}
+	return ws.writeFrame(byte(msgType), data)
+}
+
+// Ping sends a ping, which the client answers with a pong
+func (ws *WebSocket) Ping(data []byte) error {
+	return ws.writeFrame(pingFrame, data)
+}
+
+// Close sends a close frame. Messages can still be read until the client answers with a close frame.
+func (ws *WebSocket) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if code == CloseNoStatus {
+		payload = nil // The status is only used when no status was received, and is never sent
+	}
+	return ws.writeFrame(closeFrame, payload)
+}
+
+// Done returns a channel that is closed when the stream of the WebSocket is closed
+func (ws *WebSocket) Done() <-chan struct{} {
+	return ws.res.writer.Done()
+}
+
+// ------- HELPERS ---------
+
+// ReadFrame reads a WebSocket frame, and unmasks the payload. Frames from the client must be masked.
+func (ws *WebSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.r, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return fin, opcode, nil, ws.fail(CloseProtocolError, "reserved bits are set")
+	}
+	if header[1]&0x80 == 0 {
+		return fin, opcode, nil, ws.fail(CloseProtocolError, "frame is not masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= closeFrame && (length > 125 || !fin) {
+		// Control frames are short, and are not fragmented - RFC6455 Section 5.5
+		return fin, opcode, nil, ws.fail(CloseProtocolError, "invalid control frame")
+	}
+	if length > uint64(ws.MaxMessageSize) {
+		return fin, opcode, nil, ws.fail(CloseMessageTooBig, "message is too big")
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteFrame sends a single unmasked WebSocket frame
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.sentClose {
+		return ErrWebSocketClosed
+	}
+	if opcode == closeFrame {
+		ws.sentClose = true
+	}
+
+	header := []byte{0x80 | opcode, 0}
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	ws.res.Write(header)
+	ws.res.Write(payload)
+	return ws.res.Flush()
+}
+
+// ValidCloseCode checks if a status code may be received in a close frame. The codes 1005 and 1006
+// are only used locally, and codes below 3000 must be defined by the protocol - RFC6455 Section 7.4
+func validCloseCode(code int) bool {
+	if code >= 3000 && code <= 4999 {
+		return true // Used by libraries, frameworks and applications
+	}
+	if code < 1000 || code > 1014 {
+		return false
+	}
+	return code != 1004 && code != CloseNoStatus && code != 1006
+}
+
+// Fail closes the WebSocket because the client broke the protocol, and returns the error
+func (ws *WebSocket) fail(code int, reason string) error {
+	ws.readClosed = true
+	ws.Close(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
@@ -0,0 +1,160 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWebSocketRequest(t *testing.T) {
+	tests := map[string]struct {
+		method   string
+		protocol string
+		version  string
+		err      error
+	}{
+		"not connect": {"GET", "websocket", "13", ErrNotWebSocket},
+		"no protocol": {"CONNECT", "", "13", ErrNotWebSocket},
+		"old version": {"CONNECT", "websocket", "8", ErrNotWebSocket},
+		"valid":       {"CONNECT", "websocket", "13", nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := NewRequest()
+			req.Method = test.method
+			req.Protocol = test.protocol
+			req.Header["sec-websocket-version"] = test.version
+			res := NewResponse(req)
+			writer := &testStreamWriter{}
+			res.SetStreamWriter(writer)
+
+			if _, err := res.WebSocket(); err != test.err {
+				t.Fatalf("Incorrect error! Expected %v, got %v", test.err, err)
+			}
+			if test.err == nil && (writer.headers != 1 || writer.status != 200) {
+				t.Error("WebSocket headers were not sent")
+			}
+		})
+	}
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	ws, writer := newTestWebSocket(
+		newClientFrame(false, 0x1, "hel"),
+		newClientFrame(true, pingFrame, "ping"), // Control frames may be sent between the fragments of a message
+		newClientFrame(true, continuationFrame, "lo"),
+		newClientFrame(true, 0x2, "\x00\x01"),
+		newClientFrame(true, closeFrame, "\x03\xe8bye"),
+	)
+
+	msgType, msg, err := ws.ReadMessage()
+	if err != nil || msgType != TextMessage || string(msg) != "hello" {
+		t.Errorf("Incorrect message! Expected %q, got %q with error %v", "hello", msg, err)
+	}
+	msgType, msg, err = ws.ReadMessage()
+	if err != nil || msgType != BinaryMessage || string(msg) != "\x00\x01" {
+		t.Errorf("Incorrect message! Expected %q, got %q with error %v", "\x00\x01", msg, err)
+	}
+	ws.WriteMessage(TextMessage, []byte("reply"))
+	_, _, err = ws.ReadMessage()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != CloseNormalClosure || closeErr.Reason != "bye" {
+		t.Errorf("Incorrect close error! Expected code %d, got %v", CloseNormalClosure, err)
+	}
+	if err := ws.WriteMessage(TextMessage, []byte("too late")); err != ErrWebSocketClosed {
+		t.Errorf("Message was written after close. Expected %v, got %v", ErrWebSocketClosed, err)
+	}
+
+	// The ping is answered, and the close frame is answered with the same status
+	expected := "\x8a\x04ping" + "\x81\x05reply" + "\x88\x02\x03\xe8"
+	if string(writer.data) != expected {
+		t.Errorf("Incorrect frames written! Expected %q, got %q", expected, writer.data)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	unmasked := newClientFrame(true, 0x1, "hello")
+	unmasked[1] &^= 0x80
+	tests := map[string]struct {
+		frame []byte
+		code  int
+	}{
+		"unmasked":           {unmasked, CloseProtocolError},
+		"reserved bits":      {append([]byte{0xc1}, newClientFrame(true, 0x1, "hello")[1:]...), CloseProtocolError},
+		"invalid utf-8":      {newClientFrame(true, 0x1, "\xff"), CloseInvalidPayload},
+		"too big":            {newClientFrame(true, 0x2, string(make([]byte, 20))), CloseMessageTooBig},
+		"unexpected":         {newClientFrame(true, continuationFrame, "hello"), CloseProtocolError},
+		"fragmented control": {newClientFrame(false, pingFrame, "ping"), CloseProtocolError},
+		"partial close code": {newClientFrame(true, closeFrame, "\x03"), CloseProtocolError},
+		"close with 1005":    {newClientFrame(true, closeFrame, "\x03\xed"), CloseProtocolError},
+		"close with 1006":    {newClientFrame(true, closeFrame, "\x03\xee"), CloseProtocolError},
+		"close with 999":     {newClientFrame(true, closeFrame, "\x03\xe7"), CloseProtocolError},
+		"close with 2000":    {newClientFrame(true, closeFrame, "\x07\xd0"), CloseProtocolError},
+		"close with 5000":    {newClientFrame(true, closeFrame, "\x13\x88"), CloseProtocolError},
+		"close reason utf-8": {newClientFrame(true, closeFrame, "\x03\xe8\xff"), CloseInvalidPayload},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ws, writer := newTestWebSocket(test.frame)
+			ws.MaxMessageSize = 10
+			_, _, err := ws.ReadMessage()
+			if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != test.code {
+				t.Fatalf("Incorrect close error! Expected code %d, got %v", test.code, err)
+			}
+			if len(writer.data) < 4 || writer.data[0] != 0x88 || int(writer.data[2])<<8|int(writer.data[3]) != test.code {
+				t.Errorf("WebSocket was not closed with code %d, got %q", test.code, writer.data)
+			}
+		})
+	}
+}
+
+func TestValidCloseCode(t *testing.T) {
+	tests := map[int]bool{
+		999: false, 1000: true, 1003: true, 1004: false, 1005: false, 1006: false,
+		1007: true, 1011: true, 1015: false, 2999: false, 3000: true, 4999: true, 5000: false,
+	}
+	for code, valid := range tests {
+		if validCloseCode(code) != valid {
+			t.Errorf("Incorrect validity of close code %d. Expected %t", code, valid)
+		}
+	}
+}
+
+func TestWebSocketEndOfStream(t *testing.T) {
+	ws, _ := newTestWebSocket()
+	if _, _, err := ws.ReadMessage(); err != io.EOF {
+		t.Errorf("Incorrect error! Expected %v, got %v", io.EOF, err)
+	}
+}
+
+// ------- HELPERS ---------
+
+// NewTestWebSocket creates a WebSocket reading the given frames
+func newTestWebSocket(frames ...[]byte) (*WebSocket, *testStreamWriter) {
+	req := NewRequest()
+	req.Method = "CONNECT"
+	req.Protocol = "websocket"
+	req.Header["sec-websocket-version"] = "13"
+	req.SetBodyReader(ioutil.NopCloser(bytes.NewReader(bytes.Join(frames, nil))))
+	res := NewResponse(req)
+	writer := &testStreamWriter{}
+	res.SetStreamWriter(writer)
+	ws, _ := res.WebSocket()
+	return ws, writer
+}
+
+// NewClientFrame creates a masked WebSocket frame, as sent by clients
+func newClientFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{first, 0x80 | byte(len(payload))}, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
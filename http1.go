@@ -0,0 +1,110 @@
+package opal
+
+import (
+	"context"
+	"github.com/SveinungOverland/opal/http"
+	"runtime/debug"
+	"time"
+)
+
+/*
+	This file contains the serving of clients that does not speak
+	HTTP/2. Requests are served by the same router and middlewares
+	as HTTP/2 requests, but one request at a time.
+*/
+
+// ServeHTTP1 serves HTTP/1.1 requests on the connection until the client, or the server, closes it.
+// The first request has already been read while detecting the protocol.
+func (c *Conn) serveHTTP1(req *http.Request) {
+	c.mu.Lock()
+	c.isHTTP1 = true
+	c.mu.Unlock()
+
+	// A panic outside the handlers, like in parsing or writing, only closes this connection
+	defer func() {
+		if value := recover(); value != nil {
+			c.server.reportPanic(&PanicError{Value: value, Stack: debug.Stack(), Request: req})
+		}
+	}()
+
+	for {
+		start := time.Now()
+		ctx, cancel := context.WithCancel(c.ctx) // Cancelled when the connection is closed
+		req.SetContext(ctx)
+		res := runHandlers(c, req, http.NewResponse(req), nil)
+		cancel()
+
+		// Server push is not available in HTTP/1.1, and push requests are therefore ignored
+		keepAlive := isKeepAlive(req) && !c.isDraining()
+		if !keepAlive {
+			res.Header["connection"] = "close"
+		}
+		written, err := http.WriteResponse(c.rw, req, res)
+		if err != nil {
+			c.server.nonBlockingErrorChanSend(err)
+			return
+		}
+		c.logAccess(req, res, 0, start, written)
+		if !keepAlive {
+			return
+		}
+
+		// Wait for the next request, once the handlers of this one have returned
+		if !c.waitOverdue() {
+			return
+		}
+		c.setIdle(true)
+		req, err = http.ReadRequest(c.br, c.server.bodyLimit())
+		c.setIdle(false)
+		if err != nil {
+			c.rejectRequest(req, err)
+			return
+		}
+	}
+}
+
+// ------- HELPERS ---------
+
+// RejectRequest answers a HTTP/1.1 request that could not be read, like one whose body is larger than the
+// server's limit. The rest of the request is not read, so the connection can not be used for more requests.
+// Returns false if the client is not answered, as the request is not returned along with the error.
+func (c *Conn) rejectRequest(req *http.Request, err error) bool {
+	status, ok := rejectStatus[err]
+	if req == nil || !ok {
+		return false
+	}
+	res := http.NewResponse(req)
+	res.String(status, http.StatusText(status))
+	res.Header["connection"] = "close"
+	http.WriteResponse(c.rw, req, res)
+	return true
+}
+
+// rejectStatus is the status of the response to a HTTP/1.1 request that could not be read
+var rejectStatus = map[error]uint16{
+	http.ErrMalformedRequest:  400,
+	http.ErrBodyTooLarge:      413,
+	http.ErrHeaderTooLarge:    431,
+	http.ErrUnsupportedCoding: 501,
+}
+
+// IsKeepAlive checks if the connection should be kept open after a request - RFC7230 Section 6.3
+func isKeepAlive(req *http.Request) bool {
+	connection := req.Header["connection"]
+	if req.Proto == "HTTP/1.0" {
+		return http.HeaderContains(connection, "keep-alive")
+	}
+	return !http.HeaderContains(connection, "close")
+}
+
+func (c *Conn) setIdle(idle bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = idle
+}
+
+func (c *Conn) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
@@ -0,0 +1,154 @@
+package opal
+
+import (
+	"bufio"
+	"github.com/SveinungOverland/opal/http"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHTTP1Fallback(t *testing.T) {
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+
+	// Two requests on the same connection, the last one closes it
+	go client.conn.Write([]byte("POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nTEST" +
+		"GET /invalid HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+
+	status, headers, body := readHTTP1Response(t, client.br)
+	if status != "HTTP/1.1 200 OK" {
+		t.Errorf("Incorrect status line. Expected %q, got %q", "HTTP/1.1 200 OK", status)
+	}
+	if headers["content-type"] != "application/json" {
+		t.Errorf("Incorrect content-type. Expected %s, got %s", "application/json", headers["content-type"])
+	}
+	if body != "{\"Result\":\"TEST_RESULT\"}" {
+		t.Errorf("Incorrect body. Got %s", body)
+	}
+
+	status, headers, _ = readHTTP1Response(t, client.br)
+	if status != "HTTP/1.1 404 Not Found" {
+		t.Errorf("Incorrect status line. Expected %q, got %q", "HTTP/1.1 404 Not Found", status)
+	}
+	if headers["connection"] != "close" {
+		t.Error("Connection was not closed after \"Connection: close\"")
+	}
+}
+
+func TestHTTP1BodyTooLarge(t *testing.T) {
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	srv.SetMaxBodySize(4)
+	for _, contentLength := range []string{"5", "9223372036854775807"} {
+		client := newPipeClient(srv)
+		go client.conn.Write([]byte("POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + contentLength + "\r\n\r\n"))
+
+		status, headers, _ := readHTTP1Response(t, client.br)
+		if status != "HTTP/1.1 413 Payload Too Large" {
+			t.Errorf("Incorrect status line for content-length %s. Expected %q, got %q", contentLength, "HTTP/1.1 413 Payload Too Large", status)
+		}
+		if headers["connection"] != "close" {
+			t.Error("Connection was not closed after a too large body")
+		}
+		client.conn.Close()
+	}
+
+	// The limit applies to every request on a kept-alive connection
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	go client.conn.Write([]byte("POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nTEST" +
+		"POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\n"))
+	if status, _, _ := readHTTP1Response(t, client.br); status != "HTTP/1.1 200 OK" {
+		t.Errorf("Incorrect status line. Expected %q, got %q", "HTTP/1.1 200 OK", status)
+	}
+	if status, _, _ := readHTTP1Response(t, client.br); status != "HTTP/1.1 413 Payload Too Large" {
+		t.Errorf("Incorrect status line. Expected %q, got %q", "HTTP/1.1 413 Payload Too Large", status)
+	}
+}
+
+func TestHTTP1RequestRejected(t *testing.T) {
+	tests := map[string]string{
+		"Content-Length: 4\r\nTransfer-Encoding: chunked\r\n":     "HTTP/1.1 400 Bad Request",
+		strings.Repeat("Accept: */*\r\n", http.MaxHeaderFields+1): "HTTP/1.1 431 Request Header Fields Too Large",
+		"Transfer-Encoding: gzip\r\n":                             "HTTP/1.1 501 Not Implemented",
+	}
+
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	for headers, expected := range tests {
+		client := newPipeClient(srv)
+		go client.conn.Write([]byte("POST /test HTTP/1.1\r\nHost: localhost\r\n" + headers + "\r\n"))
+
+		status, responseHeaders, _ := readHTTP1Response(t, client.br)
+		if status != expected {
+			t.Errorf("Incorrect status line. Expected %q, got %q", expected, status)
+		}
+		if responseHeaders["connection"] != "close" {
+			t.Error("Connection was not closed after a rejected request")
+		}
+		client.conn.Close()
+	}
+}
+
+func TestIsKeepAlive(t *testing.T) {
+	tests := []struct {
+		proto      string
+		connection string
+		expected   bool
+	}{
+		{"HTTP/1.1", "", true},
+		{"HTTP/1.1", "close", false},
+		{"HTTP/1.0", "", false},
+		{"HTTP/1.0", "Keep-Alive", true},
+	}
+	for _, test := range tests {
+		req := newTestHTTP1Request(test.proto, test.connection)
+		if actual := isKeepAlive(req); actual != test.expected {
+			t.Errorf("Incorrect keep-alive for %s with connection %q. Expected %t, got %t", test.proto, test.connection, test.expected, actual)
+		}
+	}
+}
+
+// ---------- HELPERS --------------
+
+func readHTTP1Response(t *testing.T, br *bufio.Reader) (status string, headers map[string]string, body string) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Could not read status line: %v", err)
+	}
+	status = strings.TrimRight(line, "\r\n")
+
+	headers = make(map[string]string)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Could not read header: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		headers[strings.ToLower(kv[0])] = kv[1]
+	}
+
+	length, _ := strconv.Atoi(headers["content-length"])
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("Could not read body: %v", err)
+	}
+	return status, headers, string(buf)
+}
+
+func newTestHTTP1Request(proto, connection string) *http.Request {
+	req := http.NewRequest()
+	req.Proto = proto
+	if connection != "" {
+		req.Header["connection"] = connection
+	}
+	return req
+}
@@ -0,0 +1,136 @@
+package opaltest
+
+import (
+	"github.com/SveinungOverland/opal"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"strings"
+	"sync"
+)
+
+/*
+	This file contains the testing of handlers without a connection. Routers
+	and middlewares are run against a synthesized request, the same way the
+	server runs them, and the response is recorded.
+*/
+
+// Handler runs routers and middlewares like a server does, without a connection
+type Handler struct {
+	srv *opal.Server
+}
+
+// NewHandler creates a handler serving the routes of the given routers
+func NewHandler(routers ...*router.Router) *Handler {
+	srv := opal.NewServer()
+	for _, r := range routers {
+		srv.Register(r)
+	}
+	return &Handler{srv: srv}
+}
+
+// Use registers a handler as a middleware
+func (h *Handler) Use(middleware router.HandleFunc) {
+	h.srv.Use(middleware)
+}
+
+// Server returns the server running the handlers, so handler timeouts and the panic handler can be set
+func (h *Handler) Server() *opal.Server {
+	return h.srv
+}
+
+// Record runs the middlewares and handlers of a request's route, and records the response
+func (h *Handler) Record(req *http.Request) *ResponseRecorder {
+	rec := NewRecorder()
+	res := http.NewResponse(req)
+	res.SetStreamWriter(rec)
+	res = h.srv.ServeRequest(req, res)
+	rec.finish(res)
+	return rec
+}
+
+// NewRequest synthesizes a HTTP/2 request for a target, like "/users/1?fields=name"
+func NewRequest(method, target string, body []byte) *http.Request {
+	req := http.NewRequest()
+	req.Method = method
+	req.Scheme = "https"
+	req.Authority = "localhost"
+	req.Proto = "HTTP/2"
+	req.URI = target
+	if i := strings.Index(target, "?"); i != -1 {
+		req.URI = target[:i]
+		req.RawQuery = target[i:]
+	}
+	req.Body = body
+	return req
+}
+
+// ResponseRecorder is a http.StreamWriter recording a response. Streamed responses are recorded
+// as they are sent to a client.
+type ResponseRecorder struct {
+	// Response is the response built by the handlers. The body of a streamed response includes
+	// all flushed data, and its status and headers are the ones that were flushed.
+	Response *http.Response
+	// Flushes is the number of times the handlers flushed data
+	Flushes int
+	// Reset is set if the response was aborted after its headers were flushed, like when the handlers time out
+	// or panic, where a connection would reset the stream. Response is then what was flushed.
+	Reset bool
+
+	mu        sync.Mutex
+	committed bool
+	status    uint16
+	header    map[string]string
+	body      []byte
+	done      chan struct{}
+}
+
+// NewRecorder creates a recorder that can be set as the StreamWriter of a response
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{done: make(chan struct{})}
+}
+
+// WriteHeader records the status and headers of a streamed response
+func (rec *ResponseRecorder) WriteHeader(status uint16, header map[string]string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.committed = true
+	rec.status = status
+	rec.header = make(map[string]string, len(header))
+	for name, value := range header {
+		rec.header[name] = value
+	}
+	return nil
+}
+
+// WriteData records a part of the body of a streamed response
+func (rec *ResponseRecorder) WriteData(data []byte) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.body = append(rec.body, data...)
+	rec.Flushes++
+	return nil
+}
+
+// Done returns a channel that is closed when the recording is finished
+func (rec *ResponseRecorder) Done() <-chan struct{} {
+	return rec.done
+}
+
+// ------- HELPERS ---------
+
+// Finish sets the recorded response when the handlers are done. The rest of a streamed response is appended,
+// as the server sends it after the handlers. The response is nil if it was aborted.
+func (rec *ResponseRecorder) finish(res *http.Response) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if res == nil {
+		rec.Reset = true
+		res = &http.Response{Status: rec.status, Header: rec.header, Body: rec.body, Trailer: make(map[string]string)}
+	} else if rec.committed && res.Committed() {
+		res.Status = rec.status
+		res.Header = rec.header
+		res.Body = append(rec.body, res.Body...)
+	}
+	rec.Response = res
+	close(rec.done)
+}
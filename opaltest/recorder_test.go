@@ -0,0 +1,114 @@
+package opaltest
+
+import (
+	"github.com/SveinungOverland/opal"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	h := NewHandler(newTestRouter())
+	h.Use(func(req *http.Request, res *http.Response) {
+		res.Header["x-middleware"] = "true"
+	})
+
+	rec := h.Record(NewRequest("POST", "/users/42?greeting=hello", []byte("opal")))
+	res := rec.Response
+	if res.Status != 200 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 200, res.Status)
+	}
+	if string(res.Body) != "hello 42 opal" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "hello 42 opal", res.Body)
+	}
+	if res.Header["x-middleware"] != "true" {
+		t.Error("Middleware was not run")
+	}
+	if res.Header["content-length"] != "13" {
+		t.Errorf("Incorrect content-length! Expected %q, got %q", "13", res.Header["content-length"])
+	}
+	if rec.Flushes != 0 {
+		t.Errorf("Response was flushed %d times", rec.Flushes)
+	}
+
+	if res := h.Record(NewRequest("GET", "/missing", nil)).Response; res.Status != 404 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 404, res.Status)
+	}
+}
+
+func TestRecordStreamedResponse(t *testing.T) {
+	rec := NewHandler(newTestRouter()).Record(NewRequest("GET", "/stream", nil))
+	res := rec.Response
+	if res.Status != 202 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 202, res.Status)
+	}
+	if string(res.Body) != "first second third" {
+		t.Errorf("Incorrect body! Expected %q, got %q", "first second third", res.Body)
+	}
+	if rec.Flushes != 2 {
+		t.Errorf("Incorrect number of flushes! Expected %d, got %d", 2, rec.Flushes)
+	}
+	select {
+	case <-rec.Done():
+	default:
+		t.Error("Recorder is not done after the handlers")
+	}
+}
+
+func TestRecordTimeout(t *testing.T) {
+	r := newTestRouter()
+	r.Timeout("/slow", 10*time.Millisecond)
+	rec := NewHandler(r).Record(NewRequest("GET", "/slow", nil))
+	if rec.Response.Status != 503 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 503, rec.Response.Status)
+	}
+}
+
+func TestRecordTimeoutAfterFlush(t *testing.T) {
+	release := make(chan struct{})
+	errChan := make(chan error, 1)
+	r := router.NewRouter("/")
+	r.Timeout("/slow", 10*time.Millisecond)
+	r.Get("/slow", func(req *http.Request, res *http.Response) {
+		res.Write([]byte("partial"))
+		res.Flush()
+		<-release
+		res.Write([]byte(" more"))
+		errChan <- res.Flush()
+	})
+
+	// The headers are sent, so the response is aborted like a reset stream instead of replaced with 503
+	rec := NewHandler(r).Record(NewRequest("GET", "/slow", nil))
+	if !rec.Reset {
+		t.Error("Response was not reset")
+	}
+	if rec.Response.Status != 200 || string(rec.Response.Body) != "partial" {
+		t.Errorf("Incorrect response! Expected %d %q, got %d %q", 200, "partial", rec.Response.Status, rec.Response.Body)
+	}
+	close(release)
+	if err := <-errChan; err != opal.ErrHandlerTimeout {
+		t.Errorf("Incorrect error of flush after the timeout! Expected %v, got %v", opal.ErrHandlerTimeout, err)
+	}
+}
+
+// ------- HELPERS ---------
+
+func newTestRouter() *router.Router {
+	r := router.NewRouter("/")
+	r.Post("/users/:id", func(req *http.Request, res *http.Response) {
+		res.String(200, req.Query("greeting")+" "+req.Param("id")+" "+string(req.Body))
+	})
+	r.Get("/stream", func(req *http.Request, res *http.Response) {
+		res.Status = 202
+		res.Write([]byte("first "))
+		res.Flush()
+		res.Write([]byte("second "))
+		res.Flush()
+		res.Write([]byte("third"))
+	})
+	r.Get("/slow", func(req *http.Request, res *http.Response) {
+		<-req.Context().Done()
+	})
+	return r
+}
@@ -0,0 +1,332 @@
+package opaltest
+
+import (
+	"errors"
+	"github.com/SveinungOverland/opal"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	This file contains an in-process server for protocol-level tests. The
+	connections are in-memory pipes, served by the same code as TCP
+	connections, and test clients write and read real frames.
+*/
+
+// ClientPreface is the connection preface sent by HTTP/2 clients - RFC7540 Section 3.5
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// DefaultTimeout is how long Conn.ReadFrame waits for a frame by default
+const DefaultTimeout = time.Second
+
+// maxWindowSize is the largest flow-control window, which the client advertises - RFC7540 Section 6.9.1
+const maxWindowSize = 1<<31 - 1
+
+// defaultWindowSize is the flow-control window of a connection before it is changed by WINDOW_UPDATE frames
+const defaultWindowSize = 65535
+
+// ErrTimeout is returned when no frame is received before the timeout
+var ErrTimeout = errors.New("opaltest: Timeout waiting for frame")
+
+// ErrClosed is returned when the server has closed the connection
+var ErrClosed = errors.New("opaltest: Connection is closed")
+
+// Server serves an opal server over in-memory connections
+type Server struct {
+	srv *opal.Server
+}
+
+// NewServer creates an in-process server for an opal server. The server should not use TLS.
+func NewServer(srv *opal.Server) *Server {
+	return &Server{srv: srv}
+}
+
+// Dial opens a new connection to the server. It has the signature of a dial function, like the
+// Dial field of client.Client, and the network and address are ignored.
+func (s *Server) Dial(network, addr string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	go s.srv.ServeConn(serverConn)
+	return clientConn, nil
+}
+
+// Connect opens a new connection to the server, and does the handshake of the client
+func (s *Server) Connect() (*Conn, error) {
+	nc, _ := s.Dial("pipe", "")
+	c := NewConn(nc)
+	if err := c.Handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Conn is the client side of a HTTP/2 connection. Frames are read in the background and queued until
+// they are read with ReadFrame, so the server is not blocked writing to the pipe by a test that reads
+// few frames. Flow-control credit is given back to the server as DATA frames arrive.
+type Conn struct {
+	net.Conn
+	Hpack   *hpack.Context // Encodes request headers and decodes response headers
+	Timeout time.Duration  // How long ReadFrame waits for a frame
+
+	mu        sync.Mutex
+	queue     []frame.Frame        // Frames read from the server, and not yet returned by ReadFrame
+	closed    bool                 // Set when the server has closed the connection
+	signal    chan struct{}        // Signalled when a frame is queued or the connection is closed
+	responses map[uint32]*response // Responses being read by ReadResponse
+}
+
+type response struct {
+	res      *http.Response
+	complete bool
+}
+
+// NewConn creates the client side of a connection, and starts reading its frames
+func NewConn(nc net.Conn) *Conn {
+	c := &Conn{
+		Conn:      nc,
+		Hpack:     hpack.NewContext(4096, 4096),
+		Timeout:   DefaultTimeout,
+		signal:    make(chan struct{}, 1),
+		responses: make(map[uint32]*response),
+	}
+	go c.readFrames()
+	return c
+}
+
+// Handshake sends the connection preface, a SETTINGS frame and a WINDOW_UPDATE frame. The client advertises
+// the largest flow-control windows, so the server is not held back by the windows of the client.
+func (c *Conn) Handshake() error {
+	if _, err := c.Write([]byte(ClientPreface)); err != nil {
+		return err
+	}
+	err := c.WriteFrame(&frame.Frame{
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{},
+		Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{0x4: maxWindowSize}},
+		Length:  6,
+	})
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(newWindowUpdate(maxWindowSize - defaultWindowSize))
+}
+
+// WriteFrame writes a frame to the server
+func (c *Conn) WriteFrame(f *frame.Frame) error {
+	_, err := c.Write(f.ToBytes())
+	return err
+}
+
+// WriteRequest encodes the headers of a request, and sends them in a HEADERS frame on a stream.
+// The body of the request is sent in a DATA frame if it has one.
+func (c *Conn) WriteRequest(streamID uint32, req *http.Request) error {
+	fragment := c.Hpack.Encode(RequestHeaderFields(req))
+	endStream := len(req.Body) == 0
+	err := c.WriteFrame(&frame.Frame{
+		ID:      streamID,
+		Type:    frame.HeadersType,
+		Flags:   &types.HeadersFlags{EndHeaders: true, EndStream: endStream},
+		Payload: &types.HeadersPayload{Fragment: fragment},
+		Length:  uint32(len(fragment)),
+	})
+	if err != nil || endStream {
+		return err
+	}
+	return c.WriteFrame(&frame.Frame{
+		ID:      streamID,
+		Type:    frame.DataType,
+		Flags:   &types.DataFlags{EndStream: true},
+		Payload: &types.DataPayload{Data: req.Body},
+		Length:  uint32(len(req.Body)),
+	})
+}
+
+// ReadFrame returns the next frame from the server
+func (c *Conn) ReadFrame() (frame.Frame, error) {
+	timeout := time.NewTimer(c.Timeout)
+	defer timeout.Stop()
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			f := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return f, nil
+		}
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return frame.Frame{}, ErrClosed
+		}
+
+		select {
+		case <-c.signal:
+		case <-timeout.C:
+			return frame.Frame{}, ErrTimeout
+		}
+	}
+}
+
+// ReadFrameOf skips frames until it receives a frame of a given type on a given stream
+func (c *Conn) ReadFrameOf(frameType byte, streamID uint32) (frame.Frame, error) {
+	for {
+		f, err := c.ReadFrame()
+		if err != nil || (f.Type == frameType && f.ID == streamID) {
+			return f, err
+		}
+	}
+}
+
+// ReadResponse reads frames until the response of a stream is complete, and returns it. The responses
+// of other streams are read too, and returned when ReadResponse is called for them.
+func (c *Conn) ReadResponse(streamID uint32) (*http.Response, error) {
+	for {
+		if res, ok := c.responses[streamID]; ok && res.complete {
+			delete(c.responses, streamID)
+			return res.res, nil
+		}
+
+		f, err := c.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if f.ID == 0 {
+			continue // Frames of the connection are skipped
+		}
+		res, ok := c.responses[f.ID]
+		if !ok {
+			res = &response{}
+			c.responses[f.ID] = res
+		}
+
+		switch f.Type {
+		case frame.HeadersType:
+			hfs, err := c.readHeaderBlock(f.Payload.(*types.HeadersPayload).Fragment, f.Flags.(*types.HeadersFlags).EndHeaders)
+			if err != nil {
+				return nil, err
+			}
+			if res.res == nil {
+				res.res = newResponse(hfs)
+			} else {
+				for _, hf := range hfs {
+					res.res.Trailer[hf.Name] = hf.Value
+				}
+			}
+			res.complete = f.Flags.(*types.HeadersFlags).EndStream
+		case frame.PushPromiseType:
+			// The promised request is decoded, so the following header blocks can be decoded
+			if _, err := c.readHeaderBlock(f.Payload.(*types.PushPromisePayload).Fragment, f.Flags.(*types.PushPromiseFlags).EndHeaders); err != nil {
+				return nil, err
+			}
+		case frame.DataType:
+			if res.res != nil {
+				res.res.Body = append(res.res.Body, f.Payload.(*types.DataPayload).Data...)
+				res.complete = f.Flags.(*types.DataFlags).EndStream
+			}
+		case frame.RstStreamType:
+			delete(c.responses, f.ID)
+			if f.ID == streamID {
+				return nil, errors.New("opaltest: Stream was reset with " + f.Payload.(*types.RstStreamPayload).ErrorCode.String())
+			}
+		}
+	}
+}
+
+// RequestHeaderFields converts a request into header fields. Pseudo-header fields come first.
+func RequestHeaderFields(req *http.Request) []*hpack.HeaderField {
+	hfs := []*hpack.HeaderField{
+		{Name: ":method", Value: req.Method},
+		{Name: ":scheme", Value: req.Scheme},
+		{Name: ":authority", Value: req.Authority},
+		{Name: ":path", Value: req.URI + req.RawQuery},
+	}
+	for name, value := range req.Header {
+		hfs = append(hfs, &hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+	}
+	return hfs
+}
+
+// ------- HELPERS ---------
+
+// ReadFrames reads frames from the server and queues them, until the connection is closed
+func (c *Conn) readFrames() {
+	fr := frame.NewReader(c.Conn)
+	fr.MaxFrameSize = frame.MaxFrameSizeLimit
+	received := uint32(0) // Data received since the connection window was last restored
+	for {
+		f, err := fr.ReadFrame()
+		c.mu.Lock()
+		if err != nil {
+			c.closed = true
+		} else {
+			c.queue = append(c.queue, f)
+		}
+		c.mu.Unlock()
+		select {
+		case c.signal <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+
+		// The connection window is restored when half of it is used. The write is not waited for, as the
+		// server may be blocked writing to the pipe until the next frame is read.
+		if f.Type == frame.DataType {
+			received += f.Length
+			if received >= maxWindowSize/2 {
+				go c.WriteFrame(newWindowUpdate(received))
+				received = 0
+			}
+		}
+	}
+}
+
+// NewWindowUpdate creates a WINDOW_UPDATE frame for the connection
+func newWindowUpdate(increment uint32) *frame.Frame {
+	return &frame.Frame{
+		Type:    frame.WindowUpdateType,
+		Flags:   &types.WindowUpdateFlags{},
+		Payload: &types.WindowUpdatePayload{WindowSizeIncrement: increment},
+		Length:  4,
+	}
+}
+
+// ReadHeaderBlock reads the CONTINUATION frames of a header block, and decodes it
+func (c *Conn) readHeaderBlock(fragment []byte, endHeaders bool) ([]*hpack.HeaderField, error) {
+	block := append([]byte{}, fragment...)
+	for !endHeaders {
+		f, err := c.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if f.Type != frame.ContinuationType {
+			return nil, errors.New("opaltest: Header block is interrupted")
+		}
+		block = append(block, f.Payload.(*types.ContinuationPayload).HeaderFragment...)
+		endHeaders = f.Flags.(*types.ContinuationFlags).EndHeaders
+	}
+	return c.Hpack.Decode(block)
+}
+
+// NewResponse builds a response from decoded response headers
+func newResponse(hfs []*hpack.HeaderField) *http.Response {
+	res := http.NewResponse(nil)
+	res.Header = make(map[string]string) // Without the default content type of a new response
+	for _, hf := range hfs {
+		if hf.Name == ":status" {
+			status, _ := strconv.Atoi(hf.Value)
+			res.Status = uint16(status)
+			continue
+		}
+		res.Header[hf.Name] = hf.Value
+	}
+	return res
+}
@@ -0,0 +1,113 @@
+package opaltest
+
+import (
+	"bytes"
+	"github.com/SveinungOverland/opal"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	srv := opal.NewServer()
+	srv.Register(newTestRouter())
+	conn, err := NewServer(srv).Connect()
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	// The server sends its SETTINGS first
+	f, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatalf("No frame received: %v", err)
+	}
+	if f.Type != frame.SettingsType || f.Flags.(*types.SettingsFlags).Ack {
+		t.Errorf("Incorrect first frame! Expected SETTINGS, got frame of type %d", f.Type)
+	}
+
+	if err := conn.WriteRequest(1, NewRequest("POST", "/users/7?greeting=hi", []byte("there"))); err != nil {
+		t.Fatalf("Request could not be written: %v", err)
+	}
+	if err := conn.WriteRequest(3, NewRequest("GET", "/stream", nil)); err != nil {
+		t.Fatalf("Request could not be written: %v", err)
+	}
+
+	res, err := conn.ReadResponse(1)
+	if err != nil {
+		t.Fatalf("No response received: %v", err)
+	}
+	if res.Status != 200 || string(res.Body) != "hi 7 there" {
+		t.Errorf("Incorrect response! Expected %d %q, got %d %q", 200, "hi 7 there", res.Status, res.Body)
+	}
+	res, err = conn.ReadResponse(3)
+	if err != nil {
+		t.Fatalf("No response received: %v", err)
+	}
+	if res.Status != 202 || string(res.Body) != "first second third" {
+		t.Errorf("Incorrect response! Expected %d %q, got %d %q", 202, "first second third", res.Status, res.Body)
+	}
+}
+
+func TestServerPing(t *testing.T) {
+	conn, err := NewServer(opal.NewServer()).Connect()
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	data := []byte("opaltest")
+	conn.WriteFrame(&frame.Frame{
+		Type:    frame.PingType,
+		Flags:   &types.PingFlags{},
+		Payload: &types.PingPayload{Data: data},
+		Length:  8,
+	})
+	f, err := conn.ReadFrameOf(frame.PingType, 0)
+	if err != nil {
+		t.Fatalf("No PING received: %v", err)
+	}
+	if !f.Flags.(*types.PingFlags).Ack || string(f.Payload.(*types.PingPayload).Data) != string(data) {
+		t.Error("PING was not acknowledged with the same data")
+	}
+}
+
+func TestServerLargeResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("opal"), 200000) // Larger than the default flow-control window
+	written := make(chan struct{})
+	r := router.NewRouter("/")
+	r.Get("/large", func(req *http.Request, res *http.Response) {
+		// Every flush is a DATA frame, which is written before Flush returns
+		for i := 0; i < len(body); i += 4000 {
+			res.Write(body[i : i+4000])
+			res.Flush()
+		}
+		close(written)
+	})
+
+	srv := opal.NewServer()
+	srv.Register(r)
+	conn, err := NewServer(srv).Connect()
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer conn.Close()
+	conn.WriteRequest(1, NewRequest("GET", "/large", nil))
+
+	// All frames are received before any of them are read
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Server was blocked writing the response")
+	}
+	res, err := conn.ReadResponse(1)
+	if err != nil {
+		t.Fatalf("No response received: %v", err)
+	}
+	if !bytes.Equal(res.Body, body) {
+		t.Errorf("Incorrect body! Expected %d bytes, got %d", len(body), len(res.Body))
+	}
+}
@@ -0,0 +1,68 @@
+package opal
+
+import (
+	"fmt"
+	"github.com/SveinungOverland/opal/http"
+	"runtime/debug"
+)
+
+/*
+	This file contains the recovery of panics in handlers, so a
+	panicking handler does not take down the server. The client
+	gets a 500 response, and the connection stays usable.
+*/
+
+// PanicError is reported when a handler panics
+type PanicError struct {
+	Value   interface{} // The value given to panic
+	Stack   []byte      // The stack trace of the panicking goroutine
+	Request *http.Request
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("opal: Panic serving %s %s: %v", e.Request.Method, e.Request.URI, e.Value)
+}
+
+// PanicHandler handles a panic in a handler. The response is already reset to a 500
+// response, and can be changed by the PanicHandler.
+type PanicHandler func(req *http.Request, res *http.Response, err *PanicError)
+
+// SetPanicHandler sets a function that is called when a handler panics. It replaces the default
+// handling, where the PanicError is sent to the error channel, or printed if there is none.
+func (s *Server) SetPanicHandler(handler PanicHandler) {
+	s.panicHandler = handler
+}
+
+// ------- HELPERS ---------
+
+// RecoverPanic recovers a panic in the handlers of a request, and replaces the response with a 500 response.
+// The response is left as it is if it is already committed. It must be deferred.
+func recoverPanic(conn *Conn, req *http.Request, res *http.Response, ok *bool) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	*ok = false
+	err := &PanicError{Value: value, Stack: debug.Stack(), Request: req}
+
+	if !res.Committed() {
+		*res = *http.NewResponse(req) // Whatever the handlers did is discarded, including push requests
+		res.String(500, "Internal Server Error")
+	}
+
+	if conn.server.panicHandler != nil {
+		conn.server.panicHandler(req, res, err)
+		return
+	}
+	conn.server.reportPanic(err)
+}
+
+// ReportPanic sends a PanicError to the error channel, or prints it if there is none
+func (s *Server) reportPanic(err *PanicError) {
+	if s.connErrorChan == nil {
+		fmt.Println(err)
+		fmt.Println(string(err.Stack))
+		return
+	}
+	s.nonBlockingErrorChanSend(err)
+}
@@ -0,0 +1,74 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+)
+
+func TestHandlerPanic(t *testing.T) {
+	panics := make(chan *PanicError, 1)
+	r := router.NewRouter("/")
+	r.Get("/panic", func(req *http.Request, res *http.Response) {
+		panic("boom")
+	})
+	r.Get("/ok", func(req *http.Request, res *http.Response) {
+		res.String(200, "ok")
+	})
+
+	srv := NewServer()
+	srv.SetPanicHandler(func(req *http.Request, res *http.Response, err *PanicError) {
+		panics <- err
+	})
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/panic", "GET", true)
+
+	headers := client.readHeaders(t, 1)
+	validateHeaderFields(t, headers, []*hpack.HeaderField{
+		hf(":status", "500"),
+		hf("content-type", "text/plain; charset=utf-8"),
+		hf("content-length", "21"),
+	})
+	err := <-panics
+	if err.Value != "boom" || err.Request.URI != "/panic" || len(err.Stack) == 0 {
+		t.Errorf("Incorrect panic error! Got %v", err)
+	}
+
+	// The connection should still be usable
+	client.writeHeaders(3, "/ok", "GET", true)
+	headers = client.readHeaders(t, 3)
+	validateHeaderFields(t, headers, []*hpack.HeaderField{
+		hf(":status", "200"),
+		hf("content-type", "text/plain; charset=utf-8"),
+		hf("content-length", "2"),
+	})
+}
+
+func TestStreamedHandlerPanic(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Get("/stream", func(req *http.Request, res *http.Response) {
+		res.Flush()
+		panic("boom")
+	})
+
+	srv := NewServer()
+	srv.SetPanicHandler(func(req *http.Request, res *http.Response, err *PanicError) {})
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/stream", "GET", true)
+
+	client.readHeaders(t, 1)
+	rst := client.readFrame(t, frame.RstStreamType, 1)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.InternalError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.InternalError, code)
+	}
+}
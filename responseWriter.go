@@ -0,0 +1,198 @@
+package opal
+
+import (
+	"errors"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	This file contains the writing of streamed responses, where the
+	handler sends the headers and parts of the body with
+	Response.Flush before all handlers are done.
+*/
+
+// ErrStreamClosed is returned when writing a response on a stream that is closed, like when the client has reset it
+var ErrStreamClosed = errors.New("opal: Stream is closed")
+
+// responseWriter is the http.StreamWriter of a HTTP/2 response
+type responseWriter struct {
+	conn   *Conn
+	stream *Stream
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool // Set when the handler timeout expires, nothing is written afterwards
+	written     int  // Bytes of data queued by WriteData
+}
+
+// WriteHeader sends the HEADERS of the response, without ending the stream
+func (rw *responseWriter) WriteHeader(status uint16, header map[string]string) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.timedOut {
+		return ErrHandlerTimeout
+	}
+	if rw.stream.isClosed() {
+		return ErrStreamClosed
+	}
+	rw.wroteHeader = true
+	rw.stream.streaming = true
+	rw.conn.writeHeaders(rw.stream, responseHeaderFields(status, header))
+	return nil
+}
+
+// WriteData sends DATA frames, and waits until they are written so the handler does not outpace the client
+func (rw *responseWriter) WriteData(data []byte) error {
+	rw.mu.Lock()
+	if rw.timedOut {
+		rw.mu.Unlock()
+		return ErrHandlerTimeout
+	}
+	rw.conn.queueData(rw.stream, data, false)
+	rw.written += len(data)
+	rw.mu.Unlock()
+
+	for atomic.LoadInt64(&rw.stream.queued) > 0 {
+		select {
+		case <-rw.stream.flushed:
+		case <-rw.conn.ctx.Done():
+			return ErrStreamClosed
+		}
+		if rw.stream.isClosed() {
+			return ErrStreamClosed
+		}
+	}
+	return nil
+}
+
+// Done returns a channel that is closed when the stream is closed, or the connection is closed
+func (rw *responseWriter) Done() <-chan struct{} {
+	return rw.stream.done
+}
+
+// ------- HELPERS ---------
+
+// BytesWritten returns the number of bytes of data the handler has flushed
+func (rw *responseWriter) bytesWritten() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.written
+}
+
+// Timeout stops the handler from writing anything more. Returns true if the headers
+// are not sent, in which case another response can be sent instead.
+func (rw *responseWriter) timeout() bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.timedOut = true
+	return !rw.wroteHeader
+}
+
+// Reset aborts the response by resetting its stream
+func (rw *responseWriter) reset(code constants.ErrorCode) {
+	rw.conn.sendFrame(frame.NewErrorFrame(rw.stream.id, code))
+}
+
+// requestWriter is the http.StreamWriter of a response served without a connection, see Server.ServeRequest.
+// It passes what the handlers flush on to the writer of the caller, and stops them at a timeout like
+// a responseWriter does.
+type requestWriter struct {
+	w http.StreamWriter
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+// WriteHeader passes the status and headers of the response on
+func (rw *requestWriter) WriteHeader(status uint16, header map[string]string) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.timedOut {
+		return ErrHandlerTimeout
+	}
+	rw.wroteHeader = true
+	return rw.w.WriteHeader(status, header)
+}
+
+// WriteData passes a part of the body on
+func (rw *requestWriter) WriteData(data []byte) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.timedOut {
+		return ErrHandlerTimeout
+	}
+	return rw.w.WriteData(data)
+}
+
+// Done returns the channel of the caller's writer
+func (rw *requestWriter) Done() <-chan struct{} {
+	return rw.w.Done()
+}
+
+// Timeout stops the handlers from writing anything more. Returns true if the headers are not sent.
+func (rw *requestWriter) timeout() bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.timedOut = true
+	return !rw.wroteHeader
+}
+
+// Reset does nothing, as there is no stream. The response is aborted by returning nil from ServeRequest.
+func (rw *requestWriter) reset(code constants.ErrorCode) {}
+
+// WriteHeaders encodes the headers of a stream and queues them, along with any data set on the stream.
+// Header blocks must be written in the order they are encoded - RFC7540 Section 4.3, so they are
+// encoded and queued under the same lock.
+func (c *Conn) writeHeaders(s *Stream, hfs []*hpack.HeaderField) {
+	c.hpackMu.Lock()
+	defer c.hpackMu.Unlock()
+	s.headers = c.hpack.Encode(hfs) // Header compression
+	c.sendStream(s)
+}
+
+// QueueData queues data of a streamed response, and ends the stream if endStream is set
+func (c *Conn) queueData(s *Stream, data []byte, endStream bool) {
+	if s.isClosed() {
+		return // The client has reset the stream, and does not want more data
+	}
+	atomic.AddInt64(&s.queued, int64(len(data)))
+	for _, f := range newDataFrames(s.id, data, c.setting(5), endStream) {
+		c.sendFrame(f)
+	}
+}
+
+// QueueTrailer queues the trailers of a streamed response, which ends the stream
+func (c *Conn) queueTrailer(s *Stream, trailer []byte) {
+	if s.isClosed() {
+		return
+	}
+	c.sendFrame(newTrailerFrame(s.id, trailer))
+}
+
+// EncodeTrailer encodes the trailers of a response. Trailers are written after the DATA frames of their stream,
+// and not in the order they are encoded, so they are encoded without using the dynamic table.
+func encodeTrailer(trailer map[string]string) []byte {
+	hfs := make([]*hpack.HeaderField, 0, len(trailer))
+	for k, v := range trailer {
+		hfs = append(hfs, &hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+	}
+	return hpack.EncodeWithoutIndexing(hfs)
+}
+
+// ResponseHeaderFields converts a status and headers into a list of headerfields, with the status first
+func responseHeaderFields(status uint16, header map[string]string) []*hpack.HeaderField {
+	hfs := make([]*hpack.HeaderField, 0, len(header)+1)
+	hfs = append(hfs, &hpack.HeaderField{Name: ":status", Value: strconv.Itoa(int(status))})
+	for k, v := range header {
+		hfs = append(hfs, &hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+	}
+	return hfs
+}
@@ -0,0 +1,143 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+	"time"
+)
+
+func TestStreamedResponse(t *testing.T) {
+	release := make(chan struct{})
+	r := router.NewRouter("/")
+	r.Get("/progress", func(req *http.Request, res *http.Response) {
+		res.Write([]byte("first"))
+		if err := res.Flush(); err != nil {
+			t.Errorf("Flush failed: %v", err)
+		}
+		<-release
+		res.Write([]byte("second"))
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/progress", "GET", true)
+
+	// The headers and the flushed data should be sent while the handler is running
+	headers := client.readFrame(t, frame.HeadersType, 1)
+	if headers.Flags.(*types.HeadersFlags).EndStream {
+		t.Fatal("Stream was ended by the headers of a streamed response")
+	}
+	first := client.readFrame(t, frame.DataType, 1)
+	if data := string(first.Payload.(*types.DataPayload).Data); data != "first" {
+		t.Errorf("Incorrect flushed data. Expected %s, got %s", "first", data)
+	}
+	if first.Flags.(*types.DataFlags).EndStream {
+		t.Fatal("Stream was ended before the handler was done")
+	}
+
+	// The rest of the body is sent when the handler is done
+	close(release)
+	second := client.readFrame(t, frame.DataType, 1)
+	if data := string(second.Payload.(*types.DataPayload).Data); data != "second" {
+		t.Errorf("Incorrect data. Expected %s, got %s", "second", data)
+	}
+	if !second.Flags.(*types.DataFlags).EndStream {
+		t.Error("Stream was not ended when the handler was done")
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	large := string(make([]byte, 20000)) // Larger than the max frame size, so CONTINUATION frames are needed
+	tests := map[string]bool{"buffered": false, "streamed": true}
+
+	for name, streamed := range tests {
+		streamed := streamed
+		t.Run(name, func(t *testing.T) {
+			r := router.NewRouter("/")
+			r.Get("/", func(req *http.Request, res *http.Response) {
+				res.String(200, "body")
+				if streamed {
+					res.Flush()
+				}
+				res.Trailer["Checksum"] = "abc"
+				res.Trailer["large"] = large
+			})
+
+			srv := NewServer()
+			srv.Register(r)
+			client := newPipeClient(srv)
+			defer client.conn.Close()
+			client.handshake()
+			client.writeHeaders(1, "/", "GET", true)
+
+			client.readHeaders(t, 1)
+			data := client.readFrame(t, frame.DataType, 1)
+			if data.Flags.(*types.DataFlags).EndStream {
+				t.Fatal("Stream was ended before the trailers were sent")
+			}
+
+			// The trailers follow the data, and end the stream
+			trailer := client.readFrame(t, frame.HeadersType, 1)
+			if !trailer.Flags.(*types.HeadersFlags).EndStream {
+				t.Error("Stream was not ended by the trailers")
+			}
+			fragment := trailer.Payload.(*types.HeadersPayload).Fragment
+			for endHeaders := trailer.Flags.(*types.HeadersFlags).EndHeaders; !endHeaders; {
+				f := <-client.frames
+				if f.Type != frame.ContinuationType || f.ID != 1 {
+					t.Fatalf("Header block was interrupted by a frame of type %d", f.Type)
+				}
+				fragment = append(fragment, f.Payload.(*types.ContinuationPayload).HeaderFragment...)
+				endHeaders = f.Flags.(*types.ContinuationFlags).EndHeaders
+			}
+			hfs, err := client.hpack.Decode(fragment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateHeaderFields(t, hfs, []*hpack.HeaderField{hf("checksum", "abc"), hf("large", large)})
+		})
+	}
+}
+
+func TestEventStreamDisconnect(t *testing.T) {
+	done := make(chan struct{})
+	r := router.NewRouter("/")
+	r.Get("/events", func(req *http.Request, res *http.Response) {
+		defer close(done)
+		es, err := res.EventStream()
+		if err != nil {
+			t.Errorf("Starting event stream failed: %v", err)
+			return
+		}
+		es.Send(http.Event{Data: "hello"})
+		<-es.Done()
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/events", "GET", true)
+
+	f := client.readFrame(t, frame.DataType, 1)
+	if data := string(f.Payload.(*types.DataPayload).Data); data != "data: hello\n\n" {
+		t.Errorf("Incorrect event. Expected %q, got %q", "data: hello\n\n", data)
+	}
+
+	// The handler should notice that the client has reset the stream
+	client.writeFrame(frame.NewErrorFrame(1, constants.Cancel))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Event stream was not done after the client reset the stream")
+	}
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"fmt"
+	"time"
 )
 
 // Route represents a node in a http-router, and contains http-method-implementation
@@ -12,12 +13,15 @@ type Route struct {
 
 	static     bool
 	staticPath string
-
-	Get    []HandleFunc
-	Post   []HandleFunc
-	Put    []HandleFunc
-	Delete []HandleFunc
-	Patch  []HandleFunc
+	streaming  bool          // Request bodies are not read before the handlers run
+	timeout    time.Duration // How long the handlers may run, zero means the server's timeout is used
+
+	Get     []HandleFunc
+	Post    []HandleFunc
+	Put     []HandleFunc
+	Delete  []HandleFunc
+	Patch   []HandleFunc
+	Connect []HandleFunc
 }
 
 func newRoute(pathValue string) *Route {
@@ -55,9 +59,21 @@ func (r *Route) addHandlers(method string, funcs []HandleFunc) {
 		r.Delete = funcs
 	case "PATCH":
 		r.Patch = funcs
+	case "CONNECT":
+		r.Connect = funcs
 	}
 }
 
+// IsStreaming says if the handlers read the request body themselves, with Request.BodyReader
+func (r *Route) IsStreaming() bool {
+	return r.streaming
+}
+
+// HandlerTimeout returns how long the handlers may run, zero if no timeout is set on the route
+func (r *Route) HandlerTimeout() time.Duration {
+	return r.timeout
+}
+
 // GetHandlers gets the handlers for a given method
 func (r *Route) GetHandlers(method string) []HandleFunc {
 	switch method {
@@ -71,6 +87,8 @@ func (r *Route) GetHandlers(method string) []HandleFunc {
 		return r.Delete
 	case "PATCH":
 		return r.Patch
+	case "CONNECT":
+		return r.Connect
 	}
 	return nil
 }
@@ -79,11 +97,14 @@ func (r *Route) merge(route *Route) {
 	// Overwrite config
 	r.static = route.static
 	r.staticPath = route.staticPath
+	r.streaming = route.streaming
+	r.timeout = route.timeout
 	r.Get = route.Get
 	r.Post = route.Post
 	r.Put = route.Put
 	r.Delete = route.Delete
 	r.Patch = route.Patch
+	r.Connect = route.Connect
 	r.subRoutes = route.subRoutes
 	r.paramRoute = route.paramRoute
 }
@@ -119,6 +140,9 @@ func (r *Route) string(depth int) string {
 	if len(r.Patch) > 0 {
 		methods = append(methods, "PATCH")
 	}
+	if len(r.Connect) > 0 {
+		methods = append(methods, "CONNECT")
+	}
 	s += fmt.Sprintf("%s  %v", r.value, methods)
 	if r.static {
 		s += "    STATIC  -  " + r.staticPath
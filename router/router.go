@@ -2,11 +2,15 @@ package router
 
 import (
 	"github.com/SveinungOverland/opal/http"
+	"time"
 )
 
 // HandleFunc is function that represents the handler for a HTTP-Endpoint
 type HandleFunc func(req *http.Request, res *http.Response)
 
+// WebSocketHandler is a function that handles a WebSocket
+type WebSocketHandler func(req *http.Request, ws *http.WebSocket)
+
 // Router manages routes for given http-endpoints
 type Router struct {
 	basePath string
@@ -48,6 +52,27 @@ func (r *Router) Patch(path string, funcs ...HandleFunc) {
 	createFullRoute(r.root, path, "PATCH", funcs)
 }
 
+// Connect initializes a CONNECT-endpoint at given path. Extended CONNECT requests, like WebSocket
+// requests, have a path - RFC8441.
+func (r *Router) Connect(path string, funcs ...HandleFunc) {
+	createFullRoute(r.root, path, "CONNECT", funcs)
+}
+
+// WebSocket initializes a WebSocket-endpoint at given path. The route is streaming, and the WebSocket
+// is closed when the handler returns. Requests that are not WebSocket requests get a 400 response.
+func (r *Router) WebSocket(path string, handler WebSocketHandler) {
+	r.Streaming(path)
+	r.Connect(path, func(req *http.Request, res *http.Response) {
+		ws, err := res.WebSocket()
+		if err != nil {
+			res.String(400, err.Error())
+			return
+		}
+		handler(req, ws)
+		ws.Close(http.CloseNormalClosure, "")
+	})
+}
+
 // Static initializes a static route for handling searches for static files.
 func (r *Router) Static(path string, relativePath string) {
 	leafRoute, _ := createOrFindRoute(r.root, path)
@@ -55,6 +80,20 @@ func (r *Router) Static(path string, relativePath string) {
 	leafRoute.staticPath = relativePath
 }
 
+// Streaming makes the handlers at given path start before the request body is received.
+// The handlers read the body with Request.BodyReader, and Request.Body is empty.
+func (r *Router) Streaming(path string) {
+	leafRoute, _ := createOrFindRoute(r.root, path)
+	leafRoute.streaming = true
+}
+
+// Timeout sets how long the handlers at given path may run, overriding the server's handler timeout.
+// The request context is cancelled when the timeout expires.
+func (r *Router) Timeout(path string, timeout time.Duration) {
+	leafRoute, _ := createOrFindRoute(r.root, path)
+	leafRoute.timeout = timeout
+}
+
 // Root returns the root of the router.
 func (r *Router) Root() *Route {
 	return r.root
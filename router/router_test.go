@@ -32,6 +32,10 @@ func TestRouterMethods(t *testing.T) {
 		actual += "PATCH"
 	})
 
+	r.Connect("/cccc", func(req *http.Request, res *http.Response) {
+		actual += "CONNECT"
+	})
+
 	// Get and run all the configured methods
 	root := r.Root()
 	route := root
@@ -44,16 +48,43 @@ func TestRouterMethods(t *testing.T) {
 	runHandlers(route.GetHandlers("DELETE"))
 	route = getSubRoute(t, getSubRoute(t, root, "bbbb"), "dddd")
 	runHandlers(route.GetHandlers("PATCH"))
+	route = getSubRoute(t, root, "cccc")
+	runHandlers(route.GetHandlers("CONNECT"))
 
 	// Check if all routes were found and all methods were run
-	expected := "POSTGETPUTDELETEPATCH"
+	expected := "POSTGETPUTDELETEPATCHCONNECT"
 	if expected != actual {
 		t.Error("Route methods were not run or the routes were not found!")
 	}
 }
 
+func TestWebSocketRoute(t *testing.T) {
+	r := NewRouter("/")
+	r.WebSocket("/chat", func(req *http.Request, ws *http.WebSocket) {
+		t.Error("Handler was called with a request that is not a WebSocket request")
+	})
+
+	route := getSubRoute(t, r.Root(), "chat")
+	if !route.IsStreaming() {
+		t.Error("WebSocket route is not streaming")
+	}
+	req := http.NewRequest()
+	req.Method = "CONNECT"
+	res := http.NewResponse(req)
+	runRequest(route.GetHandlers("CONNECT"), req, res)
+	if res.Status != 400 {
+		t.Errorf("Incorrect status! Expected %d, got %d", 400, res.Status)
+	}
+}
+
 // ----- HELPERS ------
 
+func runRequest(hs []HandleFunc, req *http.Request, res *http.Response) {
+	for _, h := range hs {
+		h(req, res)
+	}
+}
+
 func runHandlers(hs []HandleFunc) {
 	for _, h := range hs {
 		h(nil, nil)
@@ -28,7 +28,12 @@ func createOrFindRoute(root *Route, fullPath string) (*Route, bool) {
 
 		// Check if path is a parameter
 		if strings.HasPrefix(path, ":") {
-			// If the route already has a parameter subscribed, panic
+			// The same parameter is reused, like when another method is added to a path. If the route
+			// already has another parameter subscribed, panic
+			if curRoute.paramRoute != nil && curRoute.paramRoute.value == path {
+				curRoute = curRoute.paramRoute
+				continue
+			}
 			if curRoute.paramRoute != nil {
 				panic(fmt.Sprintf("Path '%s' conflicts with existing route due to '%s'", fullPath, path))
 			}
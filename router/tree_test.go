@@ -70,6 +70,12 @@ func TestCreateOrFindRoute(t *testing.T) {
 	if foundRoute.value != "test" {
 		t.Errorf("Found route has incorrect value. Expected %s, got %s", "test", newRoute.value)
 	}
+
+	// Find parameter route
+	paramRoute, _ := createOrFindRoute(route, "users/:id")
+	if foundRoute, _ := createOrFindRoute(route, "users/:id"); foundRoute != paramRoute {
+		t.Error("Parameter route was not found")
+	}
 }
 
 // ---- HELPERS ----
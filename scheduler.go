@@ -0,0 +1,300 @@
+package opal
+
+import (
+	"container/list"
+	"github.com/SveinungOverland/opal/frame"
+	"sort"
+)
+
+/*
+	This file contains the write schedulers, which decide in which
+	order the DATA frames of concurrent streams are written. Frames
+	of a single stream are always written in the order they are pushed.
+*/
+
+// Priority describes the dependency and weight of a stream - RFC7540 Section 5.3
+type Priority struct {
+	StreamDependency uint32
+	Weight           byte // The weight minus one, as it is sent in HEADERS and PRIORITY frames
+	Exclusive        bool
+}
+
+// The priority every stream is assigned by default - RFC7540 Section 5.3.5
+var defaultPriority = Priority{StreamDependency: 0, Weight: 15}
+
+// WriteScheduler decides which stream gets to write its next frame
+type WriteScheduler interface {
+	// OpenStream registers a new stream with a given priority
+	OpenStream(streamID uint32, priority Priority)
+
+	// CloseStream removes a stream and drops its queued frames
+	CloseStream(streamID uint32)
+
+	// AdjustStream changes the priority of a stream, which may not be opened yet
+	AdjustStream(streamID uint32, priority Priority)
+
+	// Push queues a frame on its stream
+	Push(f *frame.Frame)
+
+	// Pop removes and returns the next frame to write, or nil if no frame can be written.
+	// Consume is called with the first frame of a stream, and returns the part of it
+	// that can be written now. Nil means the stream is blocked, and if anything other
+	// than the frame itself is returned, the frame stays first in the stream's queue.
+	Pop(consume func(f *frame.Frame) *frame.Frame) *frame.Frame
+}
+
+// SetWriteScheduler sets the function creating a WriteScheduler for every new connection.
+// The default is NewPriorityWriteScheduler.
+func (s *Server) SetWriteScheduler(newScheduler func() WriteScheduler) {
+	s.newScheduler = newScheduler
+}
+
+// ------- ROUND-ROBIN SCHEDULER ---------
+
+// roundRobinScheduler lets every stream with queued frames write a frame in turn, ignoring priorities
+type roundRobinScheduler struct {
+	queues map[uint32]*list.List
+	order  *list.List // Stream identifiers, the next stream to write is first
+}
+
+// NewRoundRobinWriteScheduler creates a WriteScheduler which ignores stream priorities
+func NewRoundRobinWriteScheduler() WriteScheduler {
+	return &roundRobinScheduler{
+		queues: make(map[uint32]*list.List),
+		order:  list.New(),
+	}
+}
+
+func (rr *roundRobinScheduler) OpenStream(streamID uint32, priority Priority) {
+	if _, ok := rr.queues[streamID]; !ok {
+		rr.queues[streamID] = list.New()
+		rr.order.PushBack(streamID)
+	}
+}
+
+func (rr *roundRobinScheduler) CloseStream(streamID uint32) {
+	delete(rr.queues, streamID)
+	for e := rr.order.Front(); e != nil; e = e.Next() {
+		if e.Value.(uint32) == streamID {
+			rr.order.Remove(e)
+			return
+		}
+	}
+}
+
+func (rr *roundRobinScheduler) AdjustStream(streamID uint32, priority Priority) {}
+
+func (rr *roundRobinScheduler) Push(f *frame.Frame) {
+	rr.OpenStream(f.ID, defaultPriority)
+	rr.queues[f.ID].PushBack(f)
+}
+
+func (rr *roundRobinScheduler) Pop(consume func(f *frame.Frame) *frame.Frame) *frame.Frame {
+	for e := rr.order.Front(); e != nil; e = e.Next() {
+		f := popQueue(rr.queues[e.Value.(uint32)], consume)
+		if f != nil {
+			rr.order.MoveToBack(e) // Give the other streams a turn
+			return f
+		}
+	}
+	return nil
+}
+
+// ------- PRIORITY SCHEDULER ---------
+
+// The largest number of streams the priority tree keeps that are idle, which
+// clients create by sending PRIORITY frames to group streams
+const maxIdlePriorityNodes = 100
+
+// priorityNode is a stream in the dependency tree
+type priorityNode struct {
+	id       uint32
+	weight   byte // Weight minus one
+	parent   *priorityNode
+	children map[*priorityNode]struct{}
+	queue    *list.List // Nil if the stream is idle, and not opened yet
+	vt       uint64     // Virtual time, bytes written in this subtree scaled by the weight
+}
+
+// priorityScheduler shares resources based on a dependency tree, as described in RFC7540 Section 5.3.
+// Streams are served before the streams depending on them, and siblings share resources by their weights.
+type priorityScheduler struct {
+	root  *priorityNode
+	nodes map[uint32]*priorityNode
+	idle  int // Number of nodes without a queue
+}
+
+// NewPriorityWriteScheduler creates a WriteScheduler that follows the stream priorities sent by the client
+func NewPriorityWriteScheduler() WriteScheduler {
+	root := &priorityNode{id: 0, children: make(map[*priorityNode]struct{})}
+	return &priorityScheduler{
+		root:  root,
+		nodes: map[uint32]*priorityNode{0: root},
+	}
+}
+
+func (ps *priorityScheduler) OpenStream(streamID uint32, priority Priority) {
+	n, ok := ps.nodes[streamID]
+	if !ok {
+		n = ps.addNode(streamID)
+		ps.prioritize(n, priority)
+	}
+	if n.queue == nil {
+		n.queue = list.New()
+		ps.idle--
+	}
+}
+
+func (ps *priorityScheduler) CloseStream(streamID uint32) {
+	n, ok := ps.nodes[streamID]
+	if !ok || n == ps.root {
+		return
+	}
+	if n.queue == nil {
+		ps.idle--
+	}
+
+	// The children of a closed stream depends on its parent, and shares its weight - RFC7540 Section 5.3.4
+	totalWeight := 0
+	for child := range n.children {
+		totalWeight += int(child.weight) + 1
+	}
+	for child := range n.children {
+		weight := (int(n.weight) + 1) * (int(child.weight) + 1) / totalWeight
+		if weight < 1 {
+			weight = 1
+		}
+		child.weight = byte(weight - 1)
+		ps.move(child, n.parent)
+	}
+	delete(n.parent.children, n)
+	delete(ps.nodes, streamID)
+}
+
+func (ps *priorityScheduler) AdjustStream(streamID uint32, priority Priority) {
+	n, ok := ps.nodes[streamID]
+	if !ok {
+		if ps.idle >= maxIdlePriorityNodes {
+			return
+		}
+		n = ps.addNode(streamID)
+	}
+	ps.prioritize(n, priority)
+}
+
+func (ps *priorityScheduler) Push(f *frame.Frame) {
+	n, ok := ps.nodes[f.ID]
+	if !ok || n.queue == nil {
+		ps.OpenStream(f.ID, defaultPriority)
+		n = ps.nodes[f.ID]
+	}
+	n.queue.PushBack(f)
+}
+
+func (ps *priorityScheduler) Pop(consume func(f *frame.Frame) *frame.Frame) *frame.Frame {
+	f, _ := ps.pop(ps.root, consume)
+	return f
+}
+
+// Pop finds the next frame to write in the subtree of a node. A stream is served before its
+// dependencies, which are served by the lowest virtual time, so siblings get their weighted share.
+func (ps *priorityScheduler) pop(n *priorityNode, consume func(f *frame.Frame) *frame.Frame) (*frame.Frame, bool) {
+	if f := popQueue(n.queue, consume); f != nil {
+		return f, true
+	}
+
+	children := make([]*priorityNode, 0, len(n.children))
+	for child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].vt == children[j].vt {
+			return children[i].id < children[j].id
+		}
+		return children[i].vt < children[j].vt
+	})
+	for _, child := range children {
+		if f, ok := ps.pop(child, consume); ok {
+			child.vt += uint64(f.Length+1) * 256 / (uint64(child.weight) + 1)
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// ---- HELPERS -----
+
+func (ps *priorityScheduler) addNode(streamID uint32) *priorityNode {
+	n := &priorityNode{
+		id:       streamID,
+		weight:   defaultPriority.Weight,
+		parent:   ps.root,
+		children: make(map[*priorityNode]struct{}),
+	}
+	ps.nodes[streamID] = n
+	ps.root.children[n] = struct{}{}
+	ps.idle++
+	return n
+}
+
+// Prioritize makes a node depend on another node - RFC7540 Section 5.3.3
+func (ps *priorityScheduler) prioritize(n *priorityNode, priority Priority) {
+	n.weight = priority.Weight
+	parent, ok := ps.nodes[priority.StreamDependency]
+	if !ok || parent == n {
+		// Depending on an unknown stream gives the default priority - RFC7540 Section 5.3.1
+		parent = ps.root
+		n.weight = defaultPriority.Weight
+	}
+
+	// If the new parent depends on the node, it is first moved to the node's former parent
+	for p := parent.parent; p != nil; p = p.parent {
+		if p == n {
+			ps.move(parent, n.parent)
+			break
+		}
+	}
+
+	// An exclusive dependency makes the node the only child of the parent
+	if priority.Exclusive {
+		for child := range parent.children {
+			if child != n {
+				ps.move(child, n)
+			}
+		}
+	}
+	ps.move(n, parent)
+}
+
+// Move attaches a node to a new parent. The virtual time starts at the lowest among
+// its new siblings, so it does not get more than its share.
+func (ps *priorityScheduler) move(n *priorityNode, parent *priorityNode) {
+	if n.parent == parent {
+		return
+	}
+	delete(n.parent.children, n)
+	n.parent = parent
+
+	n.vt = 0
+	first := true
+	for sibling := range parent.children {
+		if first || sibling.vt < n.vt {
+			n.vt = sibling.vt
+			first = false
+		}
+	}
+	parent.children[n] = struct{}{}
+}
+
+// PopQueue removes and returns the part of the first frame of a queue that can be written
+func popQueue(queue *list.List, consume func(f *frame.Frame) *frame.Frame) *frame.Frame {
+	if queue == nil || queue.Len() == 0 {
+		return nil
+	}
+	first := queue.Front()
+	f := consume(first.Value.(*frame.Frame))
+	if f == first.Value {
+		queue.Remove(first)
+	}
+	return f
+}
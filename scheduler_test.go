@@ -0,0 +1,139 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"testing"
+)
+
+func TestRoundRobinScheduler(t *testing.T) {
+	ws := NewRoundRobinWriteScheduler()
+	ws.OpenStream(1, defaultPriority)
+	ws.OpenStream(3, defaultPriority)
+	for i := 0; i < 2; i++ {
+		ws.Push(newTestDataFrame(1, 10))
+		ws.Push(newTestDataFrame(3, 10))
+	}
+
+	expected := []uint32{1, 3, 1, 3}
+	for i, id := range popAll(ws, writeAll) {
+		if id != expected[i] {
+			t.Fatalf("Incorrect write order. Expected %v, got stream %d at %d", expected, id, i)
+		}
+	}
+}
+
+func TestPrioritySchedulerDependency(t *testing.T) {
+	ws := NewPriorityWriteScheduler()
+	ws.OpenStream(1, defaultPriority)
+	ws.OpenStream(3, Priority{StreamDependency: 1, Weight: 15})
+	ws.Push(newTestDataFrame(3, 10))
+	ws.Push(newTestDataFrame(1, 10))
+	ws.Push(newTestDataFrame(3, 10))
+
+	// Stream 3 depends on stream 1, so stream 1 is written first
+	expected := []uint32{1, 3, 3}
+	for i, id := range popAll(ws, writeAll) {
+		if id != expected[i] {
+			t.Fatalf("Incorrect write order. Expected %v, got stream %d at %d", expected, id, i)
+		}
+	}
+}
+
+func TestPrioritySchedulerWeight(t *testing.T) {
+	ws := NewPriorityWriteScheduler()
+	ws.OpenStream(1, Priority{Weight: 255})
+	ws.OpenStream(3, Priority{Weight: 63})
+	for i := 0; i < 50; i++ {
+		ws.Push(newTestDataFrame(1, 100))
+		ws.Push(newTestDataFrame(3, 100))
+	}
+
+	// Stream 1 has four times the weight of stream 3, and should get about four times the frames
+	written := map[uint32]int{}
+	for _, id := range popAll(ws, writeAll)[:50] {
+		written[id]++
+	}
+	if written[1] < 38 || written[1] > 42 {
+		t.Errorf("Weights were not respected. Stream 1 wrote %d of 50 frames, expected about 40", written[1])
+	}
+}
+
+func TestPrioritySchedulerExclusive(t *testing.T) {
+	ws := NewPriorityWriteScheduler()
+	ws.OpenStream(1, defaultPriority)
+	ws.OpenStream(3, defaultPriority)
+	ws.OpenStream(5, Priority{StreamDependency: 0, Weight: 15, Exclusive: true})
+	ws.Push(newTestDataFrame(1, 10))
+	ws.Push(newTestDataFrame(3, 10))
+	ws.Push(newTestDataFrame(5, 10))
+
+	// Stream 1 and 3 now depend on stream 5
+	ids := popAll(ws, writeAll)
+	if len(ids) != 3 || ids[0] != 5 {
+		t.Errorf("Exclusive stream was not written first. Got %v", ids)
+	}
+}
+
+func TestPrioritySchedulerClose(t *testing.T) {
+	ws := NewPriorityWriteScheduler()
+	ws.OpenStream(1, defaultPriority)
+	ws.OpenStream(3, Priority{StreamDependency: 1, Weight: 15})
+	ws.Push(newTestDataFrame(1, 10))
+	ws.Push(newTestDataFrame(3, 10))
+	ws.CloseStream(1)
+
+	// Frames of a closed stream are dropped, and its dependencies are kept
+	ids := popAll(ws, writeAll)
+	if len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("Expected only stream 3 to be written. Got %v", ids)
+	}
+}
+
+func TestPrioritySchedulerBlocked(t *testing.T) {
+	ws := NewPriorityWriteScheduler()
+	ws.OpenStream(1, defaultPriority)
+	ws.OpenStream(3, Priority{StreamDependency: 1, Weight: 15})
+	ws.Push(newTestDataFrame(1, 10))
+	ws.Push(newTestDataFrame(3, 10))
+
+	// A blocked stream does not stop the streams depending on it
+	blocked := func(f *frame.Frame) *frame.Frame {
+		if f.ID == 1 {
+			return nil
+		}
+		return f
+	}
+	ids := popAll(ws, blocked)
+	if len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("Expected only stream 3 to be written. Got %v", ids)
+	}
+	if f := ws.Pop(writeAll); f == nil || f.ID != 1 {
+		t.Error("Blocked frame was not kept in the queue")
+	}
+}
+
+// ------- HELPERS ---------
+
+func writeAll(f *frame.Frame) *frame.Frame {
+	return f
+}
+
+// PopAll pops frames until the scheduler returns nil, and returns their stream identifiers
+func popAll(ws WriteScheduler, consume func(f *frame.Frame) *frame.Frame) []uint32 {
+	ids := []uint32{}
+	for f := ws.Pop(consume); f != nil; f = ws.Pop(consume) {
+		ids = append(ids, f.ID)
+	}
+	return ids
+}
+
+func newTestDataFrame(streamID uint32, length int) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.DataType,
+		Flags:   &types.DataFlags{},
+		Payload: &types.DataPayload{Data: make([]byte, length)},
+		Length:  uint32(length),
+	}
+}
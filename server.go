@@ -2,14 +2,30 @@ package opal
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/http"
 	"github.com/SveinungOverland/opal/router"
 	"net"
+	"sync"
+	"time"
 
 	"context"
 )
 
+// ErrServerClosed is returned by Listen after a call to Shutdown
+var ErrServerClosed = errors.New("opal: Server closed")
+
+// defaultMaxConcurrentStreams is the number of concurrent streams a client may open by default
+const defaultMaxConcurrentStreams = 250
+
+// defaultMaxBodySize is the largest HTTP/1.1 request body that is read by default
+const defaultMaxBodySize = 10 << 20
+
+// shutdownPollInterval is how often Shutdown checks if all connections are drained
+const shutdownPollInterval = 100 * time.Millisecond
+
 // Server represents a HTTP-server
 type Server struct {
 	cert          tls.Certificate
@@ -17,7 +33,31 @@ type Server struct {
 	connErrorChan *chan error
 	rootRoute     *router.Route
 
-	middlewares []router.HandleFunc
+	middlewares     []router.HandleFunc
+	newScheduler    func() WriteScheduler
+	settings        Settings
+	settingsTimeout time.Duration
+	handlerTimeout  time.Duration
+	panicHandler    PanicHandler
+	accessLogger    AccessLogger
+	maxBodySize     int64
+
+	mu         sync.Mutex
+	listener   net.Listener
+	conns      map[*Conn]struct{} // All live connections
+	inShutdown bool
+}
+
+// NewServer creates a new http2-server without TLS. It serves cleartext HTTP/2 (h2c), both
+// with prior knowledge and by upgrading from HTTP/1.1.
+func NewServer() *Server {
+	return &Server{
+		isTLS:        false,
+		rootRoute:    router.NewRoot(),
+		middlewares:  make([]router.HandleFunc, 0),
+		newScheduler: NewPriorityWriteScheduler,
+		settings:     DefaultSettings(),
+	}
 }
 
 // NewTLSServer creates a new http2-server with a TLS configuration
@@ -28,10 +68,12 @@ func NewTLSServer(certPath, privateKeyPath string) (*Server, error) {
 	}
 
 	return &Server{
-		cert:        cert,
-		isTLS:       true,
-		rootRoute:   router.NewRoot(),
-		middlewares: make([]router.HandleFunc, 0),
+		cert:         cert,
+		isTLS:        true,
+		rootRoute:    router.NewRoot(),
+		middlewares:  make([]router.HandleFunc, 0),
+		newScheduler: NewPriorityWriteScheduler,
+		settings:     DefaultSettings(),
 	}, nil
 }
 
@@ -50,18 +92,95 @@ func (s *Server) Listen(port int16) error {
 	}
 	defer listener.Close()
 
+	// Register listener, so Shutdown is able to close it
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			s.nonBlockingErrorChanSend(err)
 			continue
 		}
 
 		c := s.createConn(conn)
+		if !s.trackConn(c, true) {
+			c.close() // Accepted while the listener was being closed
+			return ErrServerClosed
+		}
 		go c.serve()
 	}
 }
 
+// ServeConn serves a single connection, like a connection from a custom listener or from net.Pipe.
+// It returns when the connection is closed. The connection is closed right away if the server is shut down.
+func (s *Server) ServeConn(conn net.Conn) {
+	c := s.createConn(conn)
+	if !s.trackConn(c, true) {
+		c.close()
+		return
+	}
+	c.serve()
+}
+
+// ServeRequest runs the middlewares and handlers of a request's route without a connection, and returns
+// the response. Data flushed by the handlers is written to the StreamWriter of res, if it has one.
+// The returned response is a new 503 response if the handlers time out. If they time out or panic after
+// the headers are flushed, nil is returned, where a connection would reset the stream.
+func (s *Server) ServeRequest(req *http.Request, res *http.Response) *http.Response {
+	if res.StreamWriter() == nil {
+		return runHandlers(&Conn{server: s}, req, res, nil)
+	}
+	writer := &requestWriter{w: res.StreamWriter()}
+	res.SetStreamWriter(writer)
+	return runHandlers(&Conn{server: s}, req, res, writer)
+}
+
+// Shutdown gracefully shuts down the server. It closes the listener, sends a GOAWAY frame
+// to every live connection, and waits for in-flight streams to finish. If the context expires
+// before all connections are drained, the remaining connections are closed and the
+// context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	// Tell every client that no new streams will be processed
+	for _, c := range conns {
+		c.shutdown()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.numConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 // Register registers a router to the server
 func (s *Server) Register(r *router.Router) {
 	s.rootRoute.AppendRouter(r)
@@ -75,15 +194,22 @@ func (s *Server) Use(handler router.HandleFunc) {
 func (s *Server) createConn(conn net.Conn) *Conn {
 	ctx, cancel := context.WithCancel(context.Background())
 	c := &Conn{
-		ctx:          ctx,
-		cancel:       cancel,
-		server:       s,
-		conn:         conn,
-		isTLS:        false,
-		streams:      make(map[uint32]*Stream),
-		inChan:       make(chan *Stream, 10),
-		outChan:      make(chan *Stream, 10),
-		outChanFrame: make(chan *frame.Frame),
+		ctx:           ctx,
+		cancel:        cancel,
+		server:        s,
+		conn:          conn,
+		isTLS:         false,
+		streams:       make(map[uint32]*Stream),
+		active:        make(map[uint32]struct{}),
+		inChan:        make(chan *Stream, 10),
+		outChan:       make(chan *Stream), // Unbuffered, so header blocks are queued in the order they are encoded
+		outChanFrame:  make(chan *frame.Frame),
+		sendFlow:      newSendFlow(),
+		flowSignal:    make(chan struct{}, 1),
+		overdueDone:   make(chan struct{}, 1),
+		recvWindow:    initialWindowSize,
+		recvInitial:   initialWindowSize,
+		localSettings: s.settings,
 		settings: map[uint16]uint32{
 			// !ok value should be treated as no-limit
 			1: 4096, // Header Table Size
@@ -95,11 +221,19 @@ func (s *Server) createConn(conn net.Conn) *Conn {
 		},
 	}
 
+	// Servers that are not created by NewServer or NewTLSServer have no scheduler function
+	if s.newScheduler != nil {
+		c.scheduler = s.newScheduler()
+	} else {
+		c.scheduler = NewPriorityWriteScheduler()
+	}
+	c.sendFlow.closed = c.streamClosed
+
 	if s.isTLS {
 		config := &tls.Config{
 			Certificates: []tls.Certificate{s.cert},
-			ServerName:   "localhost", //Todo: change this
-			NextProtos:   []string{"h2"},
+			ServerName:   "localhost",                //Todo: change this
+			NextProtos:   []string{"h2", "http/1.1"}, // Clients without HTTP/2 support falls back to HTTP/1.1
 		}
 		c.tlsConn = tls.Server(conn, config)
 		c.isTLS = true
@@ -108,6 +242,19 @@ func (s *Server) createConn(conn net.Conn) *Conn {
 	return c
 }
 
+// SetMaxConcurrentStreams sets the number of streams each client may have open at the same time.
+// Streams opened beyond the limit are refused. Zero removes the limit. The default is 250.
+func (s *Server) SetMaxConcurrentStreams(n uint32) {
+	s.settings.MaxConcurrentStreams = n
+}
+
+// SetMaxBodySize sets the largest request body the server reads. Zero means 10 MB, which is the default.
+// Larger requests get a 413 response, and over HTTP/1.1 the connection is then closed. Over HTTP/2 the
+// stream is reset instead if the response headers are already sent.
+func (s *Server) SetMaxBodySize(n int64) {
+	s.maxBodySize = n
+}
+
 // SetErrorChan sets a errorChannel for retrieving internal errors from the server
 func (s *Server) SetErrorChan(errorChannel *chan error) {
 	s.connErrorChan = errorChannel
@@ -125,3 +272,58 @@ func (s *Server) nonBlockingErrorChanSend(err error) {
 		fmt.Println("Error occurred but error channel does not exist")
 	}
 }
+
+// ------- HELPERS ---------
+
+// TrackConn adds or removes a connection from the set of live connections. Returns false if a connection
+// is not added because the server is shutting down, as Shutdown would never send it a GOAWAY frame.
+func (s *Server) trackConn(c *Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// BodyLimit returns the largest request body the server reads
+func (s *Server) bodyLimit() int64 {
+	if s.maxBodySize == 0 {
+		return defaultMaxBodySize
+	}
+	return s.maxBodySize
+}
+
+func (s *Server) numConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// CloseConns forcefully closes all live connections
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
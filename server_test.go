@@ -0,0 +1,137 @@
+package opal
+
+import (
+	"context"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesListener(t *testing.T) {
+	srv := newTestServer()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.Listen(0)
+	}()
+
+	// Give the listener some time to start
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned an error: %v", err)
+	}
+
+	select {
+	case err := <-errChan:
+		if err != ErrServerClosed {
+			t.Errorf("Listen returned wrong error! Expected %v, got %v", ErrServerClosed, err)
+		}
+	case <-ctx.Done():
+		t.Error("Listen did not return after Shutdown")
+	}
+}
+
+func TestServeConnAfterShutdown(t *testing.T) {
+	srv := NewServer()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	// A connection served after Shutdown is closed, and not left for Shutdown to wait on
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(serverConn)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn did not return after Shutdown")
+	}
+	if n := srv.numConns(); n != 0 {
+		t.Errorf("Connection was tracked after Shutdown! Expected %d connections, got %d", 0, n)
+	}
+	if _, err := clientConn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection was not closed")
+	}
+}
+
+func TestConnShutdownDrainsStreams(t *testing.T) {
+	conn := newTestConn()
+	conn.ready = true
+	conn.acceptStream(1)
+	conn.acceptStream(3)
+	conn.dispatch(newTestStream(3, nil, []byte{}))
+
+	go conn.shutdown()
+
+	// A GOAWAY should be sent with the last processed stream
+	goAway := <-conn.outChanFrame
+	if goAway.Type != frame.GoAwayType {
+		t.Fatalf("Incorrect frame type! Expected %d, got %d", frame.GoAwayType, goAway.Type)
+	}
+	payload := goAway.Payload.(*types.GoAwayPayload)
+	if payload.LastStreamID != 3 {
+		t.Errorf("Incorrect last stream id! Expected %d, got %d", 3, payload.LastStreamID)
+	}
+	if payload.ErrorCode != constants.NoError {
+		t.Errorf("Incorrect error code! Expected %d, got %d", constants.NoError, payload.ErrorCode)
+	}
+
+	// New streams should be ignored after a GOAWAY
+	if conn.acceptStream(5) {
+		t.Error("Stream initiated after GOAWAY was accepted")
+	}
+
+	// The connection is drained when all in-flight streams are written
+	if conn.drained() {
+		t.Error("Connection is drained while a stream is still in-flight")
+	}
+	conn.streamFinished(3)
+	if !conn.drained() {
+		t.Error("Connection is not drained after all streams are written")
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	r := router.NewRouter("/")
+	r.Get("/wait", func(req *http.Request, res *http.Response) {
+		<-release
+	})
+
+	srv := NewServer()
+	srv.SetMaxConcurrentStreams(1)
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	defer close(release)
+	client.handshake()
+
+	// The limit should be announced in the server's SETTINGS
+	settings := client.readFrame(t, frame.SettingsType, 0)
+	if settings.Flags.(*types.SettingsFlags).Ack {
+		t.Fatal("Server did not send its SETTINGS before the acknowledgement")
+	}
+	if limit := settings.Payload.(*types.SettingsPayload).IDValuePair[3]; limit != 1 {
+		t.Errorf("Incorrect SETTINGS_MAX_CONCURRENT_STREAMS! Expected %d, got %d", 1, limit)
+	}
+
+	// The second stream exceeds the limit while the first is handled
+	client.writeHeaders(1, "/wait", "GET", true)
+	client.writeHeaders(3, "/wait", "GET", true)
+	rst := client.readFrame(t, frame.RstStreamType, 3)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.RefusedStream {
+		t.Errorf("Incorrect error code! Expected %d, got %d", constants.RefusedStream, code)
+	}
+}
@@ -0,0 +1,137 @@
+package opal
+
+import (
+	"errors"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	This file contains the settings the server announces to its clients,
+	RFC7540 Section 6.5. The client's settings are stored at each
+	connection (Conn), see Conn.applySettings.
+*/
+
+// ErrInvalidSettings is returned by SetSettings when a value is out of range
+var ErrInvalidSettings = errors.New("opal: Invalid settings")
+
+// defaultSettingsTimeout is how long the server waits for the client to acknowledge its settings
+const defaultSettingsTimeout = 10 * time.Second
+
+// Settings are the parameters the server announces in its SETTINGS frame
+type Settings struct {
+	HeaderTableSize       uint32 // Size of the HPACK table used to decode request headers
+	EnablePush            bool   // Server push is never used if false, regardless of the client's settings
+	MaxConcurrentStreams  uint32 // Zero means no limit
+	InitialWindowSize     uint32 // Initial receive window of every stream
+	MaxFrameSize          uint32 // Largest frame payload the server accepts
+	MaxHeaderListSize     uint32 // Limit of the request headers' decoded size. Larger header lists close the connection. Zero means 1 MB
+	EnableConnectProtocol bool   // Announces that WebSockets can be opened with extended CONNECT requests - RFC8441
+}
+
+// DefaultSettings returns the settings every server uses by default
+func DefaultSettings() Settings {
+	return Settings{
+		HeaderTableSize:       initialHeaderTableSize,
+		EnablePush:            true,
+		MaxConcurrentStreams:  defaultMaxConcurrentStreams,
+		InitialWindowSize:     initialWindowSize,
+		MaxFrameSize:          16384,
+		MaxHeaderListSize:     0,
+		EnableConnectProtocol: true,
+	}
+}
+
+// SetSettings sets the settings announced to new connections. Start from DefaultSettings
+// to only change some of them. Returns ErrInvalidSettings if any of the values are out of range.
+func (s *Server) SetSettings(settings Settings) error {
+	if settings.InitialWindowSize > maxWindowSize ||
+		settings.MaxFrameSize < 16384 || settings.MaxFrameSize > frame.MaxFrameSizeLimit {
+		return ErrInvalidSettings
+	}
+	s.settings = settings
+	return nil
+}
+
+// SetSettingsTimeout sets how long the server waits for a client to acknowledge its settings,
+// before the connection is closed with a SETTINGS_TIMEOUT error. The default is 10 seconds.
+func (s *Server) SetSettingsTimeout(timeout time.Duration) {
+	s.settingsTimeout = timeout
+}
+
+// ------- HELPERS ---------
+
+// ToFrame creates the SETTINGS frame announcing the settings
+func (settings Settings) toFrame() *frame.Frame {
+	values := map[uint16]uint32{
+		0x1: settings.HeaderTableSize,
+		0x4: settings.InitialWindowSize,
+		0x5: settings.MaxFrameSize,
+	}
+	if !settings.EnablePush {
+		values[0x2] = 0 // A server does not announce that push is enabled, as only servers push
+	}
+	if settings.MaxConcurrentStreams != 0 {
+		values[0x3] = settings.MaxConcurrentStreams
+	}
+	values[0x6] = settings.headerListLimit() // The default limit is announced, as the protocol's default is no limit
+	if settings.EnableConnectProtocol {
+		values[0x8] = 1 // SETTINGS_ENABLE_CONNECT_PROTOCOL - RFC8441 Section 3
+	}
+	return &frame.Frame{
+		ID:      0,
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{},
+		Payload: &types.SettingsPayload{IDValuePair: values},
+		Length:  uint32(len(values) * 6),
+	}
+}
+
+// HeaderListLimit returns the limit of the request headers' size, which is 1 MB if MaxHeaderListSize is not set
+func (settings Settings) headerListLimit() uint32 {
+	if settings.MaxHeaderListSize != 0 {
+		return settings.MaxHeaderListSize
+	}
+	return defaultMaxHeaderListSize
+}
+
+// SendSettings sends the server's settings, and closes the connection if they are not acknowledged in time
+func (c *Conn) sendSettings() {
+	c.sendFrame(c.localSettings.toFrame())
+
+	timeout := c.server.settingsTimeout
+	if timeout == 0 {
+		timeout = defaultSettingsTimeout
+	}
+	c.mu.Lock()
+	c.settingsTimer = time.AfterFunc(timeout, func() {
+		// The writer closes the connection after the GOAWAY is written
+		c.sendFrame(c.newGoAwayFrame(constants.SettingsTimeout))
+	})
+	c.mu.Unlock()
+}
+
+// SettingsAcked applies the settings that only take effect when the client has received them
+func (c *Conn) settingsAcked() {
+	c.mu.Lock()
+	if c.settingsTimer != nil {
+		c.settingsTimer.Stop()
+		c.settingsTimer = nil
+	}
+	c.mu.Unlock()
+
+	// The receive windows of open streams are adjusted by the change - RFC7540 Section 6.9.2
+	delta := int32(c.localSettings.InitialWindowSize) - c.recvInitial
+	c.recvInitial = int32(c.localSettings.InitialWindowSize)
+	if delta != 0 {
+		streamMapMutex.Lock()
+		for _, stream := range c.streams {
+			atomic.AddInt32(&stream.recvWindow, delta)
+		}
+		streamMapMutex.Unlock()
+	}
+	c.fr.MaxFrameSize = c.localSettings.MaxFrameSize
+}
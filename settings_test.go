@@ -0,0 +1,135 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"testing"
+	"time"
+)
+
+func TestSetSettings(t *testing.T) {
+	srv := NewServer()
+	settings := DefaultSettings()
+	settings.MaxFrameSize = 1000
+	if err := srv.SetSettings(settings); err != ErrInvalidSettings {
+		t.Errorf("Too small max frame size was accepted. Expected %v, got %v", ErrInvalidSettings, err)
+	}
+	settings.MaxFrameSize = 1 << 20
+	if err := srv.SetSettings(settings); err != nil {
+		t.Errorf("Valid settings were not accepted: %v", err)
+	}
+}
+
+func TestServerSendsSettings(t *testing.T) {
+	srv := NewServer()
+	settings := DefaultSettings()
+	settings.EnablePush = false
+	settings.MaxHeaderListSize = 8192
+	srv.SetSettings(settings)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	f := client.readFrame(t, frame.SettingsType, 0)
+	if f.Flags.(*types.SettingsFlags).Ack {
+		t.Fatal("Server did not send its SETTINGS before the acknowledgement")
+	}
+	expected := map[uint16]uint32{
+		0x1: initialHeaderTableSize,
+		0x2: 0,
+		0x3: defaultMaxConcurrentStreams,
+		0x4: initialWindowSize,
+		0x5: 16384,
+		0x6: 8192,
+		0x8: 1,
+	}
+	values := f.Payload.(*types.SettingsPayload).IDValuePair
+	if len(values) != len(expected) {
+		t.Errorf("Incorrect number of settings! Expected %d, got %d", len(expected), len(values))
+	}
+	for id, value := range expected {
+		if values[id] != value {
+			t.Errorf("Incorrect value of setting %d! Expected %d, got %d", id, value, values[id])
+		}
+	}
+}
+
+func TestDefaultHeaderListSizeSent(t *testing.T) {
+	settings := DefaultSettings().toFrame().Payload.(*types.SettingsPayload).IDValuePair
+	if value, ok := settings[0x6]; !ok || value != defaultMaxHeaderListSize {
+		t.Errorf("Incorrect SETTINGS_MAX_HEADER_LIST_SIZE! Expected %d, got %d", defaultMaxHeaderListSize, value)
+	}
+}
+
+func TestHeaderTableSizeSetting(t *testing.T) {
+	srv := NewServer()
+	srv.Register(newTestRouter())
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	// The client allows no dynamic table, which the server signals in its next header block
+	settings := newTestSettingsFrame()
+	settings.Payload.(*types.SettingsPayload).IDValuePair[0x1] = 0
+	settings.Length = 6
+	client.writeFrame(settings)
+	client.writeHeaders(1, "/", "GET", true)
+
+	f := client.readFrame(t, frame.HeadersType, 1)
+	if fragment := f.Payload.(*types.HeadersPayload).Fragment; fragment[0] != 0x20 {
+		t.Errorf("Header block did not start with a size update to 0, got %x", fragment[0])
+	}
+}
+
+func TestSettingsTimeout(t *testing.T) {
+	srv := NewServer()
+	srv.SetSettingsTimeout(50 * time.Millisecond)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	// The client never acknowledges the server's settings
+	f := client.readFrame(t, frame.GoAwayType, 0)
+	if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.SettingsTimeout {
+		t.Errorf("Incorrect error code! Expected %d, got %d", constants.SettingsTimeout, code)
+	}
+	select {
+	case _, ok := <-client.frames:
+		if ok {
+			t.Error("Frame received after GOAWAY")
+		}
+	case <-time.After(time.Second):
+		t.Error("Connection was not closed after SETTINGS_TIMEOUT")
+	}
+}
+
+func TestSettingsAck(t *testing.T) {
+	srv := NewServer()
+	srv.SetSettingsTimeout(50 * time.Millisecond)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeFrame(&frame.Frame{
+		ID:      0,
+		Type:    frame.SettingsType,
+		Flags:   &types.SettingsFlags{Ack: true},
+		Payload: &types.SettingsPayload{IDValuePair: map[uint16]uint32{}},
+	})
+
+	// No GOAWAY should be sent after the timeout has passed
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case f, ok := <-client.frames:
+			if !ok {
+				t.Fatal("Connection was closed after the settings were acknowledged")
+			}
+			if f.Type == frame.GoAwayType {
+				t.Fatal("GOAWAY was sent after the settings were acknowledged")
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"sync/atomic"
+)
+
+/*
+	This file contains the stream state machine, as described in
+	RFC7540 Section 5.1. Frames received from the client are validated
+	against the state of their stream, and both received and sent
+	frames move streams between states. Closed streams are removed
+	from the connection.
+*/
+
+var streamStateNames = map[StreamState]string{
+	Idle:             "idle",
+	ReservedLocal:    "reserved (local)",
+	ReservedRemote:   "reserved (remote)",
+	Open:             "open",
+	HalfClosedLocal:  "half-closed (local)",
+	HalfClosedRemote: "half-closed (remote)",
+	Closed:           "closed",
+}
+
+// String returns the name of the state, as written in RFC7540 Section 5.1
+func (state StreamState) String() string {
+	return streamStateNames[state]
+}
+
+// ------- HELPERS ---------
+
+// GetState returns the current state of the stream
+func (s *Stream) getState() StreamState {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.state
+}
+
+// RecvFrame validates a frame received on the stream, and moves the stream to its next state.
+// Returns a constants.StreamError or constants.ConnectionError if the frame is not allowed in the current state.
+func (s *Stream) recvFrame(f *frame.Frame) (StreamState, error) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	switch f.Type {
+	case frame.PriorityType:
+		return s.state, nil // PRIORITY frames are allowed in every state
+	case frame.ContinuationType:
+		return s.state, nil // CONTINUATION frames are part of the HEADERS frame before them
+	case frame.RstStreamType, frame.WindowUpdateType:
+		if s.state == Idle {
+			return s.state, constants.ConnectionError{Code: constants.ProtocolError, Reason: "frame on idle stream"}
+		}
+		if f.Type == frame.RstStreamType {
+			s.state = Closed
+		}
+		return s.state, nil
+	}
+
+	switch s.state {
+	case Idle:
+		if f.Type != frame.HeadersType {
+			return s.state, constants.ConnectionError{Code: constants.ProtocolError, Reason: "frame on idle stream"}
+		}
+		s.state = Open
+	case ReservedLocal:
+		return s.state, constants.ConnectionError{Code: constants.ProtocolError, Reason: "frame on reserved stream"}
+	case HalfClosedRemote, Closed:
+		return s.state, constants.StreamError{StreamID: s.id, Code: constants.StreamClosed}
+	}
+
+	if hasEndStream(f) {
+		switch s.state {
+		case Open:
+			s.state = HalfClosedRemote
+		case HalfClosedLocal:
+			s.state = Closed
+		}
+	}
+	return s.state, nil
+}
+
+// SendFrame moves the stream to its next state after a frame is sent on it
+func (s *Stream) sendFrame(f *frame.Frame) StreamState {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	if f.Type == frame.RstStreamType {
+		s.state = Closed
+		return s.state
+	}
+	if f.Type == frame.HeadersType && s.state == ReservedLocal {
+		s.state = HalfClosedRemote // Pushed streams are half-closed when the headers are sent
+	}
+	if hasEndStream(f) {
+		switch s.state {
+		case Open:
+			s.state = HalfClosedLocal
+		case HalfClosedRemote:
+			s.state = Closed
+		}
+	}
+	return s.state
+}
+
+// CanSendData says if DATA frames can be sent on the stream
+func (s *Stream) canSendData() bool {
+	state := s.getState()
+	return state == Open || state == HalfClosedRemote
+}
+
+// HasEndStream says if a HEADERS or DATA frame has the END_STREAM flag set
+func hasEndStream(f *frame.Frame) bool {
+	switch flags := f.Flags.(type) {
+	case *types.HeadersFlags:
+		return flags.EndStream
+	case *types.DataFlags:
+		return flags.EndStream
+	}
+	return false
+}
+
+// IsIdle says if a stream identifier is not used yet. Streams with lower identifiers than the last
+// opened stream are implicitly closed - RFC7540 Section 5.1.1
+func (c *Conn) isIdle(id uint32) bool {
+	if id%2 == 0 {
+		return id > atomic.LoadUint32(&c.prevStreamID) // Streams initiated by the server
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return id > c.lastStreamID
+}
+
+// IgnoredStream says if a stream was initiated by the client after a GOAWAY was sent, so its frames are ignored
+func (c *Conn) ignoredStream(id uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return id%2 == 1 && c.draining && id > c.goAwayStreamID
+}
+
+// UnknownStream validates a frame received on a stream that is not in the stream map, which
+// means it is either idle, or closed and removed
+func (c *Conn) unknownStream(f *frame.Frame) error {
+	if c.ignoredStream(f.ID) {
+		return nil
+	}
+	if c.isIdle(f.ID) {
+		if f.Type == frame.PriorityType {
+			return nil
+		}
+		return constants.ConnectionError{Code: constants.ProtocolError, Reason: "frame on idle stream"}
+	}
+	switch f.Type {
+	case frame.DataType, frame.ContinuationType:
+		return constants.StreamError{StreamID: f.ID, Code: constants.StreamClosed}
+	}
+	return nil // PRIORITY, WINDOW_UPDATE and RST_STREAM frames may arrive after a stream is closed
+}
+
+// FrameSent moves a stream to its next state after one of its frames is written
+func (c *Conn) frameSent(f *frame.Frame) {
+	if endsStream(f) {
+		c.closeStream(f.ID)
+	}
+	if f.ID == 0 || f.Type == frame.PushPromiseType {
+		return
+	}
+	if s, ok := c.GetStream(f.ID); ok && s.sendFrame(f) == Closed {
+		c.removeStream(f.ID)
+	}
+}
+
+// RemoveStream removes a closed stream from the connection, so the stream map does not grow with every stream
+func (c *Conn) removeStream(id uint32) {
+	streamMapMutex.Lock()
+	defer streamMapMutex.Unlock()
+	delete(c.streams, id)
+}
+
+// StreamClosed says if a stream is closed, or already removed from the connection
+func (c *Conn) streamClosed(id uint32) bool {
+	s, ok := c.GetStream(id)
+	return !ok || s.isClosed()
+}
+
+// BodyAbandoned says if the handler of a stream closed the request body before the client ended it
+func (c *Conn) bodyAbandoned(id uint32) bool {
+	s, ok := c.GetStream(id)
+	return ok && s.body != nil && s.body.abandoned()
+}
+
+// CanSendData says if DATA frames can be sent on a stream
+func (c *Conn) canSendData(id uint32) bool {
+	s, ok := c.GetStream(id)
+	return ok && s.canSendData()
+}
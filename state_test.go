@@ -0,0 +1,101 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+	"time"
+)
+
+func TestStreamStateTransitions(t *testing.T) {
+	headers := &frame.Frame{ID: 1, Type: frame.HeadersType, Flags: &types.HeadersFlags{EndHeaders: true}}
+	endHeaders := &frame.Frame{ID: 1, Type: frame.HeadersType, Flags: &types.HeadersFlags{EndHeaders: true, EndStream: true}}
+	data := newTestData(1, "data", false)
+	endData := newTestData(1, "data", true)
+
+	s := &Stream{id: 1, state: Idle}
+	if _, err := s.recvFrame(data); err == nil {
+		t.Error("DATA frame on idle stream was accepted")
+	}
+	if state, err := s.recvFrame(headers); err != nil || state != Open {
+		t.Errorf("Expected %v after HEADERS, got %v with error %v", Open, state, err)
+	}
+	if state, err := s.recvFrame(endData); err != nil || state != HalfClosedRemote {
+		t.Errorf("Expected %v after END_STREAM, got %v with error %v", HalfClosedRemote, state, err)
+	}
+	expected := constants.StreamError{StreamID: 1, Code: constants.StreamClosed}
+	if _, err := s.recvFrame(data); err != expected {
+		t.Errorf("Expected %v for DATA frame on half-closed stream, got %v", expected, err)
+	}
+	if state := s.sendFrame(endHeaders); state != Closed {
+		t.Errorf("Expected %v after sending END_STREAM, got %v", Closed, state)
+	}
+
+	s = &Stream{id: 1, state: Idle}
+	s.recvFrame(headers)
+	if state := s.sendFrame(endData); state != HalfClosedLocal {
+		t.Errorf("Expected %v after sending END_STREAM, got %v", HalfClosedLocal, state)
+	}
+	if state, err := s.recvFrame(endData); err != nil || state != Closed {
+		t.Errorf("Expected %v after END_STREAM, got %v with error %v", Closed, state, err)
+	}
+
+	pushed := &Stream{id: 2, state: ReservedLocal}
+	if _, err := pushed.recvFrame(data); err == nil {
+		t.Error("DATA frame on reserved stream was accepted")
+	}
+	if state := pushed.sendFrame(headers); state != HalfClosedRemote {
+		t.Errorf("Expected %v after sending HEADERS on pushed stream, got %v", HalfClosedRemote, state)
+	}
+}
+
+func TestClosedStreamsRemoved(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Get("/", func(req *http.Request, res *http.Response) {
+		res.String(200, "ok")
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/", "GET", true)
+	client.readFrame(t, frame.DataType, 1)
+
+	timeout := time.After(time.Second)
+	for {
+		if _, ok := client.server.GetStream(1); !ok {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("Closed stream was not removed from the connection")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Frames on the removed stream are treated as frames on a closed stream
+	client.writeFrame(newTestData(1, "late", false))
+	rst := client.readFrame(t, frame.RstStreamType, 1)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.StreamClosed {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.StreamClosed, code)
+	}
+}
+
+func TestDecreasingStreamID(t *testing.T) {
+	srv := NewServer()
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(3, "/", "GET", true)
+	client.writeHeaders(1, "/", "GET", true)
+
+	f := client.readFrame(t, frame.GoAwayType, 0)
+	if code := f.Payload.(*types.GoAwayPayload).ErrorCode; code != constants.ProtocolError {
+		t.Errorf("Incorrect error code! Expected %v, got %v", constants.ProtocolError, code)
+	}
+}
@@ -1,10 +1,14 @@
 package opal
 
 import (
+	"context"
 	"github.com/SveinungOverland/opal/frame"
 	"github.com/SveinungOverland/opal/hpack"
 	"github.com/SveinungOverland/opal/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type StreamState uint8
@@ -20,28 +24,42 @@ const (
 )
 
 type Stream struct {
+	queued           int64 // Bytes of a streamed response that are queued but not written, accessed atomically
 	id               uint32
 	streamDependency uint32
 	priorityWeight   byte
+	recvWindow       int32 // Stream-level receive window, accessed atomically
 	lastFrame        *frame.Frame
-	state            StreamState
-	headers          []byte
+	state            StreamState // Guarded by stateMu, see state.go
+	stateMu          sync.Mutex
+	headers          []byte               // The encoded response headers
+	trailer          []byte               // The encoded response trailers, nil if there are none
+	fields           []*hpack.HeaderField // The decoded request headers
 	data             []byte
+	request          *http.Request // A request that is already built, like the request of a h2c upgrade
+	body             *requestBody  // The request body, fed by DATA frames
+	contentLength    int64         // The content-length of the request body, -1 if it is not announced
+	received         int64         // Bytes of request body received in DATA frames
+	streaming        bool          // Set when the response is streamed, and the stream is not ended by the headers
+	flushed          chan struct{} // Signaled when all queued data is written, or the stream is closed
+	closed           int32         // Set to 1 when the stream is closed, accessed atomically
+	done             chan struct{} // Closed when the stream is closed
+	ctx              context.Context
+	cancel           context.CancelFunc // Cancels the context of the request when the stream is closed
 }
 
 // toRequest builds and returns a Request based on recieved headers and data frames
-func (s *Stream) toRequest(context *hpack.Context) (*http.Request, error) {
-	// Merge and Decode headers
-	decoded, err := context.Decode(s.headers) // Header decompression
-	if err != nil {
-		return nil, err
+func (s *Stream) toRequest() *http.Request {
+	if s.request != nil {
+		return s.request
 	}
 
 	// Build request
 	req := http.NewRequest()
+	req.Proto = "HTTP/2"
 
 	// Parse Headers
-	for _, hf := range decoded {
+	for _, hf := range s.fields {
 		if strings.HasPrefix(hf.Name, ":") {
 			parsePseudoHeader(req, hf.Name, hf.Value)
 		} else {
@@ -50,13 +68,99 @@ func (s *Stream) toRequest(context *hpack.Context) (*http.Request, error) {
 	}
 
 	// Set body
-	req.Body = s.data
+	if s.body != nil {
+		req.SetBodyReader(s.body)
+		req.Trailer = s.body.trailer // Filled in when the trailers are received
+	} else {
+		req.Body = s.data // The body is already received
+	}
 
-	return req, nil
+	return req
 }
 
 // ------- HELPERS ---------
 
+// MarkClosed marks the stream as closed, and wakes up handlers writing to it
+func (s *Stream) markClosed() {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return
+	}
+	if s.done != nil {
+		close(s.done)
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	signalFlushed(s)
+}
+
+// IsClosed says if the stream is closed, by being ended or reset
+func (s *Stream) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// ValidRequestHeaders checks that the header fields of a request are well-formed - RFC7540 Section 8.1.2.
+// ConnectProtocol says if the server has announced extended CONNECT requests.
+// Returns the content-length of the request, or -1 if it has none.
+func validRequestHeaders(hfs []*hpack.HeaderField, connectProtocol bool) (contentLength int64, ok bool) {
+	contentLength = -1
+	pseudo := make(map[string]string)
+	regular := false
+	for _, hf := range hfs {
+		if strings.ToLower(hf.Name) != hf.Name {
+			return -1, false // Header field names must be lowercase
+		}
+		if strings.HasPrefix(hf.Name, ":") {
+			if _, known := requestPseudoHeaders[hf.Name]; !known || regular {
+				return -1, false // Only the request pseudo-headers are allowed, before all regular headers
+			}
+			if _, duplicate := pseudo[hf.Name]; duplicate {
+				return -1, false
+			}
+			pseudo[hf.Name] = hf.Value
+			continue
+		}
+		regular = true
+		switch hf.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return -1, false // Connection-specific headers are not used in HTTP/2
+		case "te":
+			if hf.Value != "trailers" {
+				return -1, false
+			}
+		case "content-length":
+			length, err := strconv.ParseInt(hf.Value, 10, 64)
+			if err != nil || length < 0 {
+				return -1, false
+			}
+			contentLength = length
+		}
+	}
+
+	method, hasMethod := pseudo[":method"]
+	_, hasScheme := pseudo[":scheme"]
+	path, hasPath := pseudo[":path"]
+	_, hasProtocol := pseudo[":protocol"]
+	if method == "CONNECT" && !hasProtocol {
+		// A CONNECT request only has the authority of the proxied connection - RFC7540 Section 8.3
+		_, hasAuthority := pseudo[":authority"]
+		return contentLength, hasAuthority && !hasScheme && !hasPath
+	}
+	if hasProtocol && (method != "CONNECT" || !connectProtocol) {
+		// The protocol is only used by extended CONNECT requests, if the server supports them - RFC8441 Sections 3 and 4
+		return -1, false
+	}
+	return contentLength, hasMethod && hasScheme && hasPath && path != ""
+}
+
+var requestPseudoHeaders = map[string]struct{}{
+	":method":    {},
+	":scheme":    {},
+	":authority": {},
+	":path":      {},
+	":protocol":  {},
+}
+
 // Parses HTTP2 Psuedo-Request-Header fields that starts with ":".
 func parsePseudoHeader(req *http.Request, headerName string, value string) {
 	switch headerName {
@@ -75,5 +179,7 @@ func parsePseudoHeader(req *http.Request, headerName string, value string) {
 		}
 	case ":scheme":
 		req.Scheme = value
+	case ":protocol":
+		req.Protocol = value
 	}
 }
@@ -2,6 +2,7 @@ package opal
 
 import (
 	"container/list"
+	"github.com/SveinungOverland/opal/constants"
 	"github.com/SveinungOverland/opal/frame"
 	"github.com/SveinungOverland/opal/frame/types"
 )
@@ -14,13 +15,18 @@ import (
 
 func WriteStream(c *Conn) {
 	// Init variables needed for function
-	frames := list.New() // Queue for frames
+	frames := list.New() // Queue for frames that are not DATA
 
 	// Helper funcs
+	// DATA frames and trailers are ordered by the write scheduler. Other HEADERS frames are only added by addStream.
 	addFrame := func(f *frame.Frame) {
 		if f == nil {
 			return
 		}
+		if f.Type == frame.DataType || f.Type == frame.HeadersType {
+			c.withScheduler(func(ws WriteScheduler) { ws.Push(f) })
+			return
+		}
 		frames.PushBack(f)
 	}
 
@@ -30,88 +36,51 @@ func WriteStream(c *Conn) {
 		}
 
 		// TODO: Check stream state, to make sure client is waiting to receive frames
-		maxPayloadSize := c.settings[5]
-		// Create Header Frame
-		headerLength := uint32(len(s.headers))
-		headerFlags := &types.HeadersFlags{}
-		headersPayload := &types.HeadersPayload{}
-
-		offset := uint32(0) // offset is used to add space for streamdependency and priorityweight
-		if s.streamDependency != 0 {
-			headerFlags.Priority = true
-			offset = 5 // For the 5 bytes streamdependency and priorityweight uses
-			headersPayload.StreamDependency = s.streamDependency
-			headersPayload.PriorityWeight = s.priorityWeight
+		maxPayloadSize := c.setting(5)
+		hasTrailer := s.trailer != nil
+		endStream := len(s.data) == 0 && !s.streaming && !hasTrailer // A streamed response continues with DATA frames
+		for _, f := range newHeaderFrames(s, maxPayloadSize, endStream) {
+			frames.PushBack(f)
 		}
-
-		headerFramesNeeded := ((headerLength + offset) + maxPayloadSize - 1) / maxPayloadSize // Ceil of int division
-
-		if headerFramesNeeded == 1 {
-			headerFlags.EndHeaders = true
-			headersPayload.Fragment = s.headers
-		} else {
-			headersPayload.Fragment = s.headers[:maxPayloadSize-offset] // Subtracting offset in case priority flag is set
-		}
-
-		if len(s.data) == 0 {
-			headerFlags.EndStream = true
-		}
-
-		headerFrame := &frame.Frame{
-			ID:      s.id,
-			Type:    frame.HeadersType,
-			Flags:   headerFlags,
-			Payload: headersPayload,
-			Length:  uint32(len(headersPayload.Fragment)) + offset,
-		}
-		addFrame(headerFrame)
-		for i := uint32(1); i < headerFramesNeeded; i++ {
-			// Create Continuation frames for the remaining header bytes
-			var headerFragment []byte
-			flags := &types.ContinuationFlags{}
-			if i == headerFramesNeeded-1 {
-				flags.EndHeaders = true
-				headerFragment = s.headers[i*maxPayloadSize-offset:]
-			} else {
-				headerFragment = s.headers[i*maxPayloadSize-offset:][:maxPayloadSize]
+		if len(s.data) > 0 {
+			for _, f := range newDataFrames(s.id, s.data, maxPayloadSize, !hasTrailer) {
+				addFrame(f)
 			}
-			continuationFrame := &frame.Frame{
-				ID:    s.id,
-				Type:  frame.ContinuationType,
-				Flags: flags,
-				Payload: &types.ContinuationPayload{
-					HeaderFragment: headerFragment,
-				},
-				Length: uint32(len(headerFragment)),
-			}
-			addFrame(continuationFrame)
 		}
-		// Create payload frames
-		dataLength := uint32(len(s.data))
-		dataFramesNeeded := (dataLength + maxPayloadSize - 1) / maxPayloadSize // Ceil of int division
-		for i := uint32(0); i < dataFramesNeeded; i++ {
-
-			var data []byte
-			dataFlags := &types.DataFlags{}
+		if hasTrailer {
+			addFrame(newTrailerFrame(s.id, s.trailer))
+		}
+	}
 
-			if i == dataFramesNeeded-1 {
-				dataFlags.EndStream = true
-				data = s.data[i*maxPayloadSize:]
-			} else {
-				data = s.data[i*maxPayloadSize:][:maxPayloadSize]
-			}
+	// Takes the part of a DATA frame that the flow-control windows allows to be written.
+	// Returns nil if the stream is blocked.
+	consume := func(f *frame.Frame) *frame.Frame {
+		if f.Type != frame.DataType || f.Length == 0 {
+			return f
+		}
+		allowed := c.sendFlow.take(f.ID, f.Length)
+		if allowed == 0 {
+			return nil
+		}
+		if allowed < f.Length {
+			// Only a part of the frame can be sent, the rest stays in the queue
+			return splitDataFrame(f, allowed)
+		}
+		return f
+	}
 
-			dataFrame := &frame.Frame{
-				ID:    s.id,
-				Type:  frame.DataType,
-				Flags: dataFlags,
-				Payload: &types.DataPayload{
-					Data: data,
-				},
-				Length: uint32(len(data)),
-			}
-			addFrame(dataFrame)
+	// Finds and removes the next frame that can be written. Frames that are not DATA are written
+	// first, in the order they are queued, as HPACK requires header blocks to be written in the
+	// same order as they are encoded. DATA frames are ordered by the write scheduler.
+	// Returns true if the frame is from the write scheduler.
+	nextFrame := func() (*frame.Frame, bool) {
+		if first := frames.Front(); first != nil {
+			frames.Remove(first)
+			return first.Value.(*frame.Frame), false
 		}
+		var f *frame.Frame
+		c.withScheduler(func(ws WriteScheduler) { f = ws.Pop(consume) })
+		return f, true
 	}
 
 	// Listen for new writable streams or frame
@@ -123,35 +92,193 @@ func WriteStream(c *Conn) {
 			return
 		case stream := <-c.outChan:
 			addStream(stream)
+			continue
 		case frame := <-c.outChanFrame:
 			addFrame(frame)
+			continue
 		default:
-			if frames.Len() == 0 {
-				// If frame slice is empty reset the size to avoid memory leak
-				select {
-				// This select block is blocking, so this function doesn't use up
-				// resources endlessly looping
-				case <-c.ctx.Done():
-					return
-				case stream := <-c.outChan:
-					addStream(stream)
-				case frame := <-c.outChanFrame:
-					addFrame(frame)
-				}
-			}
-			// Write next frame
-			// fmt.Printf("Writing frame %+v\n with flags %+v\n and payload: %+v\n", frames[head], frames[head].Flags, frames[head].Payload)
-			frameToWrite := frames.Front()
-			if frameToWrite == nil {
+		}
+
+		f, scheduled := nextFrame()
+		if f == nil {
+			select {
+			// This select block is blocking, so this function doesn't use up
+			// resources endlessly looping. It waits for new frames or flow-control credit
+			case <-c.ctx.Done():
 				return
+			case stream := <-c.outChan:
+				addStream(stream)
+			case frame := <-c.outChanFrame:
+				addFrame(frame)
+			case <-c.flowSignal:
 			}
-			frameValue := frameToWrite.Value
-			if frameValue == nil {
-				return
+			continue
+		}
+
+		// DATA frames and trailers queued before a stream was reset are dropped, and the flow-control credit is given back
+		if scheduled && !c.canSendData(f.ID) {
+			if f.Type == frame.DataType {
+				c.sendFlow.addConn(f.Length)
+				c.dataWritten(f)
 			}
+			continue
+		}
 
-			c.tlsConn.Write(frameValue.(*frame.Frame).ToBytes())
-			frames.Remove(frameToWrite)
+		// Write next frame. Trailers are queued as a single HEADERS frame, and are split when they are
+		// written, so no other frame is written between the HEADERS frame and its CONTINUATION frames.
+		if f.Type == frame.HeadersType && scheduled {
+			trailer := &Stream{id: f.ID, headers: f.Payload.(*types.HeadersPayload).Fragment}
+			for _, part := range newHeaderFrames(trailer, c.setting(5), true) {
+				c.rw.Write(part.ToBytes())
+			}
+		} else {
+			c.rw.Write(f.ToBytes())
+		}
+
+		if f.Type == frame.DataType {
+			c.dataWritten(f)
+		}
+		if endsStream(f) && c.bodyAbandoned(f.ID) {
+			// The client is asked to stop sending a request body the handler did not read - RFC7540 Section 8.1
+			frames.PushBack(frame.NewErrorFrame(f.ID, constants.NoError))
+		}
+		c.frameSent(f)
+		// A connection error closes the connection - RFC7540 Section 5.4.1
+		if f.Type == frame.GoAwayType && f.Payload.(*types.GoAwayPayload).ErrorCode != constants.NoError {
+			c.close()
+			return
 		}
+		// When a GOAWAY has been sent, close the connection as soon as everything is written
+		if frames.Len() == 0 && c.drained() {
+			c.close()
+			return
+		}
+	}
+}
+
+// NewHeaderFrames creates the HEADERS frame, and the CONTINUATION frames needed, of a stream's encoded headers
+func newHeaderFrames(s *Stream, maxPayloadSize uint32, endStream bool) []*frame.Frame {
+	frames := make([]*frame.Frame, 0, 1)
+	headerLength := uint32(len(s.headers))
+	headerFlags := &types.HeadersFlags{EndStream: endStream}
+	headersPayload := &types.HeadersPayload{}
+
+	offset := uint32(0) // offset is used to add space for streamdependency and priorityweight
+	if s.streamDependency != 0 {
+		headerFlags.Priority = true
+		offset = 5 // For the 5 bytes streamdependency and priorityweight uses
+		headersPayload.StreamDependency = s.streamDependency
+		headersPayload.PriorityWeight = s.priorityWeight
+	}
+
+	headerFramesNeeded := ((headerLength + offset) + maxPayloadSize - 1) / maxPayloadSize // Ceil of int division
+
+	if headerFramesNeeded <= 1 {
+		headerFlags.EndHeaders = true
+		headersPayload.Fragment = s.headers
+	} else {
+		headersPayload.Fragment = s.headers[:maxPayloadSize-offset] // Subtracting offset in case priority flag is set
+	}
+
+	frames = append(frames, &frame.Frame{
+		ID:      s.id,
+		Type:    frame.HeadersType,
+		Flags:   headerFlags,
+		Payload: headersPayload,
+		Length:  uint32(len(headersPayload.Fragment)) + offset,
+	})
+	for i := uint32(1); i < headerFramesNeeded; i++ {
+		// Create Continuation frames for the remaining header bytes
+		var headerFragment []byte
+		flags := &types.ContinuationFlags{}
+		if i == headerFramesNeeded-1 {
+			flags.EndHeaders = true
+			headerFragment = s.headers[i*maxPayloadSize-offset:]
+		} else {
+			headerFragment = s.headers[i*maxPayloadSize-offset:][:maxPayloadSize]
+		}
+		frames = append(frames, &frame.Frame{
+			ID:    s.id,
+			Type:  frame.ContinuationType,
+			Flags: flags,
+			Payload: &types.ContinuationPayload{
+				HeaderFragment: headerFragment,
+			},
+			Length: uint32(len(headerFragment)),
+		})
+	}
+	return frames
+}
+
+// NewTrailerFrame creates a HEADERS frame with the encoded trailers of a stream, which ends the stream.
+// The frame is split into CONTINUATION frames by the writer if needed.
+func newTrailerFrame(streamID uint32, trailer []byte) *frame.Frame {
+	return &frame.Frame{
+		ID:      streamID,
+		Type:    frame.HeadersType,
+		Flags:   &types.HeadersFlags{EndHeaders: true, EndStream: true},
+		Payload: &types.HeadersPayload{Fragment: trailer},
+		Length:  uint32(len(trailer)),
+	}
+}
+
+// NewDataFrames splits data into DATA frames no larger than the max payload size.
+// An empty DATA frame is created if there is no data, so the stream can be ended.
+func newDataFrames(streamID uint32, data []byte, maxPayloadSize uint32, endStream bool) []*frame.Frame {
+	dataLength := uint32(len(data))
+	dataFramesNeeded := (dataLength + maxPayloadSize - 1) / maxPayloadSize // Ceil of int division
+	if dataFramesNeeded == 0 {
+		dataFramesNeeded = 1
+	}
+	frames := make([]*frame.Frame, 0, dataFramesNeeded)
+	for i := uint32(0); i < dataFramesNeeded; i++ {
+		var chunk []byte
+		dataFlags := &types.DataFlags{}
+
+		if i == dataFramesNeeded-1 {
+			dataFlags.EndStream = endStream
+			chunk = data[i*maxPayloadSize:]
+		} else {
+			chunk = data[i*maxPayloadSize:][:maxPayloadSize]
+		}
+
+		frames = append(frames, &frame.Frame{
+			ID:    streamID,
+			Type:  frame.DataType,
+			Flags: dataFlags,
+			Payload: &types.DataPayload{
+				Data: chunk,
+			},
+			Length: uint32(len(chunk)),
+		})
+	}
+	return frames
+}
+
+// SplitDataFrame splits the first n bytes of a DATA frame into a new frame. The given frame keeps the rest.
+func splitDataFrame(f *frame.Frame, n uint32) *frame.Frame {
+	payload := f.Payload.(*types.DataPayload)
+	head := &frame.Frame{
+		ID:    f.ID,
+		Type:  frame.DataType,
+		Flags: &types.DataFlags{},
+		Payload: &types.DataPayload{
+			Data: payload.Data[:n],
+		},
+		Length: n,
+	}
+	payload.Data = payload.Data[n:]
+	f.Length -= n
+	return head
+}
+
+// EndsStream checks if a frame is the last frame the server sends on a stream
+func endsStream(f *frame.Frame) bool {
+	switch flags := f.Flags.(type) {
+	case *types.HeadersFlags:
+		return flags.EndStream
+	case *types.DataFlags:
+		return flags.EndStream
 	}
+	return f.Type == frame.RstStreamType
 }
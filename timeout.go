@@ -0,0 +1,131 @@
+package opal
+
+import (
+	"context"
+	"errors"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"strconv"
+	"time"
+)
+
+/*
+	This file contains the handler timeouts. When a timeout expires
+	the request context is cancelled, and the client gets a
+	503 response, or a reset stream if the response is already
+	being streamed.
+*/
+
+// ErrHandlerTimeout is returned when writing a response after the handler timeout has expired
+var ErrHandlerTimeout = errors.New("opal: Handler timeout")
+
+// SetHandlerTimeout sets how long the handlers of a request may run. Zero means no timeout, which
+// is the default. Routes can override it with Router.Timeout.
+func (s *Server) SetHandlerTimeout(timeout time.Duration) {
+	s.handlerTimeout = timeout
+}
+
+// ------- HELPERS ---------
+
+// handlerWriter is the http.StreamWriter of a response whose handlers may time out or panic
+type handlerWriter interface {
+	timeout() bool                  // Stops the handlers from writing, and says if the headers are not sent
+	reset(code constants.ErrorCode) // Aborts a response whose headers are sent
+}
+
+// RunHandlers serves a request, bounded by the handler timeout of its route. Returns the response to send,
+// which is a 503 response if the timeout expired, or a 500 response if the handlers panicked.
+// Returns nil if nothing more should be sent on the stream.
+// The writer is nil if the response can not be streamed.
+func runHandlers(conn *Conn, req *http.Request, res *http.Response, writer handlerWriter) *http.Response {
+	// A response that is partly sent when the handlers panic can only be aborted
+	finish := func(ok bool) *http.Response {
+		if !ok && writer != nil && res.Committed() {
+			writer.reset(constants.InternalError)
+			return nil
+		}
+		return res
+	}
+
+	m := conn.server.findRoute(req)
+	timeout := conn.server.timeoutOf(m.route)
+	if timeout == 0 {
+		return finish(serveResponse(conn, req, res, m))
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	req.SetContext(ctx)
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- serveResponse(conn, req, res, m)
+	}()
+
+	select {
+	case ok := <-done:
+		return finish(ok)
+	case <-ctx.Done():
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		// The stream is reset or the connection closed, and the handlers are told so by the context
+		return finish(<-done)
+	}
+
+	// The handlers may still be running, but what they write is never sent
+	conn.trackOverdue(done)
+	if writer == nil || writer.timeout() {
+		timeoutRes := http.NewResponse(req)
+		timeoutRes.String(503, "Service Unavailable")
+		timeoutRes.Header["content-length"] = strconv.Itoa(len(timeoutRes.Body))
+		return timeoutRes
+	}
+	writer.reset(constants.Cancel) // The headers are already sent
+	return nil
+}
+
+// TimeoutOf returns the handler timeout of a route, or the server's timeout if the route has none
+func (s *Server) timeoutOf(route *router.Route) time.Duration {
+	if route != nil && route.HandlerTimeout() != 0 {
+		return route.HandlerTimeout()
+	}
+	return s.handlerTimeout
+}
+
+// TrackOverdue counts handlers that are still running after their timeout expired, until they return.
+// Overdue handlers count as open streams on HTTP/2 connections, and a HTTP/1.1 connection does not
+// read the next request before they are done, so a client can not pile up handlers that never return.
+func (c *Conn) trackOverdue(done chan bool) {
+	c.mu.Lock()
+	c.overdue++
+	c.mu.Unlock()
+	go func() {
+		<-done
+		c.mu.Lock()
+		c.overdue--
+		c.mu.Unlock()
+		select {
+		case c.overdueDone <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// WaitOverdue waits until the overdue handlers of the connection have returned.
+// Returns false if the connection is closed first.
+func (c *Conn) waitOverdue() bool {
+	for {
+		c.mu.Lock()
+		overdue := c.overdue
+		c.mu.Unlock()
+		if overdue == 0 {
+			return true
+		}
+		select {
+		case <-c.overdueDone:
+		case <-c.ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package opal
+
+import (
+	"context"
+	"github.com/SveinungOverland/opal/constants"
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+	"time"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	errChan := make(chan error, 1)
+	r := router.NewRouter("/")
+	r.Get("/slow", func(req *http.Request, res *http.Response) {
+		<-req.Context().Done()
+		errChan <- req.Context().Err()
+		res.String(200, "too late")
+	})
+
+	srv := NewServer()
+	srv.SetHandlerTimeout(50 * time.Millisecond)
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/slow", "GET", true)
+
+	headers := client.readHeaders(t, 1)
+	validateHeaderFields(t, headers, []*hpack.HeaderField{
+		hf(":status", "503"),
+		hf("content-type", "text/plain; charset=utf-8"),
+		hf("content-length", "19"),
+	})
+	if err := <-errChan; err != context.DeadlineExceeded {
+		t.Errorf("Request context was not cancelled by the timeout. Got %v", err)
+	}
+}
+
+func TestRouteTimeoutResetsStream(t *testing.T) {
+	r := router.NewRouter("/")
+	r.Timeout("/stream", 50*time.Millisecond)
+	r.Get("/stream", func(req *http.Request, res *http.Response) {
+		res.Flush()
+		<-req.Context().Done()
+	})
+
+	srv := NewServer()
+	srv.SetHandlerTimeout(time.Minute) // The route's timeout overrides the server's
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/stream", "GET", true)
+
+	// The headers are already sent, so the stream is reset
+	client.readFrame(t, frame.HeadersType, 1)
+	rst := client.readFrame(t, frame.RstStreamType, 1)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.Cancel {
+		t.Errorf("Incorrect error code! Expected %d, got %d", constants.Cancel, code)
+	}
+}
+
+func TestOverdueHandlerCountsAsStream(t *testing.T) {
+	release := make(chan struct{})
+	r := router.NewRouter("/")
+	r.Get("/stuck", func(req *http.Request, res *http.Response) {
+		<-release // The handler does not return when the timeout expires
+	})
+	r.Get("/", func(req *http.Request, res *http.Response) {
+		res.String(200, "OK")
+	})
+
+	srv := NewServer()
+	srv.SetHandlerTimeout(50 * time.Millisecond)
+	srv.SetMaxConcurrentStreams(1)
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+	client.writeHeaders(1, "/stuck", "GET", true)
+	validateHeaderFields(t, client.readHeaders(t, 1)[:1], []*hpack.HeaderField{hf(":status", "503")})
+	client.readFrame(t, frame.DataType, 1)
+
+	// The handler is still running, so there is no room for another stream
+	client.writeHeaders(3, "/", "GET", true)
+	rst := client.readFrame(t, frame.RstStreamType, 3)
+	if code := rst.Payload.(*types.RstStreamPayload).ErrorCode; code != constants.RefusedStream {
+		t.Errorf("Incorrect error code! Expected %d, got %d", constants.RefusedStream, code)
+	}
+
+	close(release)
+	client.server.waitOverdue()
+	client.writeHeaders(5, "/", "GET", true)
+	validateHeaderFields(t, client.readHeaders(t, 5)[:1], []*hpack.HeaderField{hf(":status", "200")})
+}
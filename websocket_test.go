@@ -0,0 +1,45 @@
+package opal
+
+import (
+	"github.com/SveinungOverland/opal/frame"
+	"github.com/SveinungOverland/opal/frame/types"
+	"github.com/SveinungOverland/opal/hpack"
+	"github.com/SveinungOverland/opal/http"
+	"github.com/SveinungOverland/opal/router"
+	"testing"
+)
+
+func TestWebSocket(t *testing.T) {
+	r := router.NewRouter("/")
+	r.WebSocket("/echo", func(req *http.Request, ws *http.WebSocket) {
+		msgType, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Errorf("Reading message failed: %v", err)
+			return
+		}
+		ws.WriteMessage(msgType, msg)
+	})
+
+	srv := NewServer()
+	srv.Register(r)
+	client := newPipeClient(srv)
+	defer client.conn.Close()
+	client.handshake()
+
+	fragment := client.hpack.Encode([]*hpack.HeaderField{
+		hf(":method", "CONNECT"),
+		hf(":protocol", "websocket"),
+		hf(":scheme", "https"),
+		hf(":path", "/echo"),
+		hf("sec-websocket-version", "13"),
+	})
+	client.writeFrame(newTestHeadersFrame(1, fragment, true, false))
+	validateHeaderFields(t, client.readHeaders(t, 1), []*hpack.HeaderField{hf(":status", "200")})
+
+	// A masked text frame with the message "hi"
+	client.writeFrame(newTestData(1, "\x81\x82\x01\x02\x03\x04"+string([]byte{'h' ^ 1, 'i' ^ 2}), false))
+	data := client.readFrame(t, frame.DataType, 1)
+	if msg := string(data.Payload.(*types.DataPayload).Data); msg != "\x81\x02hi" {
+		t.Errorf("Incorrect message! Expected %q, got %q", "\x81\x02hi", msg)
+	}
+}